@@ -0,0 +1,287 @@
+// Package ballot implements the client and trustee side of encrypted elections.
+//
+// Ballots are encrypted with exponential ElGamal in the 2048-bit MODP group of
+// RFC 3526 with generator 2, the same group the chaincode decrypts in. A ballot
+// holds one ciphertext (g^r, g^m * h^r) per candidate, in the order returned by
+// getEncryptionInfo, for the election key h = g^x, of m = 1 for the chosen
+// candidate and m = 0 for the others. It proves every ciphertext encrypts 0 or
+// 1 and that they add up to 1. Multiplying ciphertexts adds what they
+// encrypt, so the chaincode multiplies the ballots into one sum per candidate,
+// as they are cast in homomorphic elections and once the election ends in
+// encrypted ones, and only the sums are ever decrypted.
+//
+// The secret x is split between trustees with Shamir secret sharing. Each
+// trustee turns its share x_i into decryption shares c1^x_i of the sums on
+// their own machine, see cmd/trusteeshare, and any threshold of them decrypt.
+// Every decryption share comes with a proof that it was computed with the
+// share whose public part g^x_i the election records.
+package ballot
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+var (
+	groupP, _ = new(big.Int).SetString(
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+			"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+			"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+			"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF05"+
+			"98DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB"+
+			"9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B"+
+			"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF695581718"+
+			"3995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF", 16)
+	// order of the subgroup generated by groupG
+	groupQ = new(big.Int).Rsh(groupP, 1)
+	groupG = big.NewInt(2)
+)
+
+// Ciphertext is an ElGamal ciphertext with hex encoded components, in the
+// JSON form the chaincode stores
+type Ciphertext struct {
+	C1 string `json:"c1"`
+	C2 string `json:"c2"`
+}
+
+// Sum is the ciphertext of a candidate's vote count, Key is the candidate ID,
+// as getEncryptedBallots lists them
+type Sum struct {
+	Key string `json:"key"`
+	Ciphertext
+}
+
+// KeyShare is the part of the election secret held by one trustee, with its
+// public part g^x_i the election records to check decryption shares
+type KeyShare struct {
+	Index     int    `json:"index"`
+	Secret    string `json:"secret"`
+	PublicKey string `json:"publicKey"`
+}
+
+// PartialDecryption is a decryption share c1^x_i in hex with the proof that
+// it was computed with the trustee's key share
+type PartialDecryption struct {
+	Share string `json:"share"`
+	Proof Proof  `json:"proof"`
+}
+
+// GenerateKey creates an election key split into one share per trustee, any
+// threshold of which can decrypt. It returns the hex encoded public key.
+func GenerateKey(threshold, trustees int) (string, []KeyShare, error) {
+	if threshold < 1 || threshold > trustees {
+		return "", nil, errors.New("threshold must be between 1 and the number of trustees")
+	}
+
+	// random polynomial of degree threshold-1, its constant term is the secret
+	coefficients := make([]*big.Int, threshold)
+	for i := range coefficients {
+		c, err := rand.Int(rand.Reader, groupQ)
+		if err != nil {
+			return "", nil, err
+		}
+		coefficients[i] = c
+	}
+
+	shares := make([]KeyShare, trustees)
+	for i := range shares {
+		x := big.NewInt(int64(i + 1))
+		y := new(big.Int)
+		for j := len(coefficients) - 1; j >= 0; j-- {
+			y.Mul(y, x).Add(y, coefficients[j]).Mod(y, groupQ)
+		}
+		shares[i] = KeyShare{
+			Index:     i + 1,
+			Secret:    y.Text(16),
+			PublicKey: new(big.Int).Exp(groupG, y, groupP).Text(16),
+		}
+	}
+
+	publicKey := new(big.Int).Exp(groupG, coefficients[0], groupP)
+	return publicKey.Text(16), shares, nil
+}
+
+// EncryptedBallot is a ballot in the JSON form the chaincode takes, one
+// ciphertext and proof per candidate and the proof of their sum
+type EncryptedBallot struct {
+	Choices  []Ciphertext   `json:"choices"`
+	Proofs   []ZeroOneProof `json:"proofs"`
+	SumProof Proof          `json:"sumProof"`
+}
+
+// EncryptChoices encrypts a ballot of the election for the choice-th of
+// candidates (1-based), one ciphertext per candidate
+func EncryptChoices(publicKey, electionID string, choice, candidates int) (EncryptedBallot, error) {
+	h, err := parseElement(publicKey)
+	if err != nil {
+		return EncryptedBallot{}, fmt.Errorf("invalid public key")
+	}
+	if choice < 1 || choice > candidates {
+		return EncryptedBallot{}, errors.New("choice must be between 1 and the number of candidates")
+	}
+	context := proofContext(electionID)
+
+	ballot := EncryptedBallot{
+		Choices: make([]Ciphertext, candidates),
+		Proofs:  make([]ZeroOneProof, candidates),
+	}
+	// the product of the ciphertexts is (g^R, g * h^R) for R the sum of the r
+	product := [2]*big.Int{big.NewInt(1), big.NewInt(1)}
+	randomness := new(big.Int)
+	for k := range ballot.Choices {
+		m := 0
+		if k+1 == choice {
+			m = 1
+		}
+		r, err := rand.Int(rand.Reader, groupQ)
+		if err != nil {
+			return EncryptedBallot{}, err
+		}
+		c1, c2 := encryptWith(h, m, r)
+		ballot.Choices[k] = Ciphertext{C1: c1.Text(16), C2: c2.Text(16)}
+		if ballot.Proofs[k], err = proveZeroOne(context, h, c1, c2, r, m); err != nil {
+			return EncryptedBallot{}, err
+		}
+		product[0].Mul(product[0], c1).Mod(product[0], groupP)
+		product[1].Mul(product[1], c2).Mod(product[1], groupP)
+		randomness.Add(randomness, r).Mod(randomness, groupQ)
+	}
+	y := product[1].Mul(product[1], new(big.Int).ModInverse(groupG, groupP))
+	ballot.SumProof, err = proveDLEQ(context, randomness, groupG, product[0], h, y.Mod(y, groupP))
+	if err != nil {
+		return EncryptedBallot{}, err
+	}
+	return ballot, nil
+}
+
+// Add returns a ciphertext of the sum of what a and b encrypt
+func Add(a, b Ciphertext) (Ciphertext, error) {
+	var sum [2]string
+	for i, pair := range [][2]string{{a.C1, b.C1}, {a.C2, b.C2}} {
+		x, err := parseElement(pair[0])
+		if err != nil {
+			return Ciphertext{}, err
+		}
+		y, err := parseElement(pair[1])
+		if err != nil {
+			return Ciphertext{}, err
+		}
+		sum[i] = x.Mul(x, y).Mod(x, groupP).Text(16)
+	}
+	return Ciphertext{C1: sum[0], C2: sum[1]}, nil
+}
+
+// encryptWith returns (g^r, g^m * h^r)
+func encryptWith(h *big.Int, m int, r *big.Int) (*big.Int, *big.Int) {
+	c1 := new(big.Int).Exp(groupG, r, groupP)
+	c2 := new(big.Int).Exp(groupG, big.NewInt(int64(m)), groupP)
+	c2.Mul(c2, new(big.Int).Exp(h, r, groupP)).Mod(c2, groupP)
+	return c1, c2
+}
+
+// DecryptionShares returns the trustee's proven shares of the sums, keyed by
+// candidate like the sums, in the form submitDecryptionShare takes
+func DecryptionShares(share KeyShare, electionID string, sums []Sum) (map[string]PartialDecryption, error) {
+	shares := make(map[string]PartialDecryption, len(sums))
+	for _, sum := range sums {
+		d, err := DecryptionShare(share, electionID, sum.Ciphertext)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", sum.Key, err)
+		}
+		shares[sum.Key] = d
+	}
+	return shares, nil
+}
+
+// DecryptionShare returns the trustee's share c1^x_i for a ciphertext of the
+// election, proven against the public part of the key share
+func DecryptionShare(share KeyShare, electionID string, c Ciphertext) (PartialDecryption, error) {
+	x, ok := new(big.Int).SetString(share.Secret, 16)
+	if !ok || x.Sign() < 0 || x.Cmp(groupQ) >= 0 {
+		return PartialDecryption{}, errors.New("invalid key share")
+	}
+	c1, err := parseElement(c.C1)
+	if err != nil {
+		return PartialDecryption{}, err
+	}
+	y1 := new(big.Int).Exp(groupG, x, groupP)
+	d := new(big.Int).Exp(c1, x, groupP)
+	proof, err := proveDLEQ(proofContext(electionID), x, groupG, y1, c1, d)
+	if err != nil {
+		return PartialDecryption{}, err
+	}
+	return PartialDecryption{Share: d.Text(16), Proof: proof}, nil
+}
+
+// DecryptCount combines decryption shares of a sum and returns the count it
+// holds, looking at most at max
+func DecryptCount(c Ciphertext, shares map[int]string, max int) (int, error) {
+	m, err := combine(c, shares)
+	if err != nil {
+		return 0, err
+	}
+
+	acc := big.NewInt(1)
+	for k := 0; k <= max; k++ {
+		if acc.Cmp(m) == 0 {
+			return k, nil
+		}
+		acc.Mul(acc, groupG).Mod(acc, groupP)
+	}
+	return 0, errors.New("ciphertext does not decrypt to a count")
+}
+
+// combine decrypts a ciphertext to g^m from the shares, using c1^x = prod d_i^lambda_i
+func combine(c Ciphertext, shares map[int]string) (*big.Int, error) {
+	c2, err := parseElement(c.C2)
+	if err != nil {
+		return nil, err
+	}
+
+	var trustees []int
+	for i := range shares {
+		trustees = append(trustees, i)
+	}
+	sort.Ints(trustees)
+
+	cx := big.NewInt(1)
+	for j, lambda := range lagrangeAtZero(trustees) {
+		d, err := parseElement(shares[trustees[j]])
+		if err != nil {
+			return nil, err
+		}
+		cx.Mul(cx, new(big.Int).Exp(d, lambda, groupP)).Mod(cx, groupP)
+	}
+	m := new(big.Int).Mul(c2, new(big.Int).ModInverse(cx, groupP))
+	return m.Mod(m, groupP), nil
+}
+
+// lagrangeAtZero returns the Lagrange coefficients, mod q, that interpolate
+// the shared secret at zero from the shares of the given trustees
+func lagrangeAtZero(trustees []int) []*big.Int {
+	lambdas := make([]*big.Int, len(trustees))
+	for j, i := range trustees {
+		num, den := big.NewInt(1), big.NewInt(1)
+		for _, k := range trustees {
+			if k == i {
+				continue
+			}
+			num.Mul(num, big.NewInt(int64(k)))
+			den.Mul(den, big.NewInt(int64(k-i)))
+		}
+		den.Mod(den, groupQ)
+		lambdas[j] = num.Mul(num, den.ModInverse(den, groupQ)).Mod(num, groupQ)
+	}
+	return lambdas
+}
+
+func parseElement(value string) (*big.Int, error) {
+	n, ok := new(big.Int).SetString(value, 16)
+	if !ok || n.Cmp(big.NewInt(1)) <= 0 || n.Cmp(groupP) >= 0 {
+		return nil, errors.New("invalid group element")
+	}
+	return n, nil
+}
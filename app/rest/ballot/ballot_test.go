@@ -0,0 +1,210 @@
+package ballot
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestThresholdDecryption(t *testing.T) {
+	publicKey, shares, err := GenerateKey(2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ballot, err := EncryptChoices(publicKey, "e", 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sums := []Sum{{Key: "candidate.a", Ciphertext: ballot.Choices[0]}, {Key: "candidate.b", Ciphertext: ballot.Choices[1]}}
+
+	// any two trustees decrypt
+	for _, pair := range [][2]int{{0, 1}, {0, 2}, {1, 2}} {
+		decryptionShares := map[string]map[int]string{}
+		for _, i := range pair {
+			d, err := DecryptionShares(shares[i], "e", sums)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, share := range d {
+				if decryptionShares[key] == nil {
+					decryptionShares[key] = map[int]string{}
+				}
+				decryptionShares[key][shares[i].Index] = share.Share
+			}
+		}
+		for k, expected := range []int{0, 1} {
+			count, err := DecryptCount(sums[k].Ciphertext, decryptionShares[sums[k].Key], 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != expected {
+				t.Errorf("%s: expected %d, got %d", sums[k].Key, expected, count)
+			}
+		}
+	}
+
+	// a single trustee does not
+	d, err := DecryptionShare(shares[0], "e", sums[1].Ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := DecryptCount(sums[1].Ciphertext, map[int]string{shares[0].Index: d.Share}, 1); err == nil {
+		t.Errorf("expected decryption to fail with one share, got %d", count)
+	}
+}
+
+func TestHomomorphicSum(t *testing.T) {
+	publicKey, shares, err := GenerateKey(2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// three ballots for candidate 1, 2 and 1 of 3
+	var sums []Ciphertext
+	for _, choice := range []int{1, 2, 1} {
+		ballot, err := EncryptChoices(publicKey, "e", choice, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sums == nil {
+			sums = ballot.Choices
+			continue
+		}
+		for k := range sums {
+			if sums[k], err = Add(sums[k], ballot.Choices[k]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for k, expected := range []int{2, 1, 0} {
+		decryptionShares := make(map[int]string)
+		for _, share := range shares[1:] {
+			d, err := DecryptionShare(share, "e", sums[k])
+			if err != nil {
+				t.Fatal(err)
+			}
+			decryptionShares[share.Index] = d.Share
+		}
+		count, err := DecryptCount(sums[k], decryptionShares, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != expected {
+			t.Errorf("candidate %d: expected %d votes, got %d", k+1, expected, count)
+		}
+	}
+
+	if _, err := EncryptChoices(publicKey, "e", 4, 3); err == nil {
+		t.Errorf("expected error for a choice beyond the candidates")
+	}
+}
+
+func TestGenerateKeyThreshold(t *testing.T) {
+	if _, _, err := GenerateKey(3, 2); err == nil {
+		t.Errorf("expected error for threshold above the number of trustees")
+	}
+	if _, _, err := GenerateKey(0, 2); err == nil {
+		t.Errorf("expected error for zero threshold")
+	}
+}
+
+// verifyDLEQ checks a proof the way the chaincode does
+func verifyDLEQ(context string, g1, y1, g2, y2 *big.Int, proof Proof) bool {
+	e, _ := new(big.Int).SetString(proof.E, 16)
+	f, _ := new(big.Int).SetString(proof.F, 16)
+	if e == nil || f == nil {
+		return false
+	}
+	a, b := simulate(g1, y1, e, f), simulate(g2, y2, e, f)
+	return challenge("dleq", context, g1, y1, g2, y2, a, b).Cmp(e) == 0
+}
+
+// verifyZeroOne checks a proof the way the chaincode does
+func verifyZeroOne(context string, h, c1, c2 *big.Int, proof ZeroOneProof) bool {
+	sum := new(big.Int)
+	var commitments []*big.Int
+	for m, p := range [][2]string{{proof.E0, proof.F0}, {proof.E1, proof.F1}} {
+		e, _ := new(big.Int).SetString(p[0], 16)
+		f, _ := new(big.Int).SetString(p[1], 16)
+		if e == nil || f == nil {
+			return false
+		}
+		y := new(big.Int).Exp(groupG, big.NewInt(int64(m)), groupP)
+		y.Mul(c2, y.ModInverse(y, groupP)).Mod(y, groupP)
+		sum.Add(sum, e)
+		commitments = append(commitments, simulate(groupG, c1, e, f), simulate(h, y, e, f))
+	}
+	return challenge("zero-one", context, append([]*big.Int{h, c1, c2}, commitments...)...).Cmp(sum.Mod(sum, groupQ)) == 0
+}
+
+func TestDecryptionShareProof(t *testing.T) {
+	publicKey, shares, err := GenerateKey(2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ballot, err := EncryptChoices(publicKey, "e", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := ballot.Choices[0]
+	d, err := DecryptionShare(shares[0], "e", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	y1, _ := parseElement(shares[0].PublicKey)
+	c1, _ := parseElement(c.C1)
+	share, _ := parseElement(d.Share)
+	if !verifyDLEQ("election.e", groupG, y1, c1, share, d.Proof) {
+		t.Error("expected the proof to verify")
+	}
+	if verifyDLEQ("election.other", groupG, y1, c1, share, d.Proof) {
+		t.Error("expected the proof not to verify for another election")
+	}
+	other, _ := parseElement(shares[1].PublicKey)
+	if verifyDLEQ("election.e", groupG, other, c1, share, d.Proof) {
+		t.Error("expected the proof not to verify against another trustee's key")
+	}
+	forged := new(big.Int).Mul(share, groupG)
+	if verifyDLEQ("election.e", groupG, y1, c1, forged.Mod(forged, groupP), d.Proof) {
+		t.Error("expected the proof not to verify for another share")
+	}
+}
+
+func TestEncryptedBallotProofs(t *testing.T) {
+	publicKey, _, err := GenerateKey(2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := parseElement(publicKey)
+	ballot, err := EncryptChoices(publicKey, "e", 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	product := [2]*big.Int{big.NewInt(1), big.NewInt(1)}
+	for k, c := range ballot.Choices {
+		c1, _ := parseElement(c.C1)
+		c2, _ := parseElement(c.C2)
+		if !verifyZeroOne("election.e", h, c1, c2, ballot.Proofs[k]) {
+			t.Errorf("expected the proof of ciphertext %d to verify", k+1)
+		}
+		if verifyZeroOne("election.other", h, c1, c2, ballot.Proofs[k]) {
+			t.Errorf("expected the proof of ciphertext %d not to verify for another election", k+1)
+		}
+		product[0].Mul(product[0], c1).Mod(product[0], groupP)
+		product[1].Mul(product[1], c2).Mod(product[1], groupP)
+	}
+	y := product[1].Mul(product[1], new(big.Int).ModInverse(groupG, groupP))
+	if !verifyDLEQ("election.e", groupG, product[0], h, y.Mod(y, groupP), ballot.SumProof) {
+		t.Error("expected the sum proof to verify")
+	}
+
+	// the proof of a ciphertext does not carry over to one of g^2
+	c1, _ := parseElement(ballot.Choices[1].C1)
+	c2, _ := parseElement(ballot.Choices[1].C2)
+	c2.Mul(c2, groupG).Mod(c2, groupP)
+	if verifyZeroOne("election.e", h, c1, c2, ballot.Proofs[1]) {
+		t.Error("expected the proof not to verify for another plaintext")
+	}
+}
@@ -0,0 +1,110 @@
+package ballot
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"math/big"
+	"strings"
+)
+
+// Proofs are non-interactive Chaum-Pedersen proofs in the form the chaincode
+// checks them. A proof (e, f) that log_g1(y1) = log_g2(y2) = x commits to
+// a = g1^w and b = g2^w for a random w, takes e from the hash of the statement
+// and the commitments and answers f = w + e*x. The hash covers the election
+// ID, so a proof does not carry over to another election.
+
+// Proof proves two discrete logarithms equal, e and f are hex mod q
+type Proof struct {
+	E string `json:"e"`
+	F string `json:"f"`
+}
+
+// ZeroOneProof proves a ciphertext encrypts 0 or 1, one proof per plaintext
+// of which only the one for the encrypted plaintext is real. The challenges
+// add up to the hash, so the voter can only simulate one of them.
+type ZeroOneProof struct {
+	E0 string `json:"e0"`
+	F0 string `json:"f0"`
+	E1 string `json:"e1"`
+	F1 string `json:"f1"`
+}
+
+// challenge hashes the tag, the context and the elements into a challenge mod
+// q, exactly as the chaincode does
+func challenge(tag, context string, elements ...*big.Int) *big.Int {
+	parts := []string{"fabric-voting", tag, context}
+	for _, element := range elements {
+		parts = append(parts, element.Text(16))
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "|")))
+	return new(big.Int).Mod(new(big.Int).SetBytes(sum[:]), groupQ)
+}
+
+// proofContext is the election ID the chaincode stores the election under
+func proofContext(electionID string) string {
+	if !strings.HasPrefix(electionID, "election.") {
+		return "election." + electionID
+	}
+	return electionID
+}
+
+// proveDLEQ proves log_g1(y1) = log_g2(y2) = x
+func proveDLEQ(context string, x, g1, y1, g2, y2 *big.Int) (Proof, error) {
+	w, err := rand.Int(rand.Reader, groupQ)
+	if err != nil {
+		return Proof{}, err
+	}
+	a := new(big.Int).Exp(g1, w, groupP)
+	b := new(big.Int).Exp(g2, w, groupP)
+	e := challenge("dleq", context, g1, y1, g2, y2, a, b)
+	f := new(big.Int).Mul(e, x)
+	f.Add(f, w).Mod(f, groupQ)
+	return Proof{E: e.Text(16), F: f.Text(16)}, nil
+}
+
+// proveZeroOne proves (c1, c2) = (g^r, g^m * h^r) encrypts m, 0 or 1
+func proveZeroOne(context string, h, c1, c2, r *big.Int, m int) (ZeroOneProof, error) {
+	// c2 / g^k = h^r for k = m only
+	ys := make([]*big.Int, 2)
+	for k := range ys {
+		gk := new(big.Int).Exp(groupG, big.NewInt(int64(k)), groupP)
+		ys[k] = gk.Mul(c2, gk.ModInverse(gk, groupP)).Mod(gk, groupP)
+	}
+
+	// simulate the other plaintext from a chosen challenge and answer
+	es, fs := make([]*big.Int, 2), make([]*big.Int, 2)
+	commitments := make([]*big.Int, 4)
+	other := 1 - m
+	var err error
+	if es[other], err = rand.Int(rand.Reader, groupQ); err != nil {
+		return ZeroOneProof{}, err
+	}
+	if fs[other], err = rand.Int(rand.Reader, groupQ); err != nil {
+		return ZeroOneProof{}, err
+	}
+	commitments[2*other] = simulate(groupG, c1, es[other], fs[other])
+	commitments[2*other+1] = simulate(h, ys[other], es[other], fs[other])
+
+	w, err := rand.Int(rand.Reader, groupQ)
+	if err != nil {
+		return ZeroOneProof{}, err
+	}
+	commitments[2*m] = new(big.Int).Exp(groupG, w, groupP)
+	commitments[2*m+1] = new(big.Int).Exp(h, w, groupP)
+
+	e := challenge("zero-one", context, append([]*big.Int{h, c1, c2}, commitments...)...)
+	es[m] = e.Sub(e, es[other]).Mod(e, groupQ)
+	fs[m] = new(big.Int).Mul(es[m], r)
+	fs[m].Add(fs[m], w).Mod(fs[m], groupQ)
+	return ZeroOneProof{
+		E0: es[0].Text(16), F0: fs[0].Text(16),
+		E1: es[1].Text(16), F1: fs[1].Text(16),
+	}, nil
+}
+
+// simulate returns the commitment base^f / y^e that makes (e, f) verify
+func simulate(base, y, e, f *big.Int) *big.Int {
+	a := new(big.Int).Exp(base, f, groupP)
+	ye := new(big.Int).Exp(y, e, groupP)
+	return a.Mul(a, ye.ModInverse(ye, groupP)).Mod(a, groupP)
+}
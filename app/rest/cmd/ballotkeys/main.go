@@ -0,0 +1,53 @@
+// ballotkeys generates the key of an encrypted election and splits it
+// between its trustees. Hand every trustee their share, which they use with
+// trusteeshare, and pass the "encryption" settings when creating the
+// election. They name the voter ID of every trustee's user, the only one who
+// can submit their decryption shares.
+//
+//	go run ./cmd/ballotkeys -threshold 2 -trustees 3 -ids alice,bob,carol
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/izqalan/fabric-voting/app/ballot"
+)
+
+func main() {
+	threshold := flag.Int("threshold", 2, "number of trustees needed to decrypt")
+	trustees := flag.Int("trustees", 3, "number of trustees")
+	ids := flag.String("ids", "", "comma separated voter IDs of the trustees' users, in index order")
+	flag.Parse()
+
+	trusteeIDs := strings.Split(*ids, ",")
+	if len(trusteeIDs) != *trustees {
+		fmt.Fprintf(os.Stderr, "expected %d trustee voter IDs\n", *trustees)
+		os.Exit(1)
+	}
+
+	publicKey, shares, err := ballot.GenerateKey(*threshold, *trustees)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	trusteeKeys := make([]string, len(shares))
+	for i, share := range shares {
+		trusteeKeys[i] = share.PublicKey
+	}
+
+	out, _ := json.MarshalIndent(map[string]interface{}{
+		"encryption": map[string]interface{}{
+			"publicKey":   publicKey,
+			"threshold":   *threshold,
+			"trustees":    *trustees,
+			"trusteeKeys": trusteeKeys,
+			"trusteeIDs":  trusteeIDs,
+		},
+		"shares": shares,
+	}, "", "  ")
+	fmt.Println(string(out))
+}
@@ -0,0 +1,49 @@
+// mockoidc runs an OpenID Connect provider to log in to the REST server
+// without the university's. Any listed user logs in without a password, their
+// groups are claimed in the groups claim.
+//
+//	go run ./cmd/mockoidc -user alice -user bob=election-staff,audit
+//
+// then start the server with -oidc-issuer http://localhost:9000.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/izqalan/fabric-voting/app/oidc/oidctest"
+)
+
+// userFlags collects the repeated -user flag
+type userFlags []string
+
+func (u *userFlags) String() string     { return strings.Join(*u, " ") }
+func (u *userFlags) Set(v string) error { *u = append(*u, v); return nil }
+
+func main() {
+	listen := flag.String("listen", "localhost:9000", "address to listen on")
+	issuer := flag.String("issuer", "http://localhost:9000", "URL the provider is reached at")
+	clientID := flag.String("client-id", "fabric-voting", "client ID of the REST server")
+	clientSecret := flag.String("client-secret", "", "client secret, empty for a public client")
+	var accounts userFlags
+	flag.Var(&accounts, "user", "user to log in as, username=group,group")
+	flag.Parse()
+
+	provider, err := oidctest.NewProvider(*issuer, *clientID, *clientSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, account := range accounts {
+		username, groups, _ := strings.Cut(account, "=")
+		claims := map[string]interface{}{"groups": []string{}}
+		if groups != "" {
+			claims["groups"] = strings.Split(groups, ",")
+		}
+		provider.AddUser(username, claims)
+	}
+
+	log.Printf("OpenID Connect provider %s listening on %s", *issuer, *listen)
+	log.Fatal(http.ListenAndServe(*listen, provider))
+}
@@ -0,0 +1,74 @@
+// trusteeshare computes the decryption shares of a trustee on their own
+// machine, so the key share never reaches the server. It reads the key share
+// ballotkeys handed out and the encrypted sums of the ended election, as
+// returned by GET /election/{electionID}/encryptedSums, and prints the body to
+// POST to /election/{electionID}/decryptionShare.
+//
+//	go run ./cmd/trusteeshare -share alice.json -election election.1 < sums.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/izqalan/fabric-voting/app/ballot"
+)
+
+func main() {
+	sharePath := flag.String("share", "", "file holding the trustee's key share as printed by ballotkeys")
+	electionID := flag.String("election", "", "ID of the election")
+	sumsPath := flag.String("sums", "", "file holding the encrypted sums, read from stdin if empty")
+	flag.Parse()
+
+	if *sharePath == "" || *electionID == "" {
+		fmt.Fprintln(os.Stderr, "-share and -election are required")
+		os.Exit(1)
+	}
+	shareJSON, err := os.ReadFile(*sharePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var share ballot.KeyShare
+	if err := json.Unmarshal(shareJSON, &share); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid key share:", err)
+		os.Exit(1)
+	}
+
+	var sumsJSON []byte
+	if *sumsPath == "" {
+		sumsJSON, err = io.ReadAll(os.Stdin)
+	} else {
+		sumsJSON, err = os.ReadFile(*sumsPath)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// either the bare sums or the response of the REST server holding them
+	var sums []ballot.Sum
+	if err := json.Unmarshal(sumsJSON, &sums); err != nil {
+		var response struct {
+			Data []ballot.Sum `json:"data"`
+		}
+		if err := json.Unmarshal(sumsJSON, &response); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid encrypted sums:", err)
+			os.Exit(1)
+		}
+		sums = response.Data
+	}
+
+	shares, err := ballot.DecryptionShares(share, *electionID, sums)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	out, _ := json.MarshalIndent(map[string]interface{}{
+		"trusteeIndex": share.Index,
+		"shares":       shares,
+	}, "", "  ")
+	fmt.Println(string(out))
+}
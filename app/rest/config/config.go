@@ -0,0 +1,444 @@
+// Package config loads the settings of the REST server. Defaults suit the
+// test network, a YAML file given with -config or VOTING_CONFIG overrides them,
+// then VOTING_* environment variables and finally command line flags.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/izqalan/fabric-voting/app/tokens"
+	"github.com/izqalan/fabric-voting/app/users"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+const testNetworkOrg1 = "../../test-network/organizations/peerOrganizations/org1.example.com"
+
+type Config struct {
+	// Listen is the address the HTTP server listens on
+	Listen  string        `yaml:"listen"`
+	Gateway GatewayConfig `yaml:"gateway"`
+	Wallet  WalletConfig  `yaml:"wallet"`
+	JWT     JWTConfig     `yaml:"jwt"`
+	Users   UsersConfig   `yaml:"users"`
+	OIDC    OIDCConfig    `yaml:"oidc"`
+}
+
+type GatewayConfig struct {
+	MspID string `yaml:"mspID"`
+	// the preferred gateway peer, FallbackPeers take over while it is down
+	PeerConfig    `yaml:",inline"`
+	FallbackPeers []PeerConfig `yaml:"fallbackPeers"`
+	// HealthInterval is how often the chaincode is pinged through every peer
+	HealthInterval time.Duration `yaml:"healthInterval"`
+	ChannelName    string        `yaml:"channelName"`
+	ChaincodeName  string        `yaml:"chaincodeName"`
+	Timeouts       Timeouts      `yaml:"timeouts"`
+	// MaxGateways caps the gateways kept for the identities of users, the
+	// least recently used one is closed when a new identity connects
+	MaxGateways int `yaml:"maxGateways"`
+	// IdleTimeout is how long the gateway of an identity is kept unused
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+}
+
+type PeerConfig struct {
+	// Endpoint is the address of the gateway peer
+	Endpoint string `yaml:"endpoint"`
+	// ServerName is the host name the peer's TLS certificate is issued for
+	ServerName  string `yaml:"serverName"`
+	TLSCertPath string `yaml:"tlsCertPath"`
+}
+
+// Peers returns the gateway peers in order of preference
+func (g GatewayConfig) Peers() []PeerConfig {
+	return append([]PeerConfig{g.PeerConfig}, g.FallbackPeers...)
+}
+
+// Timeouts of the gateway calls, written like 5s or 1m in YAML
+type Timeouts struct {
+	Evaluate     time.Duration `yaml:"evaluate"`
+	Endorse      time.Duration `yaml:"endorse"`
+	Submit       time.Duration `yaml:"submit"`
+	CommitStatus time.Duration `yaml:"commitStatus"`
+}
+
+// WalletConfig locates the user identities and the CA enrolling new ones
+type WalletConfig struct {
+	Path       string `yaml:"path"`
+	CACertPath string `yaml:"caCertPath"`
+	CAKeyPath  string `yaml:"caKeyPath"`
+}
+
+// JWTConfig sets the keys of the access tokens. Without Secret or Keys a key
+// is generated at startup and tokens do not survive a restart.
+type JWTConfig struct {
+	// Secret is a single HS256 key named "default", when Keys is empty
+	Secret string `yaml:"secret"`
+	// Keys verify tokens, the active one also signs new tokens. To rotate, add
+	// the new key, make it active once the JWKS is picked up, and remove the old
+	// one after TokenLifetime.
+	Keys []SigningKey `yaml:"keys"`
+	// ActiveKey is the ID of the key signing new tokens, the first one if empty
+	ActiveKey string `yaml:"activeKey"`
+	Issuer    string `yaml:"issuer"`
+	// TokenLifetime is how long access tokens are valid, RefreshLifetime how
+	// long the refresh tokens exchanged for new ones are
+	TokenLifetime   time.Duration `yaml:"tokenLifetime"`
+	RefreshLifetime time.Duration `yaml:"refreshLifetime"`
+	// RevocationStorePath is the BoltDB file of the tokens revoked by logging
+	// out, disabling an account or resetting its password
+	RevocationStorePath string `yaml:"revocationStorePath"`
+}
+
+// SigningKey is either a PEM file with an RSA or Ed25519 private key, signing
+// with RS256 or EdDSA, or an HS256 secret
+type SigningKey struct {
+	ID      string `yaml:"id"`
+	KeyPath string `yaml:"keyPath"`
+	Secret  string `yaml:"secret"`
+}
+
+// Active returns the ID of the key signing new tokens
+func (j JWTConfig) Active() string {
+	if j.ActiveKey == "" && len(j.Keys) > 0 {
+		return j.Keys[0].ID
+	}
+	return j.ActiveKey
+}
+
+// UsersConfig sets up the store of the accounts users and admins log in with
+type UsersConfig struct {
+	// StorePath is the BoltDB file of the accounts
+	StorePath string `yaml:"storePath"`
+	// ImportCSV lists accounts created at startup if missing, see users.ImportCSV
+	ImportCSV string `yaml:"importCSV"`
+	// PasswordCost is the bcrypt cost of new passwords
+	PasswordCost int `yaml:"passwordCost"`
+	// the super-admin account is created at startup if missing, to log in to a new store
+	AdminUsername string `yaml:"adminUsername"`
+	AdminPassword string `yaml:"adminPassword"`
+	// DemoUsers adds the accounts user0, user1, ... whose password is their
+	// username, for load tests
+	DemoUsers int `yaml:"demoUsers"`
+}
+
+// OIDCConfig lets users log in at an OpenID Connect provider, when Issuer is set
+type OIDCConfig struct {
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"clientID"`
+	ClientSecret string `yaml:"clientSecret"`
+	// RedirectURL is registered at the provider and leads to
+	// /api/v1/auth/oidc/callback, directly or through the frontend
+	RedirectURL string   `yaml:"redirectURL"`
+	Scopes      []string `yaml:"scopes"`
+	// UsernameClaim holds the username, which is the voter ID on the ledger
+	UsernameClaim string `yaml:"usernameClaim"`
+	// RolesClaim lists the groups of the user, RoleMapping gives the roles of
+	// each group and DefaultRoles are held by every user of the provider
+	RolesClaim   string              `yaml:"rolesClaim"`
+	RoleMapping  map[string][]string `yaml:"roleMapping"`
+	DefaultRoles []string            `yaml:"defaultRoles"`
+}
+
+// Default returns the settings for the test network
+func Default() *Config {
+	return &Config{
+		Listen: ":80",
+		Gateway: GatewayConfig{
+			MspID: "Org1MSP",
+			PeerConfig: PeerConfig{
+				Endpoint:    "localhost:7051",
+				ServerName:  "peer0.org1.example.com",
+				TLSCertPath: testNetworkOrg1 + "/peers/peer0.org1.example.com/tls/ca.crt",
+			},
+			HealthInterval: 10 * time.Second,
+			MaxGateways:    1000,
+			IdleTimeout:    30 * time.Minute,
+			ChannelName:    "mychannel",
+			ChaincodeName:  "mychaincode",
+			Timeouts: Timeouts{
+				Evaluate:     5 * time.Second,
+				Endorse:      15 * time.Second,
+				Submit:       5 * time.Second,
+				CommitStatus: time.Minute,
+			},
+		},
+		Wallet: WalletConfig{
+			Path:       "identities",
+			CACertPath: testNetworkOrg1 + "/ca/ca.org1.example.com-cert.pem",
+			CAKeyPath:  testNetworkOrg1 + "/ca/priv_sk",
+		},
+		JWT: JWTConfig{
+			Issuer:              "fabric-voting",
+			TokenLifetime:       15 * time.Minute,
+			RefreshLifetime:     7 * 24 * time.Hour,
+			RevocationStorePath: "revocations.db",
+		},
+		Users: UsersConfig{
+			StorePath:    "users.db",
+			PasswordCost: bcrypt.DefaultCost,
+		},
+		OIDC: OIDCConfig{
+			Scopes:        []string{"profile", "email"},
+			UsernameClaim: "preferred_username",
+			RolesClaim:    "groups",
+			DefaultRoles:  []string{users.RoleVoter},
+		},
+	}
+}
+
+// setting is a value that can be overridden by an environment variable and a flag
+type setting struct {
+	flag  string
+	env   string
+	value interface{} // *string, *int or *time.Duration
+	usage string
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"listen", "VOTING_LISTEN", &c.Listen, "address the HTTP server listens on"},
+		{"msp-id", "VOTING_MSP_ID", &c.Gateway.MspID, "MSP ID of the organization"},
+		{"peer-endpoint", "VOTING_PEER_ENDPOINT", &c.Gateway.Endpoint, "address of the gateway peer"},
+		{"peer-server-name", "VOTING_PEER_SERVER_NAME", &c.Gateway.ServerName, "host name of the gateway peer's TLS certificate"},
+		{"tls-cert", "VOTING_TLS_CERT_PATH", &c.Gateway.TLSCertPath, "CA certificate of the gateway peer's TLS certificate"},
+		{"health-interval", "VOTING_HEALTH_INTERVAL", &c.Gateway.HealthInterval, "how often the chaincode is pinged through every peer"},
+		{"max-gateways", "VOTING_MAX_GATEWAYS", &c.Gateway.MaxGateways, "number of user gateways kept connected"},
+		{"gateway-idle-timeout", "VOTING_GATEWAY_IDLE_TIMEOUT", &c.Gateway.IdleTimeout, "how long an unused user gateway is kept"},
+		{"channel", "CHANNEL_NAME", &c.Gateway.ChannelName, "channel name"},
+		{"chaincode", "CHAINCODE_NAME", &c.Gateway.ChaincodeName, "chaincode name"},
+		{"evaluate-timeout", "VOTING_EVALUATE_TIMEOUT", &c.Gateway.Timeouts.Evaluate, "timeout of evaluate calls"},
+		{"endorse-timeout", "VOTING_ENDORSE_TIMEOUT", &c.Gateway.Timeouts.Endorse, "timeout of endorse calls"},
+		{"submit-timeout", "VOTING_SUBMIT_TIMEOUT", &c.Gateway.Timeouts.Submit, "timeout of submit calls"},
+		{"commit-status-timeout", "VOTING_COMMIT_STATUS_TIMEOUT", &c.Gateway.Timeouts.CommitStatus, "timeout waiting for commit status"},
+		{"wallet", "VOTING_WALLET_PATH", &c.Wallet.Path, "directory of the user identities"},
+		{"ca-cert", "VOTING_CA_CERT_PATH", &c.Wallet.CACertPath, "certificate of the CA enrolling users"},
+		{"ca-key", "VOTING_CA_KEY_PATH", &c.Wallet.CAKeyPath, "private key of the CA enrolling users"},
+		{"jwt-secret", "VOTING_JWT_SECRET", &c.JWT.Secret, "HS256 secret signing the access tokens"},
+		{"jwt-active-key", "VOTING_JWT_ACTIVE_KEY", &c.JWT.ActiveKey, "ID of the key signing new access tokens"},
+		{"jwt-issuer", "VOTING_JWT_ISSUER", &c.JWT.Issuer, "issuer of the access tokens"},
+		{"jwt-token-lifetime", "VOTING_JWT_TOKEN_LIFETIME", &c.JWT.TokenLifetime, "lifetime of the access tokens"},
+		{"jwt-refresh-lifetime", "VOTING_JWT_REFRESH_LIFETIME", &c.JWT.RefreshLifetime, "lifetime of the refresh tokens"},
+		{"revocation-store", "VOTING_REVOCATION_STORE", &c.JWT.RevocationStorePath, "BoltDB file of the revoked tokens"},
+		{"user-store", "VOTING_USER_STORE", &c.Users.StorePath, "BoltDB file of the accounts"},
+		{"import-users", "VOTING_IMPORT_USERS", &c.Users.ImportCSV, "CSV file of accounts to create at startup"},
+		{"password-cost", "VOTING_PASSWORD_COST", &c.Users.PasswordCost, "bcrypt cost of new passwords"},
+		{"admin-username", "VOTING_ADMIN_USERNAME", &c.Users.AdminUsername, "admin account created at startup if missing"},
+		{"admin-password", "VOTING_ADMIN_PASSWORD", &c.Users.AdminPassword, "password of the admin account created at startup"},
+		{"demo-users", "VOTING_DEMO_USERS", &c.Users.DemoUsers, "number of generated demo users"},
+		{"oidc-issuer", "VOTING_OIDC_ISSUER", &c.OIDC.Issuer, "URL of the OpenID Connect provider users log in at"},
+		{"oidc-client-id", "VOTING_OIDC_CLIENT_ID", &c.OIDC.ClientID, "client ID registered at the OpenID Connect provider"},
+		{"oidc-client-secret", "VOTING_OIDC_CLIENT_SECRET", &c.OIDC.ClientSecret, "client secret, empty for a public client"},
+		{"oidc-redirect-url", "VOTING_OIDC_REDIRECT_URL", &c.OIDC.RedirectURL, "redirect URL registered at the OpenID Connect provider"},
+	}
+}
+
+func (s setting) set(raw string) error {
+	switch v := s.value.(type) {
+	case *string:
+		*v = raw
+	case *int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, got %q", s.flag, raw)
+		}
+		*v = n
+	case *time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration like 5s, got %q", s.flag, raw)
+		}
+		*v = d
+	}
+	return nil
+}
+
+// Load reads the configuration from the file, environment and command line
+// arguments (without the program name) and validates it
+func Load(args []string) (*Config, error) {
+	c := Default()
+	settings := c.settings()
+
+	fs := flag.NewFlagSet("rest", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("VOTING_CONFIG"), "YAML configuration file")
+	flags := make([]*string, len(settings))
+	for i, s := range settings {
+		flags[i] = fs.String(s.flag, "", s.usage+" (env "+s.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		data, err := os.ReadFile(*path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read configuration: %w", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		// misspelled keys would otherwise be silently ignored
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to parse %s: %w", *path, err)
+		}
+	}
+
+	for _, s := range settings {
+		if raw, ok := os.LookupEnv(s.env); ok {
+			if err := s.set(raw); err != nil {
+				return nil, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for i, s := range settings {
+		if set[s.flag] {
+			if err := s.set(*flags[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate reports every setting that is missing or invalid
+func (c *Config) Validate() error {
+	var errs []error
+	required := func(value, name string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", name))
+		}
+	}
+	file := func(path, name string) {
+		required(path, name)
+		if path == "" {
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	positive := func(d time.Duration, name string) {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive", name))
+		}
+	}
+
+	required(c.Listen, "listen")
+	required(c.Gateway.MspID, "gateway.mspID")
+	for i, peer := range c.Gateway.Peers() {
+		prefix := "gateway."
+		if i > 0 {
+			prefix = fmt.Sprintf("gateway.fallbackPeers[%d].", i-1)
+		}
+		required(peer.Endpoint, prefix+"endpoint")
+		required(peer.ServerName, prefix+"serverName")
+		file(peer.TLSCertPath, prefix+"tlsCertPath")
+	}
+	positive(c.Gateway.HealthInterval, "gateway.healthInterval")
+	if c.Gateway.MaxGateways <= 0 {
+		errs = append(errs, errors.New("gateway.maxGateways must be positive"))
+	}
+	positive(c.Gateway.IdleTimeout, "gateway.idleTimeout")
+	required(c.Gateway.ChannelName, "gateway.channelName")
+	required(c.Gateway.ChaincodeName, "gateway.chaincodeName")
+	positive(c.Gateway.Timeouts.Evaluate, "gateway.timeouts.evaluate")
+	positive(c.Gateway.Timeouts.Endorse, "gateway.timeouts.endorse")
+	positive(c.Gateway.Timeouts.Submit, "gateway.timeouts.submit")
+	positive(c.Gateway.Timeouts.CommitStatus, "gateway.timeouts.commitStatus")
+	required(c.Wallet.Path, "wallet.path")
+	file(c.Wallet.CACertPath, "wallet.caCertPath")
+	file(c.Wallet.CAKeyPath, "wallet.caKeyPath")
+	secret := func(value, name string) {
+		if len(value) < tokens.MinSecretLength {
+			errs = append(errs, fmt.Errorf("%s must be at least %d bytes", name, tokens.MinSecretLength))
+		}
+	}
+	if c.JWT.Secret != "" {
+		secret(c.JWT.Secret, "jwt.secret")
+		if len(c.JWT.Keys) > 0 {
+			errs = append(errs, errors.New("jwt.secret and jwt.keys cannot be set together"))
+		}
+	}
+	ids := map[string]bool{}
+	for i, key := range c.JWT.Keys {
+		prefix := fmt.Sprintf("jwt.keys[%d].", i)
+		required(key.ID, prefix+"id")
+		if ids[key.ID] {
+			errs = append(errs, fmt.Errorf("%sid %s is used twice", prefix, key.ID))
+		}
+		ids[key.ID] = true
+		switch {
+		case (key.KeyPath == "") == (key.Secret == ""):
+			errs = append(errs, fmt.Errorf("%skeyPath or %ssecret must be set", prefix, prefix))
+		case key.KeyPath != "":
+			file(key.KeyPath, prefix+"keyPath")
+		default:
+			secret(key.Secret, prefix+"secret")
+		}
+	}
+	if c.JWT.ActiveKey != "" && !ids[c.JWT.ActiveKey] {
+		errs = append(errs, fmt.Errorf("jwt.activeKey %s is not one of jwt.keys", c.JWT.ActiveKey))
+	}
+	positive(c.JWT.TokenLifetime, "jwt.tokenLifetime")
+	positive(c.JWT.RefreshLifetime, "jwt.refreshLifetime")
+	if c.JWT.RefreshLifetime < c.JWT.TokenLifetime {
+		errs = append(errs, errors.New("jwt.refreshLifetime must not be shorter than jwt.tokenLifetime"))
+	}
+	required(c.JWT.RevocationStorePath, "jwt.revocationStorePath")
+	required(c.Users.StorePath, "users.storePath")
+	if c.Users.ImportCSV != "" {
+		file(c.Users.ImportCSV, "users.importCSV")
+	}
+	if c.Users.PasswordCost < bcrypt.MinCost || c.Users.PasswordCost > bcrypt.MaxCost {
+		errs = append(errs, fmt.Errorf("users.passwordCost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost))
+	}
+	if (c.Users.AdminUsername == "") != (c.Users.AdminPassword == "") {
+		errs = append(errs, errors.New("users.adminUsername and users.adminPassword must be set together"))
+	} else if c.Users.AdminPassword != "" {
+		if err := users.ValidatePassword(c.Users.AdminPassword); err != nil {
+			errs = append(errs, fmt.Errorf("users.adminPassword: %w", err))
+		}
+	}
+	if c.Users.DemoUsers < 0 {
+		errs = append(errs, errors.New("users.demoUsers must not be negative"))
+	}
+	if c.OIDC.Issuer != "" {
+		required(c.OIDC.ClientID, "oidc.clientID")
+		required(c.OIDC.RedirectURL, "oidc.redirectURL")
+		required(c.OIDC.UsernameClaim, "oidc.usernameClaim")
+		roles := func(roles []string, name string) {
+			for _, role := range users.NormalizeRoles(roles) {
+				if !users.ValidRole(role) {
+					errs = append(errs, fmt.Errorf("%s: unknown role %s", name, role))
+				}
+			}
+		}
+		roles(c.OIDC.DefaultRoles, "oidc.defaultRoles")
+		groups := make([]string, 0, len(c.OIDC.RoleMapping))
+		for group := range c.OIDC.RoleMapping {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+		for _, group := range groups {
+			roles(c.OIDC.RoleMapping[group], "oidc.roleMapping."+group)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a configuration whose files exist, followed by extra YAML
+func writeConfig(t *testing.T, extra string) string {
+	dir := t.TempDir()
+	for _, name := range []string{"tls.crt", "ca.crt", "priv_sk"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	yaml := `listen: ":8080"
+gateway:
+  endpoint: peer1:7051
+  tlsCertPath: ` + filepath.Join(dir, "tls.crt") + `
+  timeouts:
+    endorse: 30s
+wallet:
+  caCertPath: ` + filepath.Join(dir, "ca.crt") + `
+  caKeyPath: ` + filepath.Join(dir, "priv_sk") + `
+` + extra
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, "users:\n  adminUsername: root\n  adminPassword: correct horse\n")
+	t.Setenv("VOTING_PEER_ENDPOINT", "peer2:7051")
+	t.Setenv("VOTING_SUBMIT_TIMEOUT", "10s")
+
+	cfg, err := Load([]string{"-config", path, "-submit-timeout", "20s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":8080" {
+		t.Errorf("expected the file to set listen, got %s", cfg.Listen)
+	}
+	if cfg.Gateway.Endpoint != "peer2:7051" {
+		t.Errorf("expected the environment to override the file, got %s", cfg.Gateway.Endpoint)
+	}
+	if cfg.Gateway.Timeouts.Submit != 20*time.Second {
+		t.Errorf("expected the flag to override the environment, got %s", cfg.Gateway.Timeouts.Submit)
+	}
+	if cfg.Gateway.Timeouts.Endorse != 30*time.Second || cfg.Gateway.Timeouts.Evaluate != 5*time.Second {
+		t.Errorf("unexpected timeouts %+v", cfg.Gateway.Timeouts)
+	}
+	if cfg.Gateway.MspID != "Org1MSP" {
+		t.Errorf("expected the default MSP ID, got %s", cfg.Gateway.MspID)
+	}
+	if cfg.Users.AdminUsername != "root" || cfg.Users.StorePath != "users.db" {
+		t.Errorf("unexpected users %+v", cfg.Users)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	if _, err := Load([]string{"-config", writeConfig(t, "gateway:\n  endpont: typo\n")}); err == nil {
+		t.Error("expected an error for an unknown key")
+	}
+	if _, err := Load([]string{"-config", writeConfig(t, ""), "-evaluate-timeout", "5"}); err == nil {
+		t.Error("expected an error for a duration without unit")
+	}
+	if _, err := Load([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+
+	// every invalid setting is reported at once
+	_, err := Load([]string{"-config", writeConfig(t, "jwt:\n  secret: short\n"), "-msp-id", "", "-wallet", "", "-max-gateways", "0", "-admin-username", "root"})
+	if err == nil {
+		t.Fatal("expected validation to fail")
+	}
+	for _, want := range []string{"gateway.mspID", "gateway.maxGateways", "wallet.path", "jwt.secret", "users.adminPassword"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %q", want, err)
+		}
+	}
+}
+
+func TestValidateFallbackPeers(t *testing.T) {
+	cfg := Default()
+	cfg.Gateway.FallbackPeers = []PeerConfig{{Endpoint: "localhost:9051"}}
+	if got := len(cfg.Gateway.Peers()); got != 2 {
+		t.Fatalf("expected 2 peers, got %d", got)
+	}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected validation to fail")
+	}
+	for _, want := range []string{"gateway.fallbackPeers[0].serverName", "gateway.fallbackPeers[0].tlsCertPath"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %q", want, err)
+		}
+	}
+}
+
+func TestValidateJWTKeys(t *testing.T) {
+	cfg := Default()
+	cfg.JWT.Secret = strings.Repeat("s", 32)
+	cfg.JWT.Keys = []SigningKey{
+		{ID: "2026-10", KeyPath: filepath.Join(t.TempDir(), "missing.pem")},
+		{ID: "2026-10", Secret: "short"},
+		{ID: "2026-11"},
+	}
+	cfg.JWT.ActiveKey = "2026-12"
+	if got := cfg.JWT.Active(); got != "2026-12" {
+		t.Errorf("expected the configured active key, got %s", got)
+	}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected validation to fail")
+	}
+	for _, want := range []string{
+		"jwt.secret and jwt.keys",
+		"jwt.keys[0].keyPath",
+		"jwt.keys[1].id 2026-10 is used twice",
+		"jwt.keys[1].secret must be at least 32 bytes",
+		"jwt.keys[2].keyPath or jwt.keys[2].secret must be set",
+		"jwt.activeKey 2026-12",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %q", want, err)
+		}
+	}
+
+	cfg.JWT.ActiveKey = ""
+	if got := cfg.JWT.Active(); got != "2026-10" {
+		t.Errorf("expected the first key to be active, got %s", got)
+	}
+}
+
+func TestValidateOIDC(t *testing.T) {
+	cfg := Default()
+	cfg.OIDC.Issuer = "https://idp.example"
+	cfg.OIDC.RoleMapping = map[string][]string{"staff": {"officer"}}
+	cfg.OIDC.DefaultRoles = []string{"user"}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected validation to fail")
+	}
+	for _, want := range []string{"oidc.clientID", "oidc.redirectURL", "oidc.roleMapping.staff: unknown role officer"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %q", want, err)
+		}
+	}
+	// legacy role names are accepted like everywhere else
+	if strings.Contains(err.Error(), "oidc.defaultRoles") {
+		t.Errorf("expected the legacy user role to be accepted, got %q", err)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/izqalan/fabric-voting/app/config"
+	"github.com/izqalan/fabric-voting/app/users"
+	"github.com/izqalan/fabric-voting/app/wallet"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// chaincodeRoles maps the roles of accounts to the role attribute of their
+// Fabric identity, which the chaincode checks
+var chaincodeRoles = map[string]string{
+	users.RoleVoter:           "voter",
+	users.RoleElectionOfficer: "officer",
+	users.RoleAuditor:         "auditor",
+	users.RoleSuperAdmin:      "admin",
+}
+
+// chaincodeRolePrecedence orders the chaincode roles from the most to the
+// least privileged, the identity of the first one an account holds is used
+var chaincodeRolePrecedence = []string{"admin", "auditor", "officer", "voter"}
+
+// healthLabel is the wallet label of the identity pinging the chaincode, user
+// labels always contain a dot so it cannot clash with one
+const healthLabel = "healthcheck"
+
+// gatewayPool connects every user to the gateway with their own identity from
+// the wallet, so each transaction is signed by the user it is submitted for.
+// It keeps a gRPC connection to every configured gateway peer and sends
+// requests through the active one, see monitor for how that is picked.
+// Gateways share the connection of their peer. At most cfg.MaxGateways are
+// kept, the least recently used one is closed to make room for a new one and
+// those unused for cfg.IdleTimeout are closed at every health check.
+type gatewayPool struct {
+	wallet      *wallet.Wallet
+	cfg         config.GatewayConfig
+	peers       []config.PeerConfig
+	connections []*grpc.ClientConn
+
+	mu       sync.Mutex
+	active   int
+	down     bool
+	health   []peerHealth
+	gateways map[gatewayKey]*cachedGateway
+}
+
+// cachedGateway is the gateway of an identity through a peer
+type cachedGateway struct {
+	gateway  *client.Gateway
+	lastUsed time.Time
+}
+
+type gatewayKey struct {
+	peer  int
+	label string
+}
+
+// peerHealth is the outcome of the last ping through a peer
+type peerHealth struct {
+	Endpoint  string    `json:"endpoint"`
+	Active    bool      `json:"active"`
+	State     string    `json:"state"`
+	Reachable bool      `json:"reachable"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+func newGatewayPool(w *wallet.Wallet, cfg config.GatewayConfig) (*gatewayPool, error) {
+	p := &gatewayPool{
+		wallet:   w,
+		cfg:      cfg,
+		peers:    cfg.Peers(),
+		gateways: map[gatewayKey]*cachedGateway{},
+	}
+	for _, peer := range p.peers {
+		connection, err := newGrpcConnection(peer)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("peer %s: %w", peer.Endpoint, err)
+		}
+		p.connections = append(p.connections, connection)
+		p.health = append(p.health, peerHealth{Endpoint: peer.Endpoint})
+	}
+	return p, nil
+}
+
+// Contract returns the contract signed by the identity of the user in the most
+// privileged of the roles, enrolling the identity on first use
+func (p *gatewayPool) Contract(userID string, roles, elections []string) (*client.Contract, error) {
+	chaincodeRole, err := chaincodeRole(roles)
+	if err != nil {
+		return nil, err
+	}
+	// a user voting and managing elections gets an identity for each
+	label := userID + "." + chaincodeRole
+	attributes := map[string]string{"role": chaincodeRole, "voterID": userID}
+	if chaincodeRole == "officer" {
+		// the scope is part of the certificate, a new scope needs a new identity
+		scope := append([]string{}, elections...)
+		sort.Strings(scope)
+		attributes["elections"] = strings.Join(scope, ",")
+		sum := sha256.Sum256([]byte(attributes["elections"]))
+		label += "." + hex.EncodeToString(sum[:6])
+	}
+
+	return p.contract(p.activePeer(), label, attributes)
+}
+
+func chaincodeRole(roles []string) (string, error) {
+	held := map[string]bool{}
+	for _, role := range roles {
+		held[chaincodeRoles[role]] = true
+	}
+	for _, chaincodeRole := range chaincodeRolePrecedence {
+		if held[chaincodeRole] {
+			return chaincodeRole, nil
+		}
+	}
+	return "", fmt.Errorf("no Fabric identity for roles %v", roles)
+}
+
+// contract returns the contract of the identity through the peer. Enrolling
+// a new identity may take a round trip to the CA, so it happens without p.mu
+// held and only delays the requests of that identity.
+func (p *gatewayPool) contract(peer int, label string, attributes map[string]string) (*client.Contract, error) {
+	key := gatewayKey{peer, label}
+	var gw *client.Gateway
+	p.mu.Lock()
+	cached, ok := p.gateways[key]
+	if ok {
+		cached.lastUsed = time.Now()
+		gw = cached.gateway
+	}
+	p.mu.Unlock()
+	if !ok {
+		entry, err := p.wallet.Identity(label, attributes)
+		if err != nil {
+			return nil, err
+		}
+		id, err := entry.Identity()
+		if err != nil {
+			return nil, err
+		}
+		sign, err := entry.Sign()
+		if err != nil {
+			return nil, err
+		}
+
+		gw, err = client.Connect(
+			id,
+			client.WithSign(sign),
+			client.WithClientConnection(p.connections[peer]),
+			client.WithEvaluateTimeout(p.cfg.Timeouts.Evaluate),
+			client.WithEndorseTimeout(p.cfg.Timeouts.Endorse),
+			client.WithSubmitTimeout(p.cfg.Timeouts.Submit),
+			client.WithCommitStatusTimeout(p.cfg.Timeouts.CommitStatus),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		// keep the gateway of whichever request connected first
+		p.mu.Lock()
+		if existing, ok := p.gateways[key]; ok {
+			gw.Close()
+			gw = existing.gateway
+		} else {
+			p.gateways[key] = &cachedGateway{gateway: gw, lastUsed: time.Now()}
+			p.evictLeastRecentlyUsed()
+		}
+		p.mu.Unlock()
+	}
+	return gw.GetNetwork(p.cfg.ChannelName).GetContract(p.cfg.ChaincodeName), nil
+}
+
+// evictLeastRecentlyUsed closes the least recently used gateways until at most
+// cfg.MaxGateways are left, p.mu must be held
+func (p *gatewayPool) evictLeastRecentlyUsed() {
+	for len(p.gateways) > p.cfg.MaxGateways {
+		var oldest gatewayKey
+		var oldestUse time.Time
+		for key, cached := range p.gateways {
+			if oldestUse.IsZero() || cached.lastUsed.Before(oldestUse) {
+				oldest, oldestUse = key, cached.lastUsed
+			}
+		}
+		p.gateways[oldest].gateway.Close()
+		delete(p.gateways, oldest)
+	}
+}
+
+// evictIdle closes the gateways unused since cfg.IdleTimeout before now
+func (p *gatewayPool) evictIdle(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, cached := range p.gateways {
+		if now.Sub(cached.lastUsed) >= p.cfg.IdleTimeout {
+			cached.gateway.Close()
+			delete(p.gateways, key)
+		}
+	}
+}
+
+// ping evaluates the chaincode's ping function through the peer
+func (p *gatewayPool) ping(peer int) error {
+	contract, err := p.contract(peer, healthLabel, map[string]string{})
+	if err != nil {
+		return err
+	}
+	_, err = contract.EvaluateTransaction("ping")
+	return err
+}
+
+// monitor pings the chaincode through every peer each health interval until
+// ctx is done. Requests go through the first reachable peer in configured
+// order, so they fail over while the preferred peer is down and move back
+// once it recovers. gRPC reconnects to peers that went away by itself.
+func (p *gatewayPool) monitor(ctx context.Context) {
+	ticker := time.NewTicker(p.cfg.HealthInterval)
+	defer ticker.Stop()
+	for {
+		p.checkPeers()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkPeers closes idle gateways, pings every peer and picks the active one
+func (p *gatewayPool) checkPeers() {
+	p.evictIdle(time.Now())
+
+	health := make([]peerHealth, len(p.peers))
+	for i, peer := range p.peers {
+		health[i] = peerHealth{Endpoint: peer.Endpoint, CheckedAt: time.Now()}
+		if err := p.ping(i); err != nil {
+			health[i].Error = err.Error()
+		} else {
+			health[i].Reachable = true
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.health = health
+	for i := range health {
+		if health[i].Reachable {
+			p.down = false
+			if i != p.active {
+				log.Printf("switching gateway peer from %s to %s", p.peers[p.active].Endpoint, p.peers[i].Endpoint)
+				p.active = i
+			}
+			return
+		}
+	}
+	// with no peer reachable, keep the active one and let gRPC reconnect
+	if !p.down {
+		log.Printf("no gateway peer is reachable, staying on %s", p.peers[p.active].Endpoint)
+		p.down = true
+	}
+}
+
+// activePeer returns the index of the peer requests go through
+func (p *gatewayPool) activePeer() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active
+}
+
+// status returns the last health of every peer with its current connection state
+func (p *gatewayPool) status() []peerHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := make([]peerHealth, len(p.health))
+	for i, h := range p.health {
+		h.Active = i == p.active
+		h.State = p.connections[i].GetState().String()
+		status[i] = h
+	}
+	return status
+}
+
+// connected tells whether the connection to the peer is up or can be set up
+func (h peerHealth) connected() bool {
+	return h.State != connectivity.TransientFailure.String() && h.State != connectivity.Shutdown.String()
+}
+
+// Close closes the gateways of every user and the connections to the peers
+func (p *gatewayPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, cached := range p.gateways {
+		cached.gateway.Close()
+		delete(p.gateways, key)
+	}
+	for _, connection := range p.connections {
+		connection.Close()
+	}
+}
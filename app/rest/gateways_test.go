@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/izqalan/fabric-voting/app/config"
+	"github.com/izqalan/fabric-voting/app/wallet"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// staticEnroller hands out the same self-signed identity under every name
+type staticEnroller struct {
+	entry wallet.Entry
+}
+
+func newStaticEnroller(t *testing.T) *staticEnroller {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "user"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &staticEnroller{wallet.Entry{
+		MspID:   "Org1MSP",
+		Type:    "X.509",
+		Version: 1,
+		Credentials: wallet.Credentials{
+			Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+			PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+		},
+	}}
+}
+
+func (e *staticEnroller) Enroll(name string, attributes map[string]string) (wallet.Entry, error) {
+	return e.entry, nil
+}
+
+func TestGatewayEviction(t *testing.T) {
+	w, err := wallet.New(t.TempDir(), newStaticEnroller(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gRPC dials on the first call, which closed gateways refuse before making
+	connection, err := grpc.Dial("localhost:0", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &gatewayPool{
+		wallet: w,
+		cfg: config.GatewayConfig{
+			ChannelName:   "mychannel",
+			ChaincodeName: "mychaincode",
+			Timeouts:      config.Timeouts{Evaluate: time.Second},
+			MaxGateways:   2,
+			IdleTimeout:   time.Hour,
+		},
+		peers:       []config.PeerConfig{{Endpoint: "localhost:0"}},
+		connections: []*grpc.ClientConn{connection},
+		health:      []peerHealth{{}},
+		gateways:    map[gatewayKey]*cachedGateway{},
+	}
+	defer p.Close()
+
+	contract := func(label string) *client.Contract {
+		t.Helper()
+		c, err := p.contract(0, label, map[string]string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	cached := func(label string) bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		_, ok := p.gateways[gatewayKey{0, label}]
+		return ok
+	}
+	// a closed gateway cancels its calls before they reach the peer
+	closed := func(c *client.Contract) bool {
+		_, err := c.EvaluateTransaction("ping")
+		return err != nil && strings.Contains(err.Error(), "context canceled")
+	}
+
+	alice := contract("alice.voter")
+	time.Sleep(time.Millisecond)
+	bob := contract("bob.voter")
+	time.Sleep(time.Millisecond)
+	contract("alice.voter")
+	time.Sleep(time.Millisecond)
+	carol := contract("carol.voter")
+	if !cached("alice.voter") || cached("bob.voter") || !cached("carol.voter") {
+		t.Errorf("expected the least recently used gateway of bob to be evicted, got %v", p.gateways)
+	}
+	if !closed(bob) {
+		t.Error("expected the evicted gateway of bob to be closed")
+	}
+
+	// carol was used last, only alice has been idle for the timeout
+	p.evictIdle(p.gateways[gatewayKey{0, "carol.voter"}].lastUsed.Add(-time.Millisecond).Add(time.Hour))
+	if cached("alice.voter") || !cached("carol.voter") {
+		t.Errorf("expected the idle gateway of alice to be evicted, got %v", p.gateways)
+	}
+	if !closed(alice) {
+		t.Error("expected the idle gateway of alice to be closed")
+	}
+	if closed(carol) {
+		t.Error("expected the gateway of carol to stay open")
+	}
+}
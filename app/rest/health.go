@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthz reports whether the server can reach the gateway, answering 503
+// when the connection to every peer is failing
+func healthz(gateways *gatewayPool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		peers := gateways.status()
+		for _, peer := range peers {
+			if peer.connected() {
+				c.JSON(http.StatusOK, gin.H{"status": "ok", "data": peers})
+				return
+			}
+		}
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "data": peers})
+	}
+}
+
+// readyz reports whether requests can be served, pinging the chaincode
+// through the active peer
+func readyz(gateways *gatewayPool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		peer := gateways.activePeer()
+		endpoint := gateways.peers[peer].Endpoint
+		if err := gateways.ping(peer); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "peer": endpoint, "error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ready", "peer": endpoint})
+	}
+}
@@ -42,8 +42,7 @@ function generateVoterRequests(totalVoters) {
             url: `${BASE_URL}/authenticate`,
             body: JSON.stringify({
                 username: userID,
-                password: userID,
-                role: "user"
+                password: userID
             }),
             params: {
                 headers: {
@@ -101,7 +100,7 @@ export function setup() {
 
     // Batch logins
     const loginResponses = http.batch(loginRequests);
-    const voterTokens = loginResponses.map(res => JSON.parse(res.body));
+    const voterTokens = loginResponses.map(res => JSON.parse(res.body).accessToken);
 
     return {
         electionID,
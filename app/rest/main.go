@@ -1,19 +1,25 @@
 package main
 
 import (
+	"context"
 	"crypto/x509"
 	"fmt"
 	"github.com/spf13/cast"
+	"log"
 	"os"
-	"path"
 	"time"
 
-	"github.com/hyperledger/fabric-gateway/pkg/client"
 	"github.com/hyperledger/fabric-gateway/pkg/identity"
+	"github.com/izqalan/fabric-voting/app/config"
 	_ "github.com/izqalan/fabric-voting/app/docs"
+	"github.com/izqalan/fabric-voting/app/oidc"
 	routers "github.com/izqalan/fabric-voting/app/routes"
+	"github.com/izqalan/fabric-voting/app/tokens"
+	"github.com/izqalan/fabric-voting/app/users"
+	"github.com/izqalan/fabric-voting/app/wallet"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
+	"golang.org/x/crypto/bcrypt"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 )
@@ -28,146 +34,236 @@ import (
 
 // @host      localhost:8081
 // @BasePath  /api/v1
-const (
-	mspID        = "Org1MSP"
-	cryptoPath   = "../../test-network/organizations/peerOrganizations/org1.example.com"
-	certPath     = cryptoPath + "/users/User1@org1.example.com/msp/signcerts/cert.pem"
-	keyPath      = cryptoPath + "/users/User1@org1.example.com/msp/keystore/"
-	tlsCertPath  = cryptoPath + "/peers/peer0.org1.example.com/tls/ca.crt"
-	peerEndpoint = "localhost:7051"
-	gatewayPeer  = "peer0.org1.example.com"
-)
-
 func main() {
-	// The gRPC client connection should be shared by all Gateway connections to this endpoint
-	clientConnection := newGrpcConnection()
-	defer clientConnection.Close()
-
-	id := newIdentity()
-	sign := newSign()
-
-	// Create a Gateway connection for a specific client identity
-	gw, err := client.Connect(
-		id,
-		client.WithSign(sign),
-		client.WithClientConnection(clientConnection),
-		// Default timeouts for different gRPC calls
-		client.WithEvaluateTimeout(5*time.Second),
-		client.WithEndorseTimeout(15*time.Second),
-		client.WithSubmitTimeout(5*time.Second),
-		client.WithCommitStatusTimeout(1*time.Minute),
-	)
+	cfg, err := config.Load(os.Args[1:])
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
-	defer gw.Close()
 
-	// Override default values for chaincode and channel name as they may differ in testing contexts.
-	chaincodeName := "mychaincode"
-	if ccname := os.Getenv("CHAINCODE_NAME"); ccname != "" {
-		chaincodeName = ccname
+	w, err := newWallet(cfg)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	channelName := "mychannel"
-	if cname := os.Getenv("CHANNEL_NAME"); cname != "" {
-		channelName = cname
+	fmt.Println("---------")
+	fmt.Println(cfg.Gateway.ChaincodeName)
+	fmt.Println(cfg.Gateway.ChannelName)
+
+	// Every user connects with their own identity, enrolled into the wallet on first use
+	gateways, err := newGatewayPool(w, cfg.Gateway)
+	if err != nil {
+		log.Fatal(err)
 	}
+	defer gateways.Close()
 
-	fmt.Println("---------")
-	fmt.Println(chaincodeName)
-	fmt.Println(channelName)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go gateways.monitor(ctx)
 
-	network := gw.GetNetwork(channelName)
-	contract := network.GetContract(chaincodeName)
+	keys, err := newKeySet(cfg.JWT)
+	if err != nil {
+		log.Fatal(err)
+	}
+	routers.ConfigureJWT(keys, cfg.JWT.TokenLifetime, cfg.JWT.RefreshLifetime)
 
-	// Simulated user database
-	var users = map[string]string{
-		"9831025": "1234",
-		"9831026": "1234",
-		"9831027": "1234",
-		"9831024": "1234",
+	revocations, err := tokens.OpenRevocations(cfg.JWT.RevocationStorePath)
+	if err != nil {
+		log.Fatal(err)
 	}
+	defer revocations.Close()
+	routers.ConfigureRevocations(revocations)
+	go pruneRevocations(ctx, revocations)
 
-	for i := 0; i < 5000; i++ {
-		users["user"+cast.ToString(i)] = "user" + cast.ToString(i)
+	store, err := openUserStore(cfg.Users)
+	if err != nil {
+		log.Fatal(err)
 	}
+	defer store.Close()
 
-	var admins = map[string]string{
-		"9831024": "1234",
+	credentials := routers.AuthCredentials{Store: store, PasswordCost: cfg.Users.PasswordCost}
+	if cfg.OIDC.Issuer != "" {
+		credentials.OIDC, err = oidc.New(ctx, oidcSettings(cfg.OIDC), nil)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	// Rest Endpoints
-	r := routers.SetupRouter(contract, routers.AuthCredentials{
-		Users: users, Admins: admins,
-	})
+	r := routers.SetupRouter(gateways, credentials)
 
 	// Swagger Endpoints
 	r.GET("/docs/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
-	r.Run(":80")
+
+	// Health Endpoints
+	r.GET("/healthz", healthz(gateways))
+	r.GET("/readyz", readyz(gateways))
+
+	if err := r.Run(cfg.Listen); err != nil {
+		log.Fatal(err)
+	}
 }
 
-// newGrpcConnection creates a gRPC connection to the Gateway server.
-func newGrpcConnection() *grpc.ClientConn {
-	certificate, err := loadCertificate(tlsCertPath)
+// openUserStore opens the accounts and creates the configured ones missing from it
+func openUserStore(cfg config.UsersConfig) (*users.BoltStore, error) {
+	store, err := users.OpenBolt(cfg.StorePath)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	if err := seedUsers(store, cfg); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
 
-	certPool := x509.NewCertPool()
-	certPool.AddCert(certificate)
-	transportCredentials := credentials.NewClientTLSFromCert(certPool, gatewayPeer)
+func seedUsers(store users.UserStore, cfg config.UsersConfig) error {
+	if cfg.ImportCSV != "" {
+		f, err := os.Open(cfg.ImportCSV)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		result, err := users.ImportCSV(store, f, cfg.PasswordCost)
+		if err != nil {
+			return fmt.Errorf("failed to import %s: %w", cfg.ImportCSV, err)
+		}
+		log.Printf("imported %d users from %s, %d already existed", result.Created, cfg.ImportCSV, result.Skipped)
+	}
+
+	if cfg.AdminUsername != "" {
+		if err := createMissing(store, cfg.AdminUsername, cfg.AdminPassword, users.RoleSuperAdmin, cfg.PasswordCost); err != nil {
+			return err
+		}
+	}
+
+	// demo passwords are public, hashing them costlier would only slow down the first start
+	for i := 0; i < cfg.DemoUsers; i++ {
+		name := "user" + cast.ToString(i)
+		if err := createMissing(store, name, name, users.RoleVoter, bcrypt.MinCost); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	connection, err := grpc.Dial(peerEndpoint, grpc.WithTransportCredentials(transportCredentials))
+// createMissing creates the account unless the username is taken
+func createMissing(store users.UserStore, username, password, role string, cost int) error {
+	if _, found, err := store.Get(username); err != nil || found {
+		return err
+	}
+	user, err := users.New(username, password, []string{role}, cost)
 	if err != nil {
-		panic(fmt.Errorf("failed to create gRPC connection: %w", err))
+		return err
 	}
+	return store.Create(user)
+}
 
-	return connection
+func oidcSettings(cfg config.OIDCConfig) oidc.Settings {
+	return oidc.Settings{
+		Issuer:        cfg.Issuer,
+		ClientID:      cfg.ClientID,
+		ClientSecret:  cfg.ClientSecret,
+		RedirectURL:   cfg.RedirectURL,
+		Scopes:        cfg.Scopes,
+		UsernameClaim: cfg.UsernameClaim,
+		RolesClaim:    cfg.RolesClaim,
+		RoleMapping:   cfg.RoleMapping,
+		DefaultRoles:  cfg.DefaultRoles,
+	}
 }
 
-func newIdentity() *identity.X509Identity {
-	certificate, err := loadCertificate(certPath)
+// newGrpcConnection creates a gRPC connection to the Gateway server of a peer.
+// The gRPC client connection should be shared by all Gateway connections to this endpoint
+func newGrpcConnection(cfg config.PeerConfig) (*grpc.ClientConn, error) {
+	certificate, err := loadCertificate(cfg.TLSCertPath)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	id, err := identity.NewX509Identity(mspID, certificate)
+	certPool := x509.NewCertPool()
+	certPool.AddCert(certificate)
+	transportCredentials := credentials.NewClientTLSFromCert(certPool, cfg.ServerName)
+
+	connection, err := grpc.Dial(cfg.Endpoint, grpc.WithTransportCredentials(transportCredentials))
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to create gRPC connection: %w", err)
 	}
 
-	return id
+	return connection, nil
 }
 
-func loadCertificate(filename string) (*x509.Certificate, error) {
-	certificatePEM, err := os.ReadFile(filename)
+// newWallet opens the wallet of user identities, enrolling new users with the
+// organization's CA key as a stand-in for a Fabric CA on the test network
+func newWallet(cfg *config.Config) (*wallet.Wallet, error) {
+	ca, err := wallet.NewLocalCA(cfg.Gateway.MspID, cfg.Wallet.CACertPath, cfg.Wallet.CAKeyPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read certificate file: %w", err)
+		return nil, err
 	}
-	return identity.CertificateFromPEM(certificatePEM)
+	return wallet.New(cfg.Wallet.Path, ca)
 }
 
-// creates a function that generates a digital signature from a message digest using a private key.
-func newSign() identity.Sign {
-	files, err := os.ReadDir(keyPath)
-	if err != nil {
-		panic(fmt.Errorf("failed to read private key directory: %w", err))
+// newKeySet loads the keys of the access tokens, generating one when none is configured
+func newKeySet(cfg config.JWTConfig) (*tokens.KeySet, error) {
+	var keys []*tokens.Key
+	active := cfg.Active()
+	switch {
+	case cfg.Secret != "":
+		key, err := tokens.NewHMACKey("default", []byte(cfg.Secret))
+		if err != nil {
+			return nil, err
+		}
+		keys, active = append(keys, key), key.ID
+	case len(cfg.Keys) == 0:
+		log.Println("no JWT key configured, tokens are signed with a generated key and do not survive a restart")
+		key, err := tokens.GenerateKey("generated")
+		if err != nil {
+			return nil, err
+		}
+		keys, active = append(keys, key), key.ID
 	}
-	privateKeyPEM, err := os.ReadFile(path.Join(keyPath, files[0].Name()))
 
-	if err != nil {
-		panic(fmt.Errorf("failed to read private key file: %w", err))
+	for _, k := range cfg.Keys {
+		if k.Secret != "" {
+			key, err := tokens.NewHMACKey(k.ID, []byte(k.Secret))
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+			continue
+		}
+		data, err := os.ReadFile(k.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWT key: %w", err)
+		}
+		key, err := tokens.ParsePrivateKey(k.ID, data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
 	}
+	return tokens.NewKeySet(keys, active, cfg.Issuer)
+}
 
-	privateKey, err := identity.PrivateKeyFromPEM(privateKeyPEM)
-	if err != nil {
-		panic(err)
+// pruneRevocations forgets expired revoked tokens every hour until ctx is done
+func pruneRevocations(ctx context.Context, revocations *tokens.Revocations) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := revocations.Prune(now); err != nil {
+				log.Printf("failed to prune revoked tokens: %v", err)
+			}
+		}
 	}
+}
 
-	sign, err := identity.NewPrivateKeySign(privateKey)
+func loadCertificate(filename string) (*x509.Certificate, error) {
+	certificatePEM, err := os.ReadFile(filename)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to read certificate file: %w", err)
 	}
-
-	return sign
+	return identity.CertificateFromPEM(certificatePEM)
 }
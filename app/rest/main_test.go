@@ -5,12 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/izqalan/fabric-voting/app/config"
 	routers "github.com/izqalan/fabric-voting/app/routes"
+	"github.com/izqalan/fabric-voting/app/users"
 	"github.com/spf13/cast"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
-	"io"
+	"golang.org/x/crypto/bcrypt"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -28,59 +29,65 @@ var (
 )
 
 func TestMain(t *testing.M) {
-	// The gRPC client connection should be shared by all Gateway connections to this endpoint
-	clientConnection := newGrpcConnection()
-	defer clientConnection.Close()
-
-	id := newIdentity()
-	sign := newSign()
-
-	// Create a Gateway connection for a specific client identity
-	gw, err := client.Connect(
-		id,
-		client.WithSign(sign),
-		client.WithClientConnection(clientConnection),
-		// Default timeouts for different gRPC calls
-		client.WithEvaluateTimeout(5*time.Second),
-		client.WithEndorseTimeout(15*time.Second),
-		client.WithSubmitTimeout(5*time.Second),
-		client.WithCommitStatusTimeout(1*time.Minute),
-	)
+	// flags belong to go test, the network is configured through VOTING_CONFIG and the environment
+	cfg, err := config.Load(nil)
 	if err != nil {
 		panic(err)
 	}
-	defer gw.Close()
 
-	// Override default values for chaincode and channel name as they may differ in testing contexts.
-	chaincodeName := "mychaincode"
-	if ccname := os.Getenv("CHAINCODE_NAME"); ccname != "" {
-		chaincodeName = ccname
+	userWallet, err := newWallet(cfg)
+	if err != nil {
+		panic(err)
 	}
-
-	channelName := "mychannel"
-	if cname := os.Getenv("CHANNEL_NAME"); cname != "" {
-		channelName = cname
+	gateways, err := newGatewayPool(userWallet, cfg.Gateway)
+	if err != nil {
+		panic(err)
 	}
+	defer gateways.Close()
 
-	network := gw.GetNetwork(channelName)
-	contract := network.GetContract(chaincodeName)
+	keys, err := newKeySet(cfg.JWT)
+	if err != nil {
+		panic(err)
+	}
+	routers.ConfigureJWT(keys, cfg.JWT.TokenLifetime, cfg.JWT.RefreshLifetime)
 
 	usersName := make([]string, len(usersToken))
-	mapUsersName := make(map[string]string)
-	for i, _ := range usersName {
+	for i := range usersName {
 		usersName[i] = "user" + cast.ToString(i)
-		mapUsersName[usersName[i]] = usersName[i]
+	}
+	store := users.NewMemoryStore()
+	if err := seedUsers(store, config.UsersConfig{DemoUsers: len(usersName)}); err != nil {
+		panic(err)
+	}
+	if err := createMissing(store, "admin", "admin", users.RoleSuperAdmin, bcrypt.MinCost); err != nil {
+		panic(err)
+	}
+	// admins log in with an authenticator code
+	admin, _, err := store.Get("admin")
+	if err != nil {
+		panic(err)
+	}
+	if _, err := admin.EnrollTOTP(); err != nil {
+		panic(err)
+	}
+	admin.TOTPEnabled = true
+	if err := store.Update(admin); err != nil {
+		panic(err)
+	}
+	adminCode, err := users.TOTPCode(admin.TOTPSecret, time.Now())
+	if err != nil {
+		panic(err)
 	}
 
 	// Rest Endpoints
-	r = routers.SetupRouter(contract, routers.AuthCredentials{mapUsersName, map[string]string{"admin": "admin"}})
+	r = routers.SetupRouter(gateways, routers.AuthCredentials{Store: store, PasswordCost: bcrypt.MinCost})
 
 	// Swagger Endpoints
 	r.GET("/docs/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 	go r.Run(":80")
 
 	for i, name := range usersName {
-		req, err := http.NewRequest("POST", "/api/v1/authenticate", bytes.NewBuffer([]byte(`{"username":"`+name+`","password":"`+name+`","role":"user"}`)))
+		req, err := http.NewRequest("POST", "/api/v1/authenticate", bytes.NewBuffer([]byte(`{"username":"`+name+`","password":"`+name+`"}`)))
 		if err != nil {
 			panic(err)
 		}
@@ -88,15 +95,15 @@ func TestMain(t *testing.M) {
 		w := httptest.NewRecorder()
 		r.ServeHTTP(w, req)
 
-		var token string
-		json.Unmarshal(w.Body.Bytes(), &token)
+		var tokens routers.TokenPair
+		json.Unmarshal(w.Body.Bytes(), &tokens)
 
-		usersToken[i] = token
+		usersToken[i] = tokens.AccessToken
 	}
 	//get user token
 
 	//get admin token
-	req, err := http.NewRequest("POST", "/api/v1/authenticate", bytes.NewBuffer([]byte(`{"username":"admin","password":"admin","role":"admin"}`)))
+	req, err := http.NewRequest("POST", "/api/v1/authenticate", bytes.NewBuffer([]byte(`{"username":"admin","password":"admin","code":"`+adminCode+`"}`)))
 	if err != nil {
 		panic(err)
 	}
@@ -104,11 +111,11 @@ func TestMain(t *testing.M) {
 	w := httptest.NewRecorder()
 	r.ServeHTTP(w, req)
 
-	body, err := io.ReadAll(w.Body)
-	if err != nil {
+	var tokens routers.TokenPair
+	if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil {
 		panic(err)
 	}
-	adminToken = string(body)
+	adminToken = tokens.AccessToken
 
 	var wg sync.WaitGroup
 	wg.Add(len(usersName))
@@ -143,8 +150,10 @@ func createElection() string {
 
 		requestBody := routers.Election{
 			ElectionName: "test",
-			StartDate:    time.Now().Add(-24 * time.Hour).Format(time.DateTime),
-			EndDate:      time.Now().Add(24 * time.Hour).Format(time.DateTime),
+			StartDate:    time.Now().Add(-24 * time.Hour).UTC().Format(time.RFC3339),
+			EndDate:      time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339),
+			// the tests read results while the election is open
+			LiveResults: true,
 		}
 
 		b, _ := json.Marshal(requestBody)
@@ -184,6 +193,20 @@ func createElection() string {
 		}
 	}
 
+	// open the election for voting now that its candidates are registered
+	{
+		req, err := http.NewRequest("POST", "/api/v1/election/"+electionID+"/open", nil)
+		if err != nil {
+			fmt.Println("failed to open election", err.Error())
+		}
+		req.Header.Set("Authorization", adminToken)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			fmt.Println("failed to open election", w.Code)
+		}
+	}
+
 	return electionID
 }
 
@@ -290,12 +313,14 @@ func TestVote(t *testing.T) {
 			}
 			jsonVote, err := json.Marshal(vote)
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 
 			req, err := http.NewRequest("POST", "/api/v1/vote", bytes.NewBuffer(jsonVote))
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 			req.Header.Set("Content-Type", "application/json")
 			req.Header.Set("Authorization", voterToken)
@@ -393,12 +418,14 @@ func TestVoteVisibility(t *testing.T) {
 			}
 			jsonVote, err := json.Marshal(vote)
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 
 			req, err := http.NewRequest("POST", "/api/v1/vote", bytes.NewBuffer(jsonVote))
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 			req.Header.Set("Content-Type", "application/json")
 			req.Header.Set("Authorization", voterToken)
@@ -414,7 +441,8 @@ func TestVoteVisibility(t *testing.T) {
 			//get self result
 			req, err = http.NewRequest("GET", "/api/v1/voter/user"+cast.ToString(i), nil)
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 			req.Header.Set("Content-Type", "application/json")
 			req.Header.Set("Authorization", voterToken)
@@ -461,11 +489,13 @@ func TestConcurrentRequestForSameCandid(t *testing.T) {
 			}
 			jsonVote, err := json.Marshal(vote)
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 			req, err := http.NewRequest("POST", "/api/v1/vote", bytes.NewBuffer(jsonVote))
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 			req.Header.Set("Content-Type", "application/json")
 			req.Header.Set("Authorization", usersToken[0])
@@ -516,11 +546,13 @@ func TestConcurrentRequestForMultiCandidates(t *testing.T) {
 			}
 			jsonVote, err := json.Marshal(vote)
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 			req, err := http.NewRequest("POST", "/api/v1/vote", bytes.NewBuffer(jsonVote))
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 			req.Header.Set("Content-Type", "application/json")
 			req.Header.Set("Authorization", usersToken[0])
@@ -0,0 +1,339 @@
+// Package oidc logs users in through an OpenID Connect identity provider.
+//
+// The REST server is a client of the provider using the authorization code
+// flow with PKCE: Login redirects the browser to the provider with a state,
+// nonce and code challenge kept by the server, and Exchange trades the code
+// the provider returns for an ID token, verified with the provider's JWKS.
+// The claims of the token are mapped to a username and roles, the server then
+// issues its own tokens.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/izqalan/fabric-voting/app/tokens"
+	"github.com/izqalan/fabric-voting/app/users"
+)
+
+var (
+	ErrUnknownState = errors.New("unknown or expired login")
+	ErrNoUsername   = errors.New("ID token has no username claim")
+	ErrNoSubject    = errors.New("ID token has no subject")
+)
+
+// LoginTimeout is how long a user has to log in at the provider
+const LoginTimeout = 10 * time.Minute
+
+// Settings register the server as a client of the provider
+type Settings struct {
+	// Issuer is the URL of the provider, its discovery document is read from
+	// Issuer/.well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback route of the server registered at the provider
+	RedirectURL string
+	// Scopes are requested besides openid
+	Scopes []string
+	// UsernameClaim names the claim holding the username. It names the
+	// account, and with it the voter ID on the ledger, on the first login;
+	// accounts are found by the subject of the token afterwards.
+	UsernameClaim string
+	// RolesClaim names the claim listing the groups of the user
+	RolesClaim string
+	// RoleMapping gives the roles of every group, DefaultRoles are given to
+	// every user
+	RoleMapping  map[string][]string
+	DefaultRoles []string
+}
+
+// Identity is a user logged in at the provider, Subject identifies them at
+// the provider while the Username they claim may change
+type Identity struct {
+	Subject  string
+	Username string
+	Roles    []string
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// pending is a login started by Login and not yet completed by Exchange
+type pending struct {
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+// Client logs users in at one provider
+type Client struct {
+	settings   Settings
+	httpClient *http.Client
+	endpoints  discovery
+
+	mu      sync.Mutex
+	logins  map[string]pending
+	keys    map[string]interface{}
+	fetched time.Time
+}
+
+// New reads the discovery document of the provider
+func New(ctx context.Context, settings Settings, httpClient *http.Client) (*Client, error) {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if settings.UsernameClaim == "" {
+		settings.UsernameClaim = "preferred_username"
+	}
+	c := &Client{settings: settings, httpClient: httpClient, logins: map[string]pending{}}
+
+	issuer := strings.TrimSuffix(settings.Issuer, "/")
+	if err := c.getJSON(ctx, issuer+"/.well-known/openid-configuration", &c.endpoints); err != nil {
+		return nil, fmt.Errorf("failed to discover %s: %w", issuer, err)
+	}
+	if c.endpoints.Issuer != issuer && c.endpoints.Issuer != settings.Issuer {
+		return nil, fmt.Errorf("provider claims to be %s, not %s", c.endpoints.Issuer, settings.Issuer)
+	}
+	if c.endpoints.AuthorizationEndpoint == "" || c.endpoints.TokenEndpoint == "" || c.endpoints.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document of %s lacks an endpoint", issuer)
+	}
+	return c, nil
+}
+
+// Issuer returns the issuer of the provider as its ID tokens name it
+func (c *Client) Issuer() string {
+	return c.endpoints.Issuer
+}
+
+// RedirectURL returns the callback URL registered at the provider
+func (c *Client) RedirectURL() string {
+	return c.settings.RedirectURL
+}
+
+// Login starts a login, returning the URL of the provider to redirect to and
+// the state it completes with. The caller binds the state to the browser, so
+// the callback can refuse a login started by someone else.
+func (c *Client) Login() (string, string, error) {
+	state, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	for s, login := range c.logins {
+		if now.After(login.expires) {
+			delete(c.logins, s)
+		}
+	}
+	c.logins[state] = pending{verifier: verifier, nonce: nonce, expires: now.Add(LoginTimeout)}
+	c.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.settings.ClientID},
+		"redirect_uri":          {c.settings.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, c.settings.Scopes...), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(c.endpoints.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return c.endpoints.AuthorizationEndpoint + separator + query.Encode(), state, nil
+}
+
+// Exchange completes the login of the state with the code the provider
+// returned, every state can be used once
+func (c *Client) Exchange(ctx context.Context, code, state string) (Identity, error) {
+	c.mu.Lock()
+	login, found := c.logins[state]
+	delete(c.logins, state)
+	c.mu.Unlock()
+	if !found || time.Now().After(login.expires) {
+		return Identity{}, ErrUnknownState
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.settings.RedirectURL},
+		"client_id":     {c.settings.ClientID},
+		"code_verifier": {login.verifier},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoints.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if c.settings.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(c.settings.ClientID), url.QueryEscape(c.settings.ClientSecret))
+	}
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return Identity{}, fmt.Errorf("failed to redeem the code: %w", err)
+	}
+	defer response.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&body); err != nil {
+		return Identity{}, fmt.Errorf("failed to read the token response: %w", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return Identity{}, fmt.Errorf("provider rejected the code: %s %s", body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return Identity{}, errors.New("token response has no ID token")
+	}
+
+	claims, err := c.verify(ctx, body.IDToken)
+	if err != nil {
+		return Identity{}, err
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != login.nonce {
+		return Identity{}, errors.New("ID token nonce does not match the login")
+	}
+	return c.identity(claims)
+}
+
+// verify checks the signature, issuer, audience and expiry of an ID token
+func (c *Client) verify(ctx context.Context, idToken string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		id, _ := token.Header["kid"].(string)
+		return c.key(ctx, id)
+	},
+		jwt.WithValidMethods([]string{"RS256", "EdDSA"}),
+		jwt.WithIssuer(c.endpoints.Issuer),
+		jwt.WithAudience(c.settings.ClientID),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if exp, err := claims.GetExpirationTime(); err != nil || exp == nil {
+		return nil, errors.New("invalid ID token: it does not expire")
+	}
+	return claims, nil
+}
+
+// key returns the provider key, refetching the JWKS at most once a minute when
+// the key is unknown, as it is after the provider rotates its keys
+func (c *Client) key(ctx context.Context, id string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, found := c.keys[id]; found {
+		return key, nil
+	}
+	if time.Since(c.fetched) < time.Minute {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	c.fetched = time.Now()
+
+	var set tokens.JWKS
+	if err := c.getJSON(ctx, c.endpoints.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch the provider keys: %w", err)
+	}
+	c.keys = map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		if public, err := jwk.PublicKey(); err == nil {
+			c.keys[jwk.KeyID] = public
+		}
+	}
+	if key, found := c.keys[id]; found {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", id)
+}
+
+// identity maps the claims of an ID token to the username and roles
+func (c *Client) identity(claims jwt.MapClaims) (Identity, error) {
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return Identity{}, ErrNoSubject
+	}
+	username, _ := claims[c.settings.UsernameClaim].(string)
+	if username == "" {
+		return Identity{}, ErrNoUsername
+	}
+
+	roles := append([]string{}, c.settings.DefaultRoles...)
+	var groups []string
+	switch value := claims[c.settings.RolesClaim].(type) {
+	case string:
+		groups = strings.Fields(value)
+	case []interface{}:
+		for _, group := range value {
+			if s, ok := group.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+	for _, group := range groups {
+		roles = append(roles, c.settings.RoleMapping[group]...)
+	}
+	roles = users.NormalizeRoles(roles)
+	if len(roles) == 0 {
+		return Identity{}, fmt.Errorf("no role is mapped to the groups of %s", username)
+	}
+	return Identity{Subject: subject, Username: username, Roles: roles}, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, url string, v interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	return json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(v)
+}
+
+// randomString returns 32 random bytes, URL encoded, long enough for a PKCE
+// code verifier
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,146 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/izqalan/fabric-voting/app/oidc/oidctest"
+	"github.com/izqalan/fabric-voting/app/users"
+)
+
+const redirectURL = "http://voting.example/api/v1/auth/oidc/callback"
+
+// noRedirects stops at the redirect instead of following it
+var noRedirects = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}}
+
+// authorize logs the user in at the provider, returning the code and state
+// the provider redirects back with
+func authorize(t *testing.T, loginURL, username string) (code, state string) {
+	t.Helper()
+	response, err := noRedirects.Get(loginURL + "&login_hint=" + username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusFound {
+		t.Fatalf("expected a redirect, got %s", response.Status)
+	}
+	callback, err := url.Parse(response.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return callback.Query().Get("code"), callback.Query().Get("state")
+}
+
+func TestLogin(t *testing.T) {
+	provider, server, err := oidctest.NewServer("fabric-voting", "client-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	provider.AddUser("alice", map[string]interface{}{"groups": []string{"staff", "students"}})
+	provider.AddUser("bob", map[string]interface{}{"preferred_username": "S1234", "groups": "audit"})
+	provider.AddUser("carol", nil)
+
+	ctx := context.Background()
+	client, err := New(ctx, Settings{
+		Issuer:       server.URL,
+		ClientID:     "fabric-voting",
+		ClientSecret: "client-secret",
+		RedirectURL:  redirectURL,
+		RolesClaim:   "groups",
+		RoleMapping: map[string][]string{
+			"staff": {users.RoleElectionOfficer},
+			"audit": {users.RoleAuditor},
+		},
+		DefaultRoles: []string{users.RoleVoter},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Issuer() != server.URL {
+		t.Errorf("unexpected issuer %s", client.Issuer())
+	}
+
+	for username, want := range map[string]Identity{
+		"alice": {Subject: "alice", Username: "alice", Roles: []string{users.RoleVoter, users.RoleElectionOfficer}},
+		"bob":   {Subject: "bob", Username: "S1234", Roles: []string{users.RoleVoter, users.RoleAuditor}},
+		"carol": {Subject: "carol", Username: "carol", Roles: []string{users.RoleVoter}},
+	} {
+		loginURL, loginState, err := client.Login()
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, state := authorize(t, loginURL, username)
+		if state != loginState {
+			t.Errorf("expected the provider to return state %s, got %s", loginState, state)
+		}
+		identity, err := client.Exchange(ctx, code, state)
+		if err != nil {
+			t.Fatalf("%s: %v", username, err)
+		}
+		if !reflect.DeepEqual(identity, want) {
+			t.Errorf("expected %+v, got %+v", want, identity)
+		}
+
+		// a state completes a single login
+		if _, err := client.Exchange(ctx, code, state); !errors.Is(err, ErrUnknownState) {
+			t.Errorf("expected a replayed state to be refused, got %v", err)
+		}
+	}
+}
+
+func TestLoginRejects(t *testing.T) {
+	provider, server, err := oidctest.NewServer("fabric-voting", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	provider.AddUser("alice", nil)
+
+	ctx := context.Background()
+	settings := Settings{Issuer: server.URL, ClientID: "fabric-voting", RedirectURL: redirectURL}
+	client, err := New(ctx, settings, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the code of another login fails the PKCE check at the provider
+	first, _, err := client.Login()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := client.Login()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := authorize(t, first, "alice")
+	_, state := authorize(t, second, "alice")
+	if _, err := client.Exchange(ctx, code, state); err == nil {
+		t.Error("expected a code redeemed with the wrong verifier to be refused")
+	}
+
+	if _, err := client.Exchange(ctx, "code", "unknown"); !errors.Is(err, ErrUnknownState) {
+		t.Errorf("expected an unknown state to be refused, got %v", err)
+	}
+
+	// without a role to map the groups to, nobody may log in
+	loginURL, _, err := client.Login()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state = authorize(t, loginURL, "alice")
+	if _, err := client.Exchange(ctx, code, state); err == nil {
+		t.Error("expected a user without roles to be refused")
+	}
+
+	if _, err := New(ctx, Settings{Issuer: server.URL + "/elsewhere"}, nil); err == nil {
+		t.Error("expected discovery of an unknown issuer to fail")
+	}
+}
@@ -0,0 +1,248 @@
+// Package oidctest is an OpenID Connect provider for tests and local
+// development. It logs in any of its users without a password, but checks the
+// client, redirect URI and PKCE verifier like a real provider would.
+package oidctest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/izqalan/fabric-voting/app/tokens"
+)
+
+// Provider serves the discovery document, authorization, token and JWKS
+// endpoints of an issuer
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	keys  *tokens.KeySet
+	mu    sync.Mutex
+	users map[string]map[string]interface{}
+	codes map[string]grant
+}
+
+// grant is an authorization code waiting to be redeemed
+type grant struct {
+	username    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	expires     time.Time
+}
+
+// NewProvider returns a provider for the issuer URL it is served at. Without a
+// client secret the client is public and only PKCE protects the code.
+func NewProvider(issuer, clientID, clientSecret string) (*Provider, error) {
+	key, err := tokens.GenerateKey("mock")
+	if err != nil {
+		return nil, err
+	}
+	keys, err := tokens.NewKeySet([]*tokens.Key{key}, key.ID, issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &Provider{
+		Issuer:       issuer,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		keys:         keys,
+		users:        map[string]map[string]interface{}{},
+		codes:        map[string]grant{},
+	}, nil
+}
+
+// NewServer starts a provider on a local port, close the server when done
+func NewServer(clientID, clientSecret string) (*Provider, *httptest.Server, error) {
+	var p *Provider
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ServeHTTP(w, r)
+	}))
+	p, err := NewProvider(server.URL, clientID, clientSecret)
+	if err != nil {
+		server.Close()
+		return nil, nil, err
+	}
+	return p, server, nil
+}
+
+// AddUser adds a user whose ID token carries the claims besides the standard
+// ones, e.g. {"groups": []string{"students"}}
+func (p *Provider) AddUser(username string, claims map[string]interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.users[username] = claims
+}
+
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                                p.Issuer,
+			"authorization_endpoint":                p.Issuer + "/authorize",
+			"token_endpoint":                        p.Issuer + "/token",
+			"jwks_uri":                              p.Issuer + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"EdDSA"},
+			"code_challenge_methods_supported":      []string{"S256"},
+		})
+	case "/authorize":
+		p.authorize(w, r)
+	case "/token":
+		p.token(w, r)
+	case "/jwks":
+		writeJSON(w, http.StatusOK, p.keys.JWKS())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorize logs in the user named by login_hint, listing the users to pick
+// from when there is none
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch {
+	case query.Get("client_id") != p.ClientID:
+		http.Error(w, "unknown client", http.StatusBadRequest)
+		return
+	case query.Get("response_type") != "code":
+		http.Error(w, "only the code response type is supported", http.StatusBadRequest)
+		return
+	case query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256":
+		http.Error(w, "an S256 code challenge is required", http.StatusBadRequest)
+		return
+	}
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	username := query.Get("login_hint")
+	p.mu.Lock()
+	_, found := p.users[username]
+	var names []string
+	for name := range p.users {
+		names = append(names, name)
+	}
+	p.mu.Unlock()
+	if !found {
+		sort.Strings(names)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, "<!doctype html><title>Mock OIDC provider</title><h1>Log in as</h1><ul>")
+		for _, name := range names {
+			query.Set("login_hint", name)
+			fmt.Fprintf(w, `<li><a href="/authorize?%s">%s</a></li>`, html.EscapeString(query.Encode()), html.EscapeString(name))
+		}
+		fmt.Fprint(w, "</ul>")
+		return
+	}
+
+	code := tokens.NewID()
+	p.mu.Lock()
+	p.codes[code] = grant{
+		username:    username,
+		redirectURI: redirectURI.String(),
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+		expires:     time.Now().Add(time.Minute),
+	}
+	p.mu.Unlock()
+
+	callback := redirectURI.Query()
+	callback.Set("code", code)
+	callback.Set("state", query.Get("state"))
+	redirectURI.RawQuery = callback.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// token redeems a code for an ID token
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request", err.Error())
+		return
+	}
+	if p.ClientSecret != "" {
+		id, secret, _ := r.BasicAuth()
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+		if id != p.ClientID || secret != p.ClientSecret {
+			tokenError(w, "invalid_client", "wrong client credentials")
+			return
+		}
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("client_id") != p.ClientID {
+		tokenError(w, "invalid_request", "expected an authorization code of the client")
+		return
+	}
+
+	p.mu.Lock()
+	code, found := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	claims := p.users[code.username]
+	p.mu.Unlock()
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case !found || time.Now().After(code.expires):
+		tokenError(w, "invalid_grant", "unknown or expired code")
+		return
+	case r.PostForm.Get("redirect_uri") != code.redirectURI:
+		tokenError(w, "invalid_grant", "redirect_uri does not match")
+		return
+	case base64.RawURLEncoding.EncodeToString(challenge[:]) != code.challenge:
+		tokenError(w, "invalid_grant", "code_verifier does not match the challenge")
+		return
+	}
+
+	// the user's claims may replace the username, e.g. with a student ID
+	idClaims := jwt.MapClaims{"preferred_username": code.username}
+	for name, value := range claims {
+		idClaims[name] = value
+	}
+	now := time.Now()
+	idClaims["iss"] = p.Issuer
+	idClaims["sub"] = code.username
+	idClaims["aud"] = p.ClientID
+	idClaims["iat"] = now.Unix()
+	idClaims["exp"] = now.Add(5 * time.Minute).Unix()
+	if code.nonce != "" {
+		idClaims["nonce"] = code.nonce
+	}
+	idToken, err := p.keys.Sign(idClaims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": tokens.NewID(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func tokenError(w http.ResponseWriter, code, description string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": description})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
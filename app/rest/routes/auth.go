@@ -2,88 +2,237 @@ package routes
 
 import (
 	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/izqalan/fabric-voting/app/oidc"
+	"github.com/izqalan/fabric-voting/app/tokens"
+	"github.com/izqalan/fabric-voting/app/users"
 	"net/http"
 	"strings"
 	"time"
 )
 
-var jwtKey = []byte("my-very-secure-secret-key-1234567890")
+// token types, refresh tokens are only accepted by the refresh endpoint,
+// enrollment tokens by the two-factor enrollment and two-factor tokens by the
+// verification of the code completing a login at the identity provider
+const (
+	accessToken     = "access"
+	refreshToken    = "refresh"
+	enrollmentToken = "enrollment"
+	twoFactorToken  = "twoFactor"
+)
+
+// enrollmentLifetime is how long an account required to use two-factor
+// authentication has to enroll after logging in with its password
+const enrollmentLifetime = 10 * time.Minute
+
+// twoFactorLifetime is how long a login at the identity provider waits for
+// the code of the second factor
+const twoFactorLifetime = 5 * time.Minute
+
+var (
+	// signingKeys sign and verify the tokens, a generated key until
+	// ConfigureJWT is called
+	signingKeys     = generatedKeys()
+	accessLifetime  = 15 * time.Minute
+	refreshLifetime = 7 * 24 * time.Hour
+	// revocations are checked by JwtMiddleware and the refresh endpoint
+	revocations = tokens.NewRevocations()
+)
+
+func generatedKeys() *tokens.KeySet {
+	key, err := tokens.GenerateKey("generated")
+	if err != nil {
+		panic(err)
+	}
+	keys, err := tokens.NewKeySet([]*tokens.Key{key}, key.ID, "")
+	if err != nil {
+		panic(err)
+	}
+	return keys
+}
+
+// ConfigureJWT sets the keys signing and verifying tokens and how long access
+// and refresh tokens are valid
+func ConfigureJWT(keys *tokens.KeySet, access, refresh time.Duration) {
+	signingKeys = keys
+	accessLifetime = access
+	refreshLifetime = refresh
+}
+
+// ConfigureRevocations sets where revoked tokens are recorded
+func ConfigureRevocations(r *tokens.Revocations) {
+	revocations = r
+}
 
+// AuthCredentials is where logins are checked and accounts are managed
 type AuthCredentials struct {
-	Users  map[string]string
-	Admins map[string]string
+	Store users.UserStore
+	// PasswordCost is the bcrypt cost of passwords set through the API
+	PasswordCost int
+	// OIDC logs users in at an identity provider, nil when there is none
+	OIDC *oidc.Client
 }
 
 // Claims struct to hold JWT payload
 type Claims struct {
 	UserID string `json:"userID"`
-	Role   string `json:"role"`
+	// Roles are the roles of the account when the token was issued
+	Roles []string `json:"roles"`
+	// Elections limit the election-officer role, see users.Scope
+	Elections []string `json:"elections,omitempty"`
+	// TokenType is access or refresh
+	TokenType string `json:"tokenType"`
+	// TokenVersion is the version of the user's tokens when it was issued,
+	// revoking all tokens of a user moves them to the next one
+	TokenVersion int64 `json:"tokenVersion,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// Middleware for JWT validation
-func JwtMiddleware(roles ...string) gin.HandlerFunc {
+// parseToken verifies a token of the type and checks it was not revoked
+func parseToken(tokenStr, tokenType string) (*Claims, error) {
+	claims := &Claims{}
+	if err := signingKeys.Parse(tokenStr, claims); err != nil {
+		return nil, err
+	}
+	if claims.TokenType != tokenType {
+		return nil, fmt.Errorf("expected an %s token", tokenType)
+	}
+	if claims.ID == "" || claims.IssuedAt == nil || claims.ExpiresAt == nil {
+		return nil, errors.New("token is missing its ID or validity")
+	}
+	if revocations.Revoked(claims.ID, claims.UserID, claims.TokenVersion) {
+		return nil, errors.New("token was revoked")
+	}
+	return claims, nil
+}
+
+// revoke rejects the token until it expires
+func revoke(claims *Claims) error {
+	return revocations.Revoke(claims.ID, claims.ExpiresAt.Time)
+}
+
+// spend revokes a single use token, failing with tokens.ErrRevoked if it was
+// used already, by a concurrent request too
+func spend(claims *Claims) error {
+	return revocations.RevokeOnce(claims.ID, claims.ExpiresAt.Time)
+}
+
+// Middleware for JWT validation, letting through accounts with a role granting
+// every permission on the election of the path. Routes naming the election in
+// the body check the scope of officers themselves, see requestScope.
+func JwtMiddleware(permissions ...users.Permission) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		tokenStr := c.GetHeader("Authorization")
-		tokenStr = strings.TrimSpace(tokenStr)
-		tokenStr = strings.Trim(tokenStr, "\"")
+		tokenStr := authorizationToken(c)
 		if tokenStr == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, "Missing token")
 			return
 		}
 
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, errors.New("invalid signing method")
-			}
-			return jwtKey, nil
-		})
-
-		if err != nil || !token.Valid {
+		claims, err := parseToken(tokenStr, accessToken)
+		if err != nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, "Invalid token")
 			return
 		}
 
 		// Check role authorization
-		for _, role := range roles {
-			if claims.Role == role {
-				c.Set("userID", claims.UserID)
-				c.Set("role", claims.Role)
-				c.Next()
-				return
-			}
+		scope := users.Scope{Roles: claims.Roles, Elections: claims.Elections}
+		if len(grantedRoles(scope, c.Param("electionID"), permissions)) == 0 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, "user does not have the access")
+			return
 		}
+		c.Set("userID", claims.UserID)
+		c.Set("roles", claims.Roles)
+		c.Set("scope", scope)
+		c.Set("permissions", permissions)
+		c.Set("claims", claims)
+		c.Next()
+	}
 
-		c.AbortWithStatusJSON(http.StatusUnauthorized, "user does not have the access")
-		return
+}
+
+// authorizationToken returns the token of the Authorization header
+func authorizationToken(c *gin.Context) string {
+	tokenStr := c.GetHeader("Authorization")
+	tokenStr = strings.TrimSpace(tokenStr)
+	return strings.Trim(tokenStr, "\"")
+}
+
+// grantedRoles returns the roles granting the permissions on the election,
+// on any election when electionID is empty
+func grantedRoles(scope users.Scope, electionID string, permissions []users.Permission) []string {
+	if electionID == "" {
+		return users.RolesGranting(scope.Roles, permissions...)
 	}
+	return scope.RolesGrantingIn(electionID, permissions...)
+}
 
+// requestScope returns the scope of the account authenticated by JwtMiddleware
+func requestScope(c *gin.Context) users.Scope {
+	return c.MustGet("scope").(users.Scope)
 }
 
 // Generate JWT Token
-func GenerateToken(username, role string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+func GenerateToken(username string, roles []string) (string, error) {
+	return signToken(username, users.Scope{Roles: roles}, accessToken, accessLifetime)
+}
+
+func signToken(username string, scope users.Scope, tokenType string, lifetime time.Duration) (string, error) {
 	claims := &Claims{
-		UserID: username,
-		Role:   role,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-		},
+		UserID:           username,
+		Roles:            scope.Roles,
+		Elections:        scope.Elections,
+		TokenType:        tokenType,
+		TokenVersion:     revocations.UserVersion(username),
+		RegisteredClaims: signingKeys.RegisteredClaims(lifetime),
+	}
+	return signingKeys.Sign(claims)
+}
+
+// TokenPair is returned on login and refresh
+type TokenPair struct {
+	// AccessToken goes in the Authorization header of every request
+	AccessToken string `json:"accessToken"`
+	// RefreshToken is exchanged for a new pair at /auth/refresh
+	RefreshToken string `json:"refreshToken"`
+	// ExpiresIn is the lifetime of the access token in seconds
+	ExpiresIn int `json:"expiresIn"`
+}
+
+func generateTokens(user users.User) (TokenPair, error) {
+	scope := users.Scope{Roles: user.Roles, Elections: user.Elections}
+	access, err := signToken(user.Username, scope, accessToken, accessLifetime)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	refresh, err := signToken(user.Username, scope, refreshToken, refreshLifetime)
+	if err != nil {
+		return TokenPair{}, err
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtKey)
+	return TokenPair{AccessToken: access, RefreshToken: refresh, ExpiresIn: int(accessLifetime.Seconds())}, nil
+}
+
+// @Summary JSON Web Key Set
+// @Description public keys verifying the access tokens, selected by the kid header of a token
+// @Tags Auth
+// @Produce  json
+// @Success 200 {object} tokens.JWKS "Key set"
+// @Router /.well-known/jwks.json [get]
+func getJWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, signingKeys.JWKS())
 }
 
-func GetAuthHandler(users, admins map[string]string) func(c *gin.Context) {
+func GetAuthHandler(credentials AuthCredentials) func(c *gin.Context) {
 	return func(c *gin.Context) {
 
 		var creds struct {
 			Username string `json:"username"`
 			Password string `json:"password"`
-			Role     string `json:"role"`
+			// Code is the authenticator or a recovery code, for accounts with
+			// two-factor authentication
+			Code string `json:"code"`
 		}
 
 		if err := c.ShouldBindJSON(&creds); err != nil {
@@ -91,33 +240,132 @@ func GetAuthHandler(users, admins map[string]string) func(c *gin.Context) {
 			return
 		}
 
-		// Validate role
-		if creds.Role != "admin" && creds.Role != "user" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, "Invalid role")
+		// Validate user credentials
+		user, found, err := credentials.Store.Get(creds.Username)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to look up user")
+			return
+		}
+		if !found || !user.CheckPassword(creds.Password) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, "Invalid username or password")
+			return
+		}
+		if user.Disabled {
+			c.AbortWithStatusJSON(http.StatusForbidden, "Account disabled")
 			return
 		}
 
-		if creds.Role == "admin" {
-			// Validate user credentials
-			if storedPassword, exists := admins[creds.Username]; !exists || storedPassword != creds.Password {
-				c.AbortWithStatusJSON(http.StatusUnauthorized, "Invalid username or password")
+		// accounts beyond voting prove a second factor before getting a token
+		if user.TOTPEnabled || users.TwoFactorRequired(user.Roles) {
+			if !user.TOTPEnabled {
+				abortEnrollment(c, user)
+				return
+			}
+			if creds.Code == "" {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, "Two-factor code required")
+				return
+			}
+			var ok bool
+			if user, ok = spendTwoFactorCode(credentials, c, user.Username, creds.Code); !ok {
 				return
 			}
-		} else {
-			// Validate user credentials
-			if storedPassword, exists := users[creds.Username]; !exists || storedPassword != creds.Password {
-				c.AbortWithStatusJSON(http.StatusUnauthorized, "Invalid username or password")
+		}
+
+		// Generate token, the roles are the account's, not the request's
+		pair, err := generateTokens(user)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to generate token")
+			return
+		}
+
+		c.JSON(http.StatusOK, pair)
+	}
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// @Summary Refresh Tokens
+// @Description exchanges a refresh token for a new access and refresh token, the old refresh token is revoked
+// @Tags Auth
+// @Accept  json
+// @Produce  json
+// @Param refresh body refreshRequest true "Refresh token returned on login or the last refresh"
+// @Success 200 {object} TokenPair "New tokens"
+// @Router /auth/refresh [post]
+func refreshTokens(credentials AuthCredentials) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request refreshRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+		claims, err := parseToken(request.RefreshToken, refreshToken)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, "Invalid token")
+			return
+		}
+		// every refresh token is used once, whichever request spends it first
+		if err := spend(claims); err != nil {
+			if errors.Is(err, tokens.ErrRevoked) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, "Invalid token")
 				return
 			}
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to revoke token")
+			return
+		}
+
+		// the new tokens carry the roles the account holds now
+		user, found, err := credentials.Store.Get(claims.UserID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to look up user")
+			return
+		}
+		if !found || user.Disabled {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, "Invalid token")
+			return
 		}
 
-		// Generate token
-		token, err := GenerateToken(creds.Username, creds.Role)
+		pair, err := generateTokens(user)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to generate token")
 			return
 		}
 
-		c.JSON(http.StatusOK, token)
+		c.JSON(http.StatusOK, pair)
+	}
+}
+
+// @Summary Log out
+// @Description revokes the access token of the request and the refresh token, if given
+// @Tags Auth
+// @Accept  json
+// @Produce  json
+// @Param refresh body refreshRequest false "Refresh token of the session"
+// @Success 200 {string} string "Logged out"
+// @Router /auth/logout [post]
+func logout(c *gin.Context) {
+	claims := c.MustGet("claims").(*Claims)
+
+	var request refreshRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid JSON")
+			return
+		}
 	}
+	if err := revoke(claims); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to revoke token")
+		return
+	}
+	// a refresh token that no longer verifies cannot be used anyway
+	if refresh, err := parseToken(request.RefreshToken, refreshToken); err == nil && refresh.UserID == claims.UserID {
+		if err := revoke(refresh); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to revoke token")
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, "Logged out")
 }
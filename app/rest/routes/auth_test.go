@@ -2,24 +2,39 @@ package routes
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/izqalan/fabric-voting/app/oidc"
+	"github.com/izqalan/fabric-voting/app/oidc/oidctest"
+	"github.com/izqalan/fabric-voting/app/tokens"
+	"github.com/izqalan/fabric-voting/app/users"
+	"golang.org/x/crypto/bcrypt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestJwtMiddleware(t *testing.T) {
 	// Create a test router
 	r := gin.New()
-	r.GET("/", JwtMiddleware("testRole"), func(c *gin.Context) {
+	r.GET("/", JwtMiddleware(users.ManageElections), func(c *gin.Context) {
 		fmt.Println("tssss")
-		fmt.Println(c.Get("role"))
+		fmt.Println(c.Get("roles"))
 		c.JSON(http.StatusOK, gin.H{"message": "Hello World"})
 	})
 
 	// Create a test token
-	tokenStr, err := GenerateToken("testUser", "testRole")
+	tokenStr, err := GenerateToken("testUser", []string{users.RoleElectionOfficer})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -61,7 +76,7 @@ func TestJwtMiddleware(t *testing.T) {
 
 func TestGenerateToken(t *testing.T) {
 	// Test with valid input
-	tokenStr, err := GenerateToken("testUser", "testRole")
+	tokenStr, err := GenerateToken("testUser", []string{users.RoleElectionOfficer})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -70,7 +85,7 @@ func TestGenerateToken(t *testing.T) {
 	}
 
 	// Test with invalid input
-	_, err = GenerateToken("", "")
+	_, err = GenerateToken("", nil)
 	if err != nil {
 		t.Errorf("expected nil error, got %v", err)
 	}
@@ -81,20 +96,28 @@ func TestAuthenticate(t *testing.T) {
 	r := gin.New()
 
 	// Test with valid input
-	req, err := http.NewRequest("POST", "/", bytes.NewBuffer([]byte(`{"username":"testUser","password":"testPassword","role":"user"}`)))
+	req, err := http.NewRequest("POST", "/", bytes.NewBuffer([]byte(`{"username":"testUser","password":"testPassword"}`)))
 	if err != nil {
 		t.Fatal(err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
-	r.POST("/", GetAuthHandler(map[string]string{"testUser": "testPassword"}, nil))
+	store := users.NewMemoryStore()
+	user, err := users.New("testUser", "testPassword", []string{users.RoleVoter}, bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	r.POST("/", GetAuthHandler(AuthCredentials{Store: store}))
 	r.ServeHTTP(w, req)
 	if w.Code != http.StatusOK {
 		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
 	}
 
 	// Test with invalid input
-	req, err = http.NewRequest("POST", "/", bytes.NewBuffer([]byte(`{"username":"","password":"","role":""}`)))
+	req, err = http.NewRequest("POST", "/", bytes.NewBuffer([]byte(`{"username":"","password":""}`)))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -111,11 +134,11 @@ func TestJwtMiddlewareIntegration(t *testing.T) {
 	r := gin.New()
 
 	// Create a test token
-	tokenStr, err := GenerateToken("testUser", "testRole")
+	tokenStr, err := GenerateToken("testUser", []string{users.RoleElectionOfficer})
 	if err != nil {
 		t.Fatal(err)
 	}
-	anotherRole, err := GenerateToken("testUser", "anotherRole")
+	anotherRole, err := GenerateToken("testUser", []string{users.RoleVoter})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -127,7 +150,7 @@ func TestJwtMiddlewareIntegration(t *testing.T) {
 	}
 	req.Header.Set("Authorization", tokenStr)
 	w := httptest.NewRecorder()
-	r.Use(JwtMiddleware("testRole"))
+	r.Use(JwtMiddleware(users.ManageElections))
 	r.GET("/protected", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"message": "Hello World"})
 	})
@@ -159,3 +182,676 @@ func TestJwtMiddlewareIntegration(t *testing.T) {
 		t.Errorf("expected status code %d, got %d", http.StatusUnauthorized, w.Code)
 	}
 }
+
+func TestJWKS(t *testing.T) {
+	r := gin.New()
+	r.GET("/.well-known/jwks.json", getJWKS)
+
+	req, err := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var jwks tokens.JWKS
+	if err := json.Unmarshal(w.Body.Bytes(), &jwks); err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 1 {
+		t.Fatalf("expected the generated key, got %+v", jwks)
+	}
+	public, err := jwks.Keys[0].PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another service verifies our tokens with the published key alone
+	tokenStr, err := GenerateToken("testUser", []string{users.RoleElectionOfficer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := &Claims{}
+	_, err = jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Header["kid"] != jwks.Keys[0].KeyID {
+			t.Errorf("unexpected kid %v", token.Header["kid"])
+		}
+		return public, nil
+	})
+	if err != nil || claims.UserID != "testUser" {
+		t.Errorf("expected the token to verify, got %v", err)
+	}
+}
+
+func TestRefreshAndLogout(t *testing.T) {
+	store := users.NewMemoryStore()
+	user, err := users.New("testUser", "testPassword", []string{users.RoleVoter}, bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	ConfigureRevocations(tokens.NewRevocations())
+	credentials := AuthCredentials{Store: store, PasswordCost: bcrypt.MinCost}
+
+	r := gin.New()
+	r.POST("/authenticate", GetAuthHandler(credentials))
+	r.POST("/auth/refresh", refreshTokens(credentials))
+	r.POST("/auth/logout", JwtMiddleware(), logout)
+	r.GET("/protected", JwtMiddleware(users.CastVotes), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "Hello World"})
+	})
+	send := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	pair := func(w *httptest.ResponseRecorder) TokenPair {
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+		}
+		var tokens TokenPair
+		if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil {
+			t.Fatal(err)
+		}
+		return tokens
+	}
+
+	login := pair(send("POST", "/authenticate", "", `{"username":"testUser","password":"testPassword"}`))
+	if w := send("GET", "/protected", login.RefreshToken, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a refresh token to be refused as access token, got %d", w.Code)
+	}
+
+	refreshed := pair(send("POST", "/auth/refresh", "", `{"refreshToken":"`+login.RefreshToken+`"}`))
+	if w := send("POST", "/auth/refresh", "", `{"refreshToken":"`+login.RefreshToken+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a used refresh token to be refused, got %d", w.Code)
+	}
+	if w := send("POST", "/auth/refresh", "", `{"refreshToken":"`+login.AccessToken+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected an access token to be refused as refresh token, got %d", w.Code)
+	}
+	if w := send("GET", "/protected", refreshed.AccessToken, ""); w.Code != http.StatusOK {
+		t.Errorf("expected the refreshed token to be accepted, got %d", w.Code)
+	}
+
+	// logging out revokes the access token and the refresh token
+	if w := send("POST", "/auth/logout", refreshed.AccessToken, `{"refreshToken":"`+refreshed.RefreshToken+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if w := send("GET", "/protected", refreshed.AccessToken, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the logged out token to be refused, got %d", w.Code)
+	}
+	if w := send("POST", "/auth/refresh", "", `{"refreshToken":"`+refreshed.RefreshToken+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the logged out refresh token to be refused, got %d", w.Code)
+	}
+	if w := send("GET", "/protected", login.AccessToken, ""); w.Code != http.StatusOK {
+		t.Errorf("expected the other session to stay valid, got %d", w.Code)
+	}
+
+	// disabled accounts cannot refresh
+	second := pair(send("POST", "/authenticate", "", `{"username":"testUser","password":"testPassword"}`))
+	user.Disabled = true
+	if err := store.Update(user); err != nil {
+		t.Fatal(err)
+	}
+	if w := send("POST", "/auth/refresh", "", `{"refreshToken":"`+second.RefreshToken+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a disabled account to be refused, got %d", w.Code)
+	}
+}
+
+// recordingContracts records the roles a contract was asked for
+type recordingContracts struct {
+	roles     []string
+	elections []string
+}
+
+func (r *recordingContracts) Contract(userID string, roles, elections []string) (*client.Contract, error) {
+	r.roles = roles
+	r.elections = elections
+	return nil, nil
+}
+
+func TestRolesFromStore(t *testing.T) {
+	store := users.NewMemoryStore()
+	for username, roles := range map[string][]string{
+		"officer": {users.RoleVoter, users.RoleElectionOfficer},
+		"root":    {users.RoleSuperAdmin},
+	} {
+		user, err := users.New(username, username+"-password", roles, bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enableTOTP(t, &user)
+		if err := store.Create(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ConfigureRevocations(tokens.NewRevocations())
+	credentials := AuthCredentials{Store: store, PasswordCost: bcrypt.MinCost}
+	contracts := &recordingContracts{}
+	ok := func(*client.Contract, *gin.Context) {}
+
+	r := gin.New()
+	r.POST("/authenticate", GetAuthHandler(credentials))
+	r.POST("/election", JwtMiddleware(users.ManageElections), withContract(contracts, ok))
+	r.POST("/vote", JwtMiddleware(users.CastVotes), withContract(contracts, ok))
+	r.POST("/user/:username/roles", JwtMiddleware(users.ManageUsers), setUserRoles(credentials))
+	send := func(path, token, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	login := func(username string) string {
+		// the role in the request is ignored
+		w := send("/authenticate", "", `{"username":"`+username+`","password":"`+username+`-password","role":"super-admin","code":"`+unusedTOTPCode(t, store, username)+`"}`)
+		var pair TokenPair
+		if err := json.Unmarshal(w.Body.Bytes(), &pair); err != nil {
+			t.Fatal(err)
+		}
+		return pair.AccessToken
+	}
+
+	officer := login("officer")
+	if w := send("/user/officer/roles", officer, `{"roles":["super-admin"]}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected an officer not to manage users, got %d", w.Code)
+	}
+	// every route uses the identity of the roles granting its permission
+	if w := send("/election", officer, ""); w.Code != http.StatusOK || len(contracts.roles) != 1 || contracts.roles[0] != users.RoleElectionOfficer {
+		t.Errorf("expected the officer identity, got %d %v", w.Code, contracts.roles)
+	}
+	if w := send("/vote", officer, ""); w.Code != http.StatusOK || len(contracts.roles) != 1 || contracts.roles[0] != users.RoleVoter {
+		t.Errorf("expected the voter identity, got %d %v", w.Code, contracts.roles)
+	}
+
+	root := login("root")
+	if w := send("/vote", root, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a super admin not to vote, got %d", w.Code)
+	}
+	if w := send("/user/root/roles", root, `{"roles":["voter"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected admins to keep their own right to manage users, got %d", w.Code)
+	}
+	if w := send("/user/officer/roles", root, `{"roles":["voter","election-officer","judge"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown role to be refused, got %d", w.Code)
+	}
+	if w := send("/user/officer/roles", root, `{"roles":["user"]}`); w.Code != http.StatusOK {
+		t.Fatalf("expected the roles to be set, got %d: %s", w.Code, w.Body)
+	}
+
+	// tokens carrying the old roles are revoked, new logins get the new ones
+	if w := send("/vote", officer, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the old token to be revoked, got %d", w.Code)
+	}
+	// logging in again right away is not caught by the revocation
+	officer = login("officer")
+	if w := send("/election", officer, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the officer role to be gone, got %d", w.Code)
+	}
+	if w := send("/vote", officer, ""); w.Code != http.StatusOK {
+		t.Errorf("expected the voter role to stay, got %d", w.Code)
+	}
+}
+
+// enableTOTP enrolls the user in two-factor authentication
+func enableTOTP(t *testing.T, user *users.User) {
+	if _, err := user.EnrollTOTP(); err != nil {
+		t.Fatal(err)
+	}
+	user.TOTPEnabled = true
+}
+
+// unusedTOTPCode returns a code of the user that was not used yet
+func unusedTOTPCode(t *testing.T, store users.UserStore, username string) string {
+	user, _, err := store.Get(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Now()
+	if user.TOTPLastStep >= at.Unix()/int64(users.TOTPPeriod/time.Second) {
+		at = at.Add(users.TOTPPeriod)
+	}
+	code, err := users.TOTPCode(user.TOTPSecret, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestElectionScope(t *testing.T) {
+	ConfigureRevocations(tokens.NewRevocations())
+	contracts := &recordingContracts{}
+	ok := func(_ *client.Contract, c *gin.Context) { c.Status(http.StatusOK) }
+	token, err := signToken("officer", users.Scope{Roles: []string{users.RoleElectionOfficer}, Elections: []string{"election.e1"}}, accessToken, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.POST("/election", JwtMiddleware(users.CreateElections), withContract(contracts, ok))
+	r.POST("/election/:electionID/close", JwtMiddleware(users.ManageElections), withContract(contracts, ok))
+	r.GET("/getFinalResult/:electionID", JwtMiddleware(users.ReadResults), withContract(contracts, ok))
+	r.POST("/candidate", JwtMiddleware(users.ManageElections), withContract(contracts, func(contract *client.Contract, c *gin.Context) {
+		// stops before submitting, the recorded contract is nil
+		if requestScope(c).GrantsIn(c.Query("electionID"), users.ManageElections) {
+			c.Status(http.StatusOK)
+			return
+		}
+		createCandidate(contract, c)
+	}))
+	send := func(method, path, body string) int {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, c := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/election", "", http.StatusUnauthorized},
+		{"POST", "/election/e1/close", "", http.StatusOK},
+		{"POST", "/election/election.e1/close", "", http.StatusOK},
+		{"POST", "/election/e2/close", "", http.StatusUnauthorized},
+		{"GET", "/getFinalResult/e1", "", http.StatusOK},
+		{"GET", "/getFinalResult/e2", "", http.StatusUnauthorized},
+		{"POST", "/candidate?electionID=e1", "", http.StatusOK},
+		{"POST", "/candidate?electionID=e2", `{"name":"Bob","userID":"bob","electionID":"e2"}`, http.StatusForbidden},
+	} {
+		if got := send(c.method, c.path, c.body); got != c.code {
+			t.Errorf("%s %s: expected status code %d, got %d", c.method, c.path, c.code, got)
+		}
+	}
+	if len(contracts.elections) != 1 || contracts.elections[0] != "election.e1" {
+		t.Errorf("expected the identity to be limited to e1, got %v", contracts.elections)
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider, server, err := oidctest.NewServer("fabric-voting", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	provider.AddUser("alice", nil)
+	provider.AddUser("bob", nil)
+	provider.AddUser("carol", map[string]interface{}{"groups": []string{"staff"}})
+
+	store := users.NewMemoryStore()
+	bob, err := users.New("bob", "bob-password", []string{users.RoleSuperAdmin}, bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(bob); err != nil {
+		t.Fatal(err)
+	}
+	client, err := oidc.New(context.Background(), oidc.Settings{
+		Issuer:       server.URL,
+		ClientID:     "fabric-voting",
+		RedirectURL:  "http://voting.example/api/v1/auth/oidc/callback",
+		RolesClaim:   "groups",
+		RoleMapping:  map[string][]string{"staff": {users.RoleElectionOfficer}},
+		DefaultRoles: []string{users.RoleVoter},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ConfigureRevocations(tokens.NewRevocations())
+	r := SetupRouter(&recordingContracts{}, AuthCredentials{Store: store, PasswordCost: bcrypt.MinCost, OIDC: client})
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	// authorize starts a login in one browser, returning the callback query
+	// the provider sends it back with and the cookies of the browser
+	authorize := func(username string) (string, []*http.Cookie) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/auth/oidc/login", nil))
+		if w.Code != http.StatusFound {
+			t.Fatalf("expected a redirect to the provider, got %d", w.Code)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || !cookies[0].HttpOnly || cookies[0].Path != "/api/v1/auth/oidc/callback" {
+			t.Errorf("expected an HttpOnly state cookie for the callback, got %v", cookies)
+		}
+		response, err := noRedirects.Get(w.Header().Get("Location") + "&login_hint=" + username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		callback, err := url.Parse(response.Header.Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return callback.RawQuery, cookies
+	}
+	callback := func(query string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/auth/oidc/callback?"+query, nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	// login goes to the provider, which sends the browser back to the callback
+	login := func(username string) *httptest.ResponseRecorder {
+		return callback(authorize(username))
+	}
+
+	w := login("alice")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	var pair TokenPair
+	if err := json.Unmarshal(w.Body.Bytes(), &pair); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := parseToken(pair.AccessToken, accessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != "alice" || !reflect.DeepEqual(claims.Roles, []string{users.RoleVoter}) {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+	alice, found, err := store.Get("alice")
+	if err != nil || !found || alice.IdentityProvider != server.URL {
+		t.Fatalf("expected the account to be created, got %+v %v", alice, err)
+	}
+
+	// accounts of the provider have no password
+	req := httptest.NewRequest("POST", "/api/v1/authenticate", bytes.NewBufferString(`{"username":"alice","password":""}`))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a password login to be refused, got %d", w.Code)
+	}
+
+	send := func(path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	// officers enroll in two-factor authentication before getting a token
+	w = login("carol")
+	var enrollment struct {
+		EnrollmentToken string `json:"enrollmentToken"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &enrollment); err != nil || w.Code != http.StatusForbidden || enrollment.EnrollmentToken == "" {
+		t.Fatalf("expected an enrollment token, got %d: %s", w.Code, w.Body)
+	}
+	var secret TOTPEnrollment
+	if w := send("/api/v1/auth/totp/enroll", enrollment.EnrollmentToken, ""); json.Unmarshal(w.Body.Bytes(), &secret) != nil || secret.Secret == "" {
+		t.Fatalf("expected a secret, got %d: %s", w.Code, w.Body)
+	}
+	now := time.Now()
+	code, _ := users.TOTPCode(secret.Secret, now)
+	w = send("/api/v1/auth/totp/confirm", enrollment.EnrollmentToken, `{"code":"`+code+`"}`)
+	var confirmation TOTPConfirmation
+	if err := json.Unmarshal(w.Body.Bytes(), &confirmation); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected the enrollment to be confirmed, got %d: %s", w.Code, w.Body)
+	}
+	claims, err = parseToken(confirmation.AccessToken, accessToken)
+	if err != nil || !reflect.DeepEqual(claims.Roles, []string{users.RoleVoter, users.RoleElectionOfficer}) {
+		t.Errorf("unexpected claims %+v %v", claims, err)
+	}
+
+	// once enrolled the code is verified after the callback, and the
+	// provider decides the roles on every login
+	provider.AddUser("carol", nil)
+	w = login("carol")
+	var challenge struct {
+		TwoFactorToken string `json:"twoFactorToken"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &challenge); err != nil || w.Code != http.StatusUnauthorized || challenge.TwoFactorToken == "" {
+		t.Fatalf("expected a two-factor token, got %d: %s", w.Code, w.Body)
+	}
+	if w := send("/api/v1/user", challenge.TwoFactorToken, `{}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the two-factor token to be refused elsewhere, got %d", w.Code)
+	}
+	if w := send("/api/v1/auth/totp/verify", challenge.TwoFactorToken, `{"code":"`+code+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a used code to be refused, got %d", w.Code)
+	}
+	next, _ := users.TOTPCode(secret.Secret, now.Add(users.TOTPPeriod))
+	w = send("/api/v1/auth/totp/verify", challenge.TwoFactorToken, `{"code":"`+next+`"}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &pair); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected tokens, got %d: %s", w.Code, w.Body)
+	}
+	if claims, err := parseToken(pair.AccessToken, accessToken); err != nil || !reflect.DeepEqual(claims.Roles, []string{users.RoleVoter}) {
+		t.Errorf("expected the officer role to be dropped, got %+v %v", claims, err)
+	}
+	if w := send("/api/v1/auth/totp/verify", challenge.TwoFactorToken, `{"code":"`+confirmation.RecoveryCodes[0]+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the two-factor token to be spent, got %d", w.Code)
+	}
+
+	if w := login("bob"); w.Code != http.StatusConflict {
+		t.Errorf("expected a local account not to be taken over, got %d", w.Code)
+	}
+
+	// accounts follow the subject, not the name the provider claims
+	provider.AddUser("alice", map[string]interface{}{"preferred_username": "alice.smith"})
+	if w := login("alice"); w.Code != http.StatusOK {
+		t.Fatalf("expected a renamed user to log in, got %d: %s", w.Code, w.Body)
+	}
+	if alice, _, _ := store.Get("alice"); alice.DisplayName != "alice.smith" {
+		t.Errorf("expected the new name to be shown, got %q", alice.DisplayName)
+	}
+	if _, found, _ := store.Get("alice.smith"); found {
+		t.Error("expected no account for the new name")
+	}
+	provider.AddUser("mallory", map[string]interface{}{"preferred_username": "alice"})
+	if w := login("mallory"); w.Code != http.StatusConflict {
+		t.Errorf("expected another subject claiming the name to be refused, got %d", w.Code)
+	}
+
+	// a callback is only completed by the browser that started the login
+	query, cookies := authorize("alice")
+	if w := callback(query, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a callback without the state cookie to be refused, got %d", w.Code)
+	}
+	_, otherCookies := authorize("alice")
+	if w := callback(query, otherCookies); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the cookie of another login to be refused, got %d", w.Code)
+	}
+	if w := callback(query, cookies); w.Code != http.StatusOK {
+		t.Errorf("expected the login to complete in its browser, got %d: %s", w.Code, w.Body)
+	}
+	if w := callback("code=x&state=forged", []*http.Cookie{{Name: oidcStateCookie, Value: "forged"}}); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected an unknown state to be refused, got %d", w.Code)
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	store := users.NewMemoryStore()
+	root, err := users.New("root", "root-password", []string{users.RoleSuperAdmin}, bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(root); err != nil {
+		t.Fatal(err)
+	}
+	ConfigureRevocations(tokens.NewRevocations())
+	r := SetupRouter(&recordingContracts{}, AuthCredentials{Store: store, PasswordCost: bcrypt.MinCost})
+	send := func(path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	login := func(code string) *httptest.ResponseRecorder {
+		return send("/api/v1/authenticate", "", `{"username":"root","password":"root-password","code":"`+code+`"}`)
+	}
+
+	// admins without a second factor only get a token to enroll with
+	w := login("")
+	var enrollment struct {
+		EnrollmentToken string `json:"enrollmentToken"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &enrollment); err != nil || w.Code != http.StatusForbidden || enrollment.EnrollmentToken == "" {
+		t.Fatalf("expected an enrollment token, got %d: %s", w.Code, w.Body)
+	}
+	if w := send("/api/v1/user", enrollment.EnrollmentToken, `{}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the enrollment token to be refused elsewhere, got %d", w.Code)
+	}
+	if w := send("/api/v1/auth/totp/confirm", enrollment.EnrollmentToken, `{"code":"123456"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected a confirmation before enrolling to be refused, got %d", w.Code)
+	}
+
+	w = send("/api/v1/auth/totp/enroll", enrollment.EnrollmentToken, "")
+	var secret TOTPEnrollment
+	if err := json.Unmarshal(w.Body.Bytes(), &secret); err != nil || w.Code != http.StatusOK || !strings.HasPrefix(secret.URI, "otpauth://totp/") {
+		t.Fatalf("expected a secret, got %d: %s", w.Code, w.Body)
+	}
+	w = send("/api/v1/auth/totp/confirm", enrollment.EnrollmentToken, `{"code":"`+unusedTOTPCode(t, store, "root")+`"}`)
+	var confirmation TOTPConfirmation
+	if err := json.Unmarshal(w.Body.Bytes(), &confirmation); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected the enrollment to be confirmed, got %d: %s", w.Code, w.Body)
+	}
+	if len(confirmation.RecoveryCodes) != users.RecoveryCodeCount || confirmation.AccessToken == "" {
+		t.Errorf("expected tokens and recovery codes, got %+v", confirmation)
+	}
+	if w := send("/api/v1/auth/totp/enroll", enrollment.EnrollmentToken, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the enrollment token to be spent, got %d", w.Code)
+	}
+	if w := send("/api/v1/auth/totp/enroll", confirmation.AccessToken, ""); w.Code != http.StatusConflict {
+		t.Errorf("expected a second enrollment to be refused, got %d", w.Code)
+	}
+
+	// from now on the password alone is not enough
+	if w := login(""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a login without code to be refused, got %d", w.Code)
+	}
+	if w := login("000000"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a wrong code to be refused, got %d", w.Code)
+	}
+	code := unusedTOTPCode(t, store, "root")
+	if w := login(code); w.Code != http.StatusOK {
+		t.Errorf("expected the code to log in, got %d: %s", w.Code, w.Body)
+	}
+	if w := login(code); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a used code to be refused, got %d", w.Code)
+	}
+	if w := login(confirmation.RecoveryCodes[0]); w.Code != http.StatusOK {
+		t.Errorf("expected a recovery code to log in, got %d", w.Code)
+	}
+	if w := login(confirmation.RecoveryCodes[0]); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a used recovery code to be refused, got %d", w.Code)
+	}
+	// a code sent by concurrent logins is spent by only one of them, the others
+	// stay below the invalid codes that lock the account
+	var wg sync.WaitGroup
+	var accepted int32
+	for i := 0; i < users.MaxTOTPFailures-1; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := login(confirmation.RecoveryCodes[2]); w.Code == http.StatusOK {
+				atomic.AddInt32(&accepted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted != 1 {
+		t.Errorf("expected the recovery code to log in once, got %d", accepted)
+	}
+
+	// codes of two periods were used, pretend they passed
+	root, _, _ = store.Get("root")
+	root.TOTPLastStep -= 2
+	if err := store.Update(root); err != nil {
+		t.Fatal(err)
+	}
+	w = send("/api/v1/auth/totp/recoveryCodes", confirmation.AccessToken, `{"code":"`+unusedTOTPCode(t, store, "root")+`"}`)
+	var recovery []string
+	if err := json.Unmarshal(w.Body.Bytes(), &recovery); err != nil || w.Code != http.StatusOK || len(recovery) != users.RecoveryCodeCount {
+		t.Fatalf("expected new recovery codes, got %d: %s", w.Code, w.Body)
+	}
+	if w := login(confirmation.RecoveryCodes[1]); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the old recovery codes to be replaced, got %d", w.Code)
+	}
+
+	// an admin resets the second factor of an account that lost it
+	if w := send("/api/v1/user/root/totp/reset", confirmation.AccessToken, ""); w.Code != http.StatusOK {
+		t.Fatalf("expected the reset to succeed, got %d: %s", w.Code, w.Body)
+	}
+	if w := login(recovery[0]); w.Code != http.StatusForbidden {
+		t.Errorf("expected the account to enroll again, got %d", w.Code)
+	}
+}
+
+func TestTwoFactorLockout(t *testing.T) {
+	store := users.NewMemoryStore()
+	root, err := users.New("root", "root-password", []string{users.RoleSuperAdmin}, bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enableTOTP(t, &root)
+	if err := store.Create(root); err != nil {
+		t.Fatal(err)
+	}
+	ConfigureRevocations(tokens.NewRevocations())
+	r := SetupRouter(&recordingContracts{}, AuthCredentials{Store: store, PasswordCost: bcrypt.MinCost})
+	login := func(code string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/authenticate", bytes.NewBufferString(`{"username":"root","password":"root-password","code":"`+code+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < users.MaxTOTPFailures; i++ {
+		if w := login("000000"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected wrong code %d to be refused, got %d", i, w.Code)
+		}
+	}
+	// once locked even the right code is refused, without being spent
+	code := unusedTOTPCode(t, store, "root")
+	if w := login(code); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the account to be locked, got %d: %s", w.Code, w.Body)
+	}
+
+	// the lock runs out
+	root, _, _ = store.Get("root")
+	if !root.TOTPLocked(time.Now()) {
+		t.Fatal("expected the lock to be stored")
+	}
+	root.TOTPLockedUntil = time.Now().Add(-time.Second)
+	if err := store.Update(root); err != nil {
+		t.Fatal(err)
+	}
+	if w := login(code); w.Code != http.StatusOK {
+		t.Errorf("expected the code to log in after the lock, got %d: %s", w.Code, w.Body)
+	}
+	if w := login("000000"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a wrong code to be refused, got %d", w.Code)
+	}
+	if root, _, _ = store.Get("root"); root.TOTPFailures != 1 {
+		t.Errorf("expected the count to restart after a valid code, got %d", root.TOTPFailures)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/izqalan/fabric-voting/app/users"
 	"google.golang.org/grpc/status"
 	"net/http"
 	"sync"
@@ -73,6 +74,11 @@ func createCandidate(contract *client.Contract, c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	// the election is in the body, JwtMiddleware could not check the scope
+	if !requestScope(c).GrantsIn(candidate.ElectionID, users.ManageElections) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you cannot manage election " + candidate.ElectionID})
+		return
+	}
 
 	_, err := contract.SubmitTransaction("createCandidate", candidate.Name, candidate.UserID, candidate.ElectionID)
 	if err != nil {
@@ -92,15 +98,32 @@ func createCandidate(contract *client.Contract, c *gin.Context) {
 	})
 }
 
+// CandidatePage is one page of candidates, pass Bookmark to fetch the next one.
+// Bookmark is empty on the last page.
+type CandidatePage struct {
+	Candidates []candidateElectionList `json:"candidates"`
+	Bookmark   string                  `json:"bookmark"`
+	Count      int                     `json:"count"`
+}
+
 // @Summary Get all Candidates
-// @Description Get all candidates
+// @Description Get all candidates, a page at a time
 // @Tags Candidate
 // @Accept  json
 // @Produce  json
-// @Success 200 {string} string "Candidates fetched"
+// @Param pageSize query int false "Candidates per page, 50 by default"
+// @Param bookmark query string false "Bookmark returned with the previous page"
+// @Param electionID query string false "Only candidates running in this election"
+// @Param name query string false "Only candidates whose name starts with this prefix, ignoring case"
+// @Success 200 {object} CandidatePage "Candidates fetched"
 // @Router /Candidate [get]
 func getAllCandidates(contract *client.Contract, c *gin.Context) {
-	result, err := contract.EvaluateTransaction("queryByRange", "candidate.", "candidate.z")
+	pageSize, bookmark, ok := pageQuery(c)
+	if !ok {
+		return
+	}
+
+	result, err := contract.EvaluateTransaction("queryCandidates", pageSize, bookmark, c.Query("electionID"), c.Query("name"))
 	if err != nil {
 		if s, ok := status.FromError(err); ok {
 			c.JSON(http.StatusBadRequest, gin.H{"detail": s.Details(), "message": s.Message()})
@@ -110,26 +133,27 @@ func getAllCandidates(contract *client.Contract, c *gin.Context) {
 		panic(fmt.Errorf("failed to evaluate transaction: %w", err))
 	}
 
-	fmt.Println(string(result))
-
 	var response []CandidateListLedger
-	err = json.Unmarshal(result, &response)
+	page, err := decodePage(result, &response)
 	if err != nil {
 		c.JSON(http.StatusRequestTimeout, gin.H{"error": err.Error()})
 		return
 	}
 
-	finalRes := make([]candidateElectionList, len(response))
+	finalRes := CandidatePage{
+		Candidates: make([]candidateElectionList, len(response)),
+		Bookmark:   page.Bookmark,
+		Count:      page.Count,
+	}
 
 	for i, c := range response {
-		fmt.Println("tssss", c.Record)
-		finalRes[i] = candidateElectionList{
+		finalRes.Candidates[i] = candidateElectionList{
 			Name:   c.Record.Name,
 			UserID: c.Key,
 		}
-		finalRes[i].Elections = make([]candidateState, len(c.Record.Elections))
+		finalRes.Candidates[i].Elections = make([]candidateState, len(c.Record.Elections))
 		for j, e := range c.Record.Elections {
-			finalRes[i].Elections[j] = candidateState{
+			finalRes.Candidates[i].Elections[j] = candidateState{
 				ElectionID: e.ElectionID,
 			}
 		}
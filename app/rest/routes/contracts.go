@@ -0,0 +1,33 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/izqalan/fabric-voting/app/users"
+)
+
+// Contracts hands out the contract a user submits transactions with, signed
+// by a Fabric identity enrolled for the user and one of the roles. Officer
+// identities are limited to the elections.
+type Contracts interface {
+	Contract(userID string, roles, elections []string) (*client.Contract, error)
+}
+
+// withContract runs handler with the contract of the user authenticated by
+// JwtMiddleware, which has to run first. The identity is picked among the
+// roles granting the permissions of the route, so voting always goes through
+// the voter identity of an account that also manages elections.
+func withContract(contracts Contracts, handler func(*client.Contract, *gin.Context)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope := requestScope(c)
+		roles := grantedRoles(scope, c.Param("electionID"), c.MustGet("permissions").([]users.Permission))
+		contract, err := contracts.Contract(c.GetString("userID"), roles, scope.Elections)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to load the user's identity: " + err.Error()})
+			return
+		}
+		handler(contract, c)
+	}
+}
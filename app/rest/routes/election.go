@@ -7,20 +7,56 @@ import (
 	"github.com/hyperledger/fabric-gateway/pkg/client"
 	"google.golang.org/grpc/status"
 	"net/http"
-	"time"
+	"strconv"
 )
 
+// Election dates are RFC3339 timestamps, dates without a zone are read as UTC
 type Election struct {
 	ElectionID   string `json:"electionID"`
 	ElectionName string `json:"electionName"`
 	StartDate    string `json:"startDate"`
 	EndDate      string `json:"endDate"`
 	UpdatedAt    string `json:"updatedAt"`
+	// CreatedAt and Status are set by the chaincode
+	CreatedAt  string `json:"createdAt,omitempty"`
+	Status     string `json:"status,omitempty"`
+	BallotType string `json:"ballotType"`
+	MaxChoices int    `json:"maxChoices"`
+	Seats      int    `json:"seats"`
+	// SecretBallot stores ballots under random keys that do not lead to the
+	// voter, whose record then only shows participation. Encrypted and
+	// homomorphic elections always keep their ballots secret.
+	SecretBallot bool `json:"secretBallot"`
+	// Encryption is required for elections with the "encrypted" or "homomorphic" ballot type
+	Encryption *EncryptionSettings `json:"encryption,omitempty"`
+	// LiveResults makes results readable before the election has ended
+	LiveResults bool `json:"liveResults"`
+}
+
+// EncryptionSettings hold the public key of an encrypted election and how
+// many of its trustees have to submit decryption shares. TrusteeKeys are the
+// public parts of the key shares and TrusteeIDs the users who submit them,
+// both in trustee index order.
+type EncryptionSettings struct {
+	PublicKey   string   `json:"publicKey"`
+	Threshold   int      `json:"threshold"`
+	Trustees    int      `json:"trustees"`
+	TrusteeKeys []string `json:"trusteeKeys"`
+	TrusteeIDs  []string `json:"trusteeIDs"`
+}
+
+// optionalInt passes unset (zero) numeric settings as empty arguments so the
+// chaincode applies its defaults
+func optionalInt(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
 }
 
 // update getFinalResult
 // @Summary get final result of an Election
-// @Description this API will iterate over the ledger to find the exact amount of votes given to each Candidate in an Election
+// @Description returns the votes counted for each Candidate of an Election. Results of a running Election are only available if it was created with liveResults
 // @Tags Election
 // @Accept  json
 // @Produce  json
@@ -30,7 +66,8 @@ type Election struct {
 func getFinalResult(contract *client.Contract, c *gin.Context) {
 	electionID := c.Param("electionID")
 
-	result, err := contract.SubmitTransaction("getFinalResult", electionID)
+	// a read, evaluating it keeps it off the ledger
+	result, err := contract.EvaluateTransaction("getFinalResult", electionID)
 	if err != nil {
 		if s, ok := status.FromError(err); ok {
 			c.JSON(http.StatusBadRequest, gin.H{"detail": s.Details(), "message": s.Message()})
@@ -41,7 +78,7 @@ func getFinalResult(contract *client.Contract, c *gin.Context) {
 			return
 		}
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		panic(fmt.Errorf("failed to get transaction: %w", err))
+		panic(fmt.Errorf("failed to evaluate transaction: %w", err))
 	}
 
 	var r map[string]int
@@ -52,6 +89,76 @@ func getFinalResult(contract *client.Contract, c *gin.Context) {
 	})
 }
 
+// @Summary get instant-runoff result of a ranked Election
+// @Description runs the instant-runoff count of a ranked Election and returns the winner with every counting round
+// @Tags Election
+// @Accept  json
+// @Produce  json
+// @Param electionID path string true "Election ID"
+// @Success 200 {object} map "{'winner':'candidate.1','rounds':[...]}"
+// @Router /getRankedResult/{electionID} [get]
+func getRankedResult(contract *client.Contract, c *gin.Context) {
+	electionID := c.Param("electionID")
+
+	result, err := contract.EvaluateTransaction("getRankedResult", electionID)
+	if err != nil {
+		if s, ok := status.FromError(err); ok {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": s.Details(), "message": s.Message()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		panic(fmt.Errorf("failed to evaluate transaction: %w", err))
+	}
+
+	var response interface{}
+	err = json.Unmarshal(result, &response)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		panic(fmt.Errorf("failed to unmarshal JSON data: %w", err))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Ranked result fetched",
+		"data":    response,
+		"status":  http.StatusOK,
+	})
+}
+
+// @Summary get the winning seats of an Election
+// @Description counts a plurality or approval Election and returns the candidates filling its seats
+// @Tags Election
+// @Accept  json
+// @Produce  json
+// @Param electionID path string true "Election ID"
+// @Success 200 {object} map "{'winners':['candidate.1'],'tally':{'candidate.1':10}}"
+// @Router /getSeatResult/{electionID} [get]
+func getSeatResult(contract *client.Contract, c *gin.Context) {
+	electionID := c.Param("electionID")
+
+	result, err := contract.EvaluateTransaction("getSeatResult", electionID)
+	if err != nil {
+		if s, ok := status.FromError(err); ok {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": s.Details(), "message": s.Message()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		panic(fmt.Errorf("failed to evaluate transaction: %w", err))
+	}
+
+	var response interface{}
+	err = json.Unmarshal(result, &response)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		panic(fmt.Errorf("failed to unmarshal JSON data: %w", err))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Seat result fetched",
+		"data":    response,
+		"status":  http.StatusOK,
+	})
+}
+
 // @Summary Create Election
 // @Description Create a new Election
 // @Tags Election
@@ -68,15 +175,17 @@ func createElection(contract *client.Contract, c *gin.Context) {
 		return
 	}
 
-	// generate electionID using timestamp
-	// eg Election.1621234567
-	// which translates to Election.<timestamp>
-	currentTime := time.Now()
-	electionID := fmt.Sprintf("election.%d", currentTime.Unix())
-	// time in readable utc
-	createdAt := currentTime.UTC().String()
+	encryption := ""
+	if election.Encryption != nil {
+		settings, _ := json.Marshal(election.Encryption)
+		encryption = string(settings)
+	}
 
-	_, err := contract.SubmitTransaction("createElection", election.ElectionName, election.StartDate, election.EndDate, electionID, createdAt)
+	// the chaincode derives the electionID and creation time from the transaction
+	// so every endorsing peer agrees on them
+	result, err := contract.SubmitTransaction("createElection", election.ElectionName, election.StartDate, election.EndDate,
+		election.BallotType, optionalInt(election.MaxChoices), optionalInt(election.Seats), strconv.FormatBool(election.SecretBallot),
+		encryption, strconv.FormatBool(election.LiveResults))
 	if err != nil {
 		if s, ok := status.FromError(err); ok {
 			c.JSON(http.StatusBadRequest, gin.H{"detail": s.Details(), "message": s.Message()})
@@ -88,7 +197,137 @@ func createElection(contract *client.Contract, c *gin.Context) {
 
 	fmt.Printf("*** Transaction committed successfully\n")
 
-	c.JSON(http.StatusCreated, electionID)
+	c.JSON(http.StatusCreated, string(result))
+}
+
+// @Summary Compact the vote counters of an Election
+// @Description folds the vote deltas written by every vote into the per-shard counts so results stay cheap to read. Compacting a single shard is less likely to conflict with votes coming in at the same time.
+// @Tags Election
+// @Accept  json
+// @Produce  json
+// @Param electionID path string true "Election ID"
+// @Param shard query int false "Shard to compact, all when omitted"
+// @Success 200 {object} map "{'compacted':120}"
+// @Router /Election/{electionID}/compact [post]
+func compactVoteCounts(contract *client.Contract, c *gin.Context) {
+	electionID := c.Param("electionID")
+
+	result, err := contract.SubmitTransaction("compactVoteCounts", electionID, c.Query("shard"))
+	if err != nil {
+		if s, ok := status.FromError(err); ok {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": s.Details(), "message": s.Message()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		panic(fmt.Errorf("failed to submit transaction: %w", err))
+	}
+
+	var response map[string]int
+	err = json.Unmarshal(result, &response)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		panic(fmt.Errorf("failed to unmarshal JSON data: %w", err))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Vote counters compacted. Txn committed successfully.",
+		"data":    response,
+		"status":  http.StatusOK,
+	})
+}
+
+// BallotRecord is a recorded ballot, Key being the voter ID of a public ballot
+// or the hash a secret ballot is stored under
+type BallotRecord struct {
+	Key       string          `json:"key"`
+	Ballot    []string        `json:"ballot,omitempty"`
+	Encrypted json.RawMessage `json:"encrypted,omitempty"`
+}
+
+// BallotPage is one page of ballots, pass Bookmark to fetch the next one.
+// Bookmark is empty on the last page.
+type BallotPage struct {
+	Ballots  []BallotRecord `json:"ballots"`
+	Bookmark string         `json:"bookmark"`
+	Count    int            `json:"count"`
+}
+
+// @Summary Get the recorded ballots of an Election
+// @Description lists the raw ballots of an Election a page at a time. The chaincode only lets identities with the admin or auditor role attribute read them.
+// @Tags Election
+// @Accept  json
+// @Produce  json
+// @Param electionID path string true "Election ID"
+// @Param pageSize query int false "Ballots per page, 50 by default"
+// @Param bookmark query string false "Bookmark returned with the previous page"
+// @Success 200 {object} BallotPage "Ballots fetched"
+// @Router /Election/{electionID}/ballots [get]
+func getBallotRecords(contract *client.Contract, c *gin.Context) {
+	pageSize, bookmark, ok := pageQuery(c)
+	if !ok {
+		return
+	}
+
+	result, err := contract.EvaluateTransaction("getBallotRecords", c.Param("electionID"), pageSize, bookmark)
+	if err != nil {
+		if s, ok := status.FromError(err); ok {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": s.Details(), "message": s.Message()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		panic(fmt.Errorf("failed to query transaction: %w", err))
+	}
+
+	ballots := []BallotRecord{}
+	page, err := decodePage(result, &ballots)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		panic(fmt.Errorf("failed to unmarshal JSON data: %w", err))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Ballots fetched successfully.",
+		"data":    BallotPage{Ballots: ballots, Bookmark: page.Bookmark, Count: page.Count},
+		"status":  http.StatusOK,
+	})
+}
+
+// @Summary Move an Election along its lifecycle
+// @Description opens, closes, tallies or archives an Election (draft -> open -> closed -> tallied -> archived)
+// @Tags Election
+// @Accept  json
+// @Produce  json
+// @Param electionID path string true "Election ID"
+// @Success 200 {string} string "Election updated"
+// @Router /Election/{electionID}/open [post]
+// @Router /Election/{electionID}/close [post]
+// @Router /Election/{electionID}/tally [post]
+// @Router /Election/{electionID}/archive [post]
+func transitionElection(contract *client.Contract, c *gin.Context, function string) {
+	electionID := c.Param("electionID")
+
+	result, err := contract.SubmitTransaction(function, electionID)
+	if err != nil {
+		if s, ok := status.FromError(err); ok {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": s.Details(), "message": s.Message()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		panic(fmt.Errorf("failed to submit transaction: %w", err))
+	}
+
+	var response interface{}
+	err = json.Unmarshal(result, &response)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		panic(fmt.Errorf("failed to unmarshal JSON data: %w", err))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Election updated. Txn committed successfully.",
+		"data":    response,
+		"status":  http.StatusOK,
+	})
 }
 
 // @Summary Get Election by id
@@ -127,16 +366,30 @@ func getElectionById(contract *client.Contract, c *gin.Context) {
 	})
 }
 
+// ElectionPage is one page of elections, pass Bookmark to fetch the next one.
+// Bookmark is empty on the last page.
+type ElectionPage struct {
+	Elections []Election `json:"elections"`
+	Bookmark  string     `json:"bookmark"`
+	Count     int        `json:"count"`
+}
+
 // @Summary Get All Elections
-// @Description Get all elections
+// @Description Get all elections, a page at a time
 // @Tags Election
 // @Accept  json
 // @Produce  json
-// @Success 200 {string} string "Elections fetched"
+// @Param pageSize query int false "Elections per page, 50 by default"
+// @Param bookmark query string false "Bookmark returned with the previous page"
+// @Success 200 {object} ElectionPage "Elections fetched"
 // @Router /Election [get]
 func getAllElections(contract *client.Contract, c *gin.Context) {
-	// get all elections using queryByRange function chaincode
-	result, err := contract.EvaluateTransaction("queryByRange", "election.", "election.z")
+	pageSize, bookmark, ok := pageQuery(c)
+	if !ok {
+		return
+	}
+
+	result, err := contract.EvaluateTransaction("getAllElections", pageSize, bookmark)
 	if err != nil {
 		if s, ok := status.FromError(err); ok {
 			c.JSON(http.StatusBadRequest, gin.H{"detail": s.Details(), "message": s.Message()})
@@ -146,19 +399,8 @@ func getAllElections(contract *client.Contract, c *gin.Context) {
 		panic(fmt.Errorf("failed to query transaction: %w", err))
 	}
 
-	// Record represents a record that can either be an Election or a raw string for candidates
-	type Record struct {
-		Election  *Election `json:"Record,omitempty"`
-		Candidate string    `json:"candidate,omitempty"`
-	}
-
-	// Data represents the structure of the entire JSON
-	type Data struct {
-		Key string `json:"Key"`
-	}
-
-	var data []Data
-	err = json.Unmarshal(result, &data)
+	var page ElectionPage
+	err = json.Unmarshal(result, &page)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		panic(fmt.Errorf("failed to unmarshal JSON data: %w", err))
@@ -166,7 +408,7 @@ func getAllElections(contract *client.Contract, c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Elections fetched successfully.",
-		"data":    data,
+		"data":    page,
 		"status":  http.StatusOK,
 	})
 
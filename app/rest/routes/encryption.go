@@ -0,0 +1,131 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/izqalan/fabric-voting/app/ballot"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"strconv"
+)
+
+// DecryptionShareRequest holds the shares a trustee computed of the sums of
+// getEncryptedSums, keyed by candidate ID, see cmd/trusteeshare. The key share
+// never leaves the trustee.
+type DecryptionShareRequest struct {
+	TrusteeIndex int                                 `json:"trusteeIndex"`
+	Shares       map[string]ballot.PartialDecryption `json:"shares"`
+}
+
+// @Summary Get encryption info of an Election
+// @Description returns the public key of an encrypted Election and the candidates in the order of the ciphertexts of a ballot
+// @Tags Election
+// @Accept  json
+// @Produce  json
+// @Param electionID path string true "Election ID"
+// @Success 200 {object} map "{'publicKey':'..','threshold':2,'trustees':3,'trusteeKeys':['..'],'trusteeIDs':['user1'],'candidates':['candidate.1']}"
+// @Router /Election/{electionID}/encryption [get]
+func getEncryptionInfo(contract *client.Contract, c *gin.Context) {
+	electionID := c.Param("electionID")
+
+	result, err := contract.EvaluateTransaction("getEncryptionInfo", electionID)
+	if err != nil {
+		if s, ok := status.FromError(err); ok {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": s.Details(), "message": s.Message()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		panic(fmt.Errorf("failed to evaluate transaction: %w", err))
+	}
+
+	var response interface{}
+	err = json.Unmarshal(result, &response)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		panic(fmt.Errorf("failed to unmarshal JSON data: %w", err))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Encryption info fetched",
+		"data":    response,
+		"status":  http.StatusOK,
+	})
+}
+
+// @Summary Get the encrypted sums of an Election
+// @Description returns the sum of the encrypted ballots of every candidate of an ended encrypted Election, the ciphertexts trustees compute their decryption shares for
+// @Tags Election
+// @Produce  json
+// @Param electionID path string true "Election ID"
+// @Success 200 {array} ballot.Sum "Sum of every candidate"
+// @Router /Election/{electionID}/encryptedSums [get]
+func getEncryptedSums(contract *client.Contract, c *gin.Context) {
+	electionID := c.Param("electionID")
+
+	result, err := contract.EvaluateTransaction("getEncryptedBallots", electionID)
+	if err != nil {
+		if s, ok := status.FromError(err); ok {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": s.Details(), "message": s.Message()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		panic(fmt.Errorf("failed to evaluate transaction: %w", err))
+	}
+
+	var sums []ballot.Sum
+	if err := json.Unmarshal(result, &sums); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		panic(fmt.Errorf("failed to unmarshal JSON data: %w", err))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Encrypted sums fetched",
+		"data":    sums,
+		"status":  http.StatusOK,
+	})
+}
+
+// @Summary Submit a trustee decryption share
+// @Description submits the decryption shares a trustee computed of the encrypted sums of an ended encrypted Election, with proofs that they were computed with the key share. Only the user recorded for the trustee index can submit, once. Once the threshold is reached the result is published.
+// @Tags Election
+// @Accept  json
+// @Produce  json
+// @Param electionID path string true "Election ID"
+// @Body  {object} DecryptionShareRequest
+// @Success 200 {object} map "{'shares':2,'threshold':2,'published':true}"
+// @Router /Election/{electionID}/decryptionShare [post]
+func submitDecryptionShare(contract *client.Contract, c *gin.Context) {
+	electionID := c.Param("electionID")
+
+	var request DecryptionShareRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sharesJSON, _ := json.Marshal(request.Shares)
+
+	result, err := contract.SubmitTransaction("submitDecryptionShare", electionID, strconv.Itoa(request.TrusteeIndex), string(sharesJSON))
+	if err != nil {
+		if s, ok := status.FromError(err); ok {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": s.Details(), "message": s.Message()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		panic(fmt.Errorf("failed to submit transaction: %w", err))
+	}
+
+	var response interface{}
+	err = json.Unmarshal(result, &response)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		panic(fmt.Errorf("failed to unmarshal JSON data: %w", err))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Decryption share submitted. Txn committed successfully.",
+		"data":    response,
+		"status":  http.StatusOK,
+	})
+}
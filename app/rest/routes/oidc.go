@@ -0,0 +1,151 @@
+package routes
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/izqalan/fabric-voting/app/oidc"
+	"github.com/izqalan/fabric-voting/app/users"
+)
+
+// oidcStateCookie binds a login to the browser that started it, so a callback
+// carrying someone else's code and state is refused
+const oidcStateCookie = "oidc_state"
+
+// setStateCookie stores the state for the callback route only, or clears it
+// when the state is empty
+func setStateCookie(c *gin.Context, client *oidc.Client, state string) {
+	path, secure := "/", false
+	if redirect, err := url.Parse(client.RedirectURL()); err == nil {
+		path, secure = redirect.Path, redirect.Scheme == "https"
+	}
+	maxAge := int(oidc.LoginTimeout / time.Second)
+	if state == "" {
+		maxAge = -1
+	}
+	// Lax still sends the cookie along the provider's redirect back
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, maxAge, path, "", secure, true)
+}
+
+// @Summary Log in with the identity provider
+// @Description redirects to the OpenID Connect provider, which sends the user back to the callback
+// @Tags Auth
+// @Success 302 {string} string "Redirect to the provider"
+// @Router /auth/oidc/login [get]
+func oidcLogin(credentials AuthCredentials) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		url, state, err := credentials.OIDC.Login()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to start login")
+			return
+		}
+		setStateCookie(c, credentials.OIDC, state)
+		c.Redirect(http.StatusFound, url)
+	}
+}
+
+// @Summary Identity provider callback
+// @Description completes a login at the OpenID Connect provider, started by the same browser. The account is found by the user's subject at the provider and created on the first login, named by the username the provider claims; its roles follow the groups claimed by the provider. Accounts with two-factor authentication are given a token to verify their code with at /auth/totp/verify, accounts required to use it and not enrolled a token to enroll with.
+// @Tags Auth
+// @Produce  json
+// @Param code query string true "Authorization code"
+// @Param state query string true "State of the login"
+// @Success 200 {object} TokenPair "Tokens of the account"
+// @Router /auth/oidc/callback [get]
+func oidcCallback(credentials AuthCredentials) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if reason := c.Query("error"); reason != "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, "Login failed: "+reason)
+			return
+		}
+		state, err := c.Cookie(oidcStateCookie)
+		if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, "Login failed: the login was not started by this browser")
+			return
+		}
+		setStateCookie(c, credentials.OIDC, "")
+		identity, err := credentials.OIDC.Exchange(c.Request.Context(), c.Query("code"), state)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, "Login failed: "+err.Error())
+			return
+		}
+
+		issuer := credentials.OIDC.Issuer()
+		user, found, err := credentials.Store.GetExternal(issuer, identity.Subject)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to look up user")
+			return
+		}
+		if !found {
+			// accounts created before subjects were stored are claimed by name once
+			user, found, err = credentials.Store.Get(identity.Username)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to look up user")
+				return
+			}
+			if found && (user.IdentityProvider != issuer || user.Subject != "") {
+				// an account is not taken over by whoever has its name at the provider
+				c.AbortWithStatusJSON(http.StatusConflict, "Username belongs to another account")
+				return
+			}
+		}
+		if !found {
+			user, err = users.NewExternal(identity.Username, issuer, identity.Subject, identity.Roles)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to create user")
+				return
+			}
+			if err := credentials.Store.Create(user); err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to create user")
+				return
+			}
+		} else {
+			// the provider decides the roles, the admins the elections and whether the account is disabled
+			user, err = credentials.Store.Modify(user.Username, func(u *users.User) error {
+				u.Subject = identity.Subject
+				u.DisplayName = identity.Username
+				u.Roles = identity.Roles
+				u.UpdatedAt = time.Now().UTC()
+				return nil
+			})
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to update user")
+				return
+			}
+		}
+		if user.Disabled {
+			c.AbortWithStatusJSON(http.StatusForbidden, "Account disabled")
+			return
+		}
+
+		// the provider's own second factor is not known here, accounts beyond
+		// voting prove theirs as on a password login before getting a token
+		if user.TOTPEnabled || users.TwoFactorRequired(user.Roles) {
+			if !user.TOTPEnabled {
+				abortEnrollment(c, user)
+				return
+			}
+			token, err := signToken(user.Username, users.Scope{}, twoFactorToken, twoFactorLifetime)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to generate token")
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error":          "Two-factor code required",
+				"twoFactorToken": token,
+			})
+			return
+		}
+
+		pair, err := generateTokens(user)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to generate token")
+			return
+		}
+		c.JSON(http.StatusOK, pair)
+	}
+}
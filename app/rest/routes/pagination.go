@@ -0,0 +1,42 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+// recordPage is a page of a filtered chaincode listing
+type recordPage struct {
+	Records  []json.RawMessage `json:"records"`
+	Bookmark string            `json:"bookmark"`
+	Count    int               `json:"count"`
+}
+
+// pageQuery reads the pageSize and bookmark query parameters, answering with
+// 400 and returning false if pageSize is not a number
+func pageQuery(c *gin.Context) (string, string, bool) {
+	pageSize := c.Query("pageSize")
+	if pageSize != "" {
+		if _, err := strconv.Atoi(pageSize); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "pageSize must be a number"})
+			return "", "", false
+		}
+	}
+	return pageSize, c.Query("bookmark"), true
+}
+
+// decodePage unmarshals every record of a page into records, a pointer to a slice
+func decodePage(result []byte, records interface{}) (recordPage, error) {
+	var page recordPage
+	if err := json.Unmarshal(result, &page); err != nil {
+		return page, err
+	}
+	raw, _ := json.Marshal(page.Records)
+	if err := json.Unmarshal(raw, records); err != nil {
+		return page, fmt.Errorf("failed to decode records: %w", err)
+	}
+	return page, nil
+}
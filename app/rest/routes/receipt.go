@@ -0,0 +1,80 @@
+package routes
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"google.golang.org/grpc/status"
+	"net/http"
+)
+
+// Receipt is returned for every vote. Commitment hashes the stored ballot with
+// Nonce, which only the voter receives, so keeping the receipt lets them check
+// their ballot later without anyone else learning it.
+type Receipt struct {
+	TxID       string `json:"txID"`
+	ElectionID string `json:"electionID"`
+	Commitment string `json:"commitment"`
+	Nonce      string `json:"nonce,omitempty"`
+}
+
+type receiptVerification struct {
+	Receipt
+	Recorded bool `json:"recorded"`
+	Verified bool `json:"verified"`
+}
+
+func newNonce() (string, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// @Summary Verify a vote receipt
+// @Description checks that the ballot cast in a transaction is still recorded and that it matches the receipt commitment. The receipt is found by its nonce, the ledger does not lead from the transaction to the ballot.
+// @Tags Ballot
+// @Accept  json
+// @Produce  json
+// @Param txID path string true "Transaction ID of the vote"
+// @Param nonce query string true "Nonce of the receipt"
+// @Success 200 {object} map "{'txID':'..','electionID':'..','commitment':'..','recorded':true,'verified':true}"
+// @Router /receipt/{txID} [get]
+func verifyReceipt(contract *client.Contract, c *gin.Context) {
+	txID := c.Param("txID")
+
+	nonce := c.Query("nonce")
+	if nonce == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the nonce of the receipt is required"})
+		return
+	}
+	// passed as transient data so the nonce does not end up in peer logs or the proposal arguments
+	transient := map[string][]byte{"nonce": []byte(nonce)}
+
+	result, err := contract.Evaluate("verifyReceipt", client.WithArguments(txID), client.WithTransient(transient))
+	if err != nil {
+		if s, ok := status.FromError(err); ok {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": s.Details(), "message": s.Message()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		panic(fmt.Errorf("failed to evaluate transaction: %w", err))
+	}
+
+	var response receiptVerification
+	err = json.Unmarshal(result, &response)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		panic(fmt.Errorf("failed to unmarshal JSON data: %w", err))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Receipt verified",
+		"data":    response,
+		"status":  http.StatusOK,
+	})
+}
@@ -7,9 +7,10 @@ import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/izqalan/fabric-voting/app/users"
 )
 
-func SetupRouter(contract *client.Contract, credentials AuthCredentials) *gin.Engine {
+func SetupRouter(contracts Contracts, credentials AuthCredentials) *gin.Engine {
 	r := gin.Default()
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
@@ -20,44 +21,61 @@ func SetupRouter(contract *client.Contract, credentials AuthCredentials) *gin.En
 		MaxAge:           12 * time.Hour,
 	}))
 
+	r.GET("/.well-known/jwks.json", getJWKS)
+
 	v1 := r.Group("/api/v1")
 	{
-		v1.POST("/authenticate", GetAuthHandler(credentials.Users, credentials.Admins))
-		v1.GET("/ping", JwtMiddleware("user", "admin"), pong)
-		v1.GET("/hello", JwtMiddleware("user", "admin"), helloWorld)
-		v1.POST("/candidate", JwtMiddleware("admin"), func(c *gin.Context) {
-			createCandidate(contract, c)
-		})
-		v1.GET("/candidate", JwtMiddleware("user", "admin"), func(c *gin.Context) {
-			getAllCandidates(contract, c)
-		})
-		v1.GET("/candidate/:electionID", JwtMiddleware("user", "admin"), func(c *gin.Context) {
-			getCandidatesByElectionId(contract, c)
-		})
-		v1.POST("/election", JwtMiddleware("admin"), func(c *gin.Context) {
-			createElection(contract, c)
-		})
-		v1.GET("/election/:electionID", JwtMiddleware("user", "admin"), func(c *gin.Context) {
-			getElectionById(contract, c)
-		})
-		v1.GET("/election", JwtMiddleware("user", "admin"), func(c *gin.Context) {
-			getAllElections(contract, c)
-		})
-		v1.POST("/voter", JwtMiddleware("admin"), func(c *gin.Context) {
-			createVoter(contract, c)
-		})
-		v1.GET("/voters", JwtMiddleware("user", "admin"), func(c *gin.Context) {
-			getAllVoters(contract, c)
-		})
-		v1.GET("/voter/:voterID", JwtMiddleware("user", "admin"), func(context *gin.Context) {
-			getVoter(contract, context)
-		})
-		v1.POST("/vote", JwtMiddleware("user", "admin"), func(c *gin.Context) {
-			castVote(contract, c)
-		})
-		v1.GET("/getFinalResult/:electionID", JwtMiddleware("admin"), func(context *gin.Context) {
-			getFinalResult(contract, context)
-		})
+		v1.POST("/authenticate", GetAuthHandler(credentials))
+		v1.POST("/auth/refresh", refreshTokens(credentials))
+		v1.POST("/auth/logout", JwtMiddleware(), logout)
+		v1.POST("/auth/totp/enroll", enrollmentMiddleware(), enrollTOTP(credentials))
+		v1.POST("/auth/totp/confirm", enrollmentMiddleware(), confirmTOTP(credentials))
+		v1.POST("/auth/totp/verify", loginStepMiddleware(twoFactorToken), verifyTOTP(credentials))
+		v1.POST("/auth/totp/recoveryCodes", JwtMiddleware(), regenerateRecoveryCodes(credentials))
+		if credentials.OIDC != nil {
+			v1.GET("/auth/oidc/login", oidcLogin(credentials))
+			v1.GET("/auth/oidc/callback", oidcCallback(credentials))
+		}
+		v1.POST("/user", JwtMiddleware(users.ManageUsers), createUser(credentials))
+		v1.GET("/users", JwtMiddleware(users.ManageUsers), getUsers(credentials))
+		v1.POST("/user/:username/disable", JwtMiddleware(users.ManageUsers), setUserDisabled(credentials, true))
+		v1.POST("/user/:username/enable", JwtMiddleware(users.ManageUsers), setUserDisabled(credentials, false))
+		v1.POST("/user/:username/password", JwtMiddleware(users.ManageUsers), resetPassword(credentials))
+		v1.POST("/user/:username/roles", JwtMiddleware(users.ManageUsers), setUserRoles(credentials))
+		v1.POST("/user/:username/elections", JwtMiddleware(users.ManageUsers), setUserElections(credentials))
+		v1.POST("/user/:username/totp/reset", JwtMiddleware(users.ManageUsers), resetTOTP(credentials))
+		v1.GET("/ping", JwtMiddleware(users.ReadElections), pong)
+		v1.GET("/hello", JwtMiddleware(users.ReadElections), helloWorld)
+		v1.POST("/candidate", JwtMiddleware(users.ManageElections), withContract(contracts, createCandidate))
+		v1.GET("/candidate", JwtMiddleware(users.ReadElections), withContract(contracts, getAllCandidates))
+		v1.GET("/candidate/:electionID", JwtMiddleware(users.ReadElections), withContract(contracts, getCandidatesByElectionId))
+		v1.POST("/election", JwtMiddleware(users.CreateElections), withContract(contracts, createElection))
+		v1.GET("/election/:electionID", JwtMiddleware(users.ReadElections), withContract(contracts, getElectionById))
+		v1.GET("/election", JwtMiddleware(users.ReadElections), withContract(contracts, getAllElections))
+		for action, function := range map[string]string{
+			"open":    "openElection",
+			"close":   "closeElection",
+			"tally":   "tallyElection",
+			"archive": "archiveElection",
+		} {
+			function := function
+			v1.POST("/election/:electionID/"+action, JwtMiddleware(users.ManageElections), withContract(contracts, func(contract *client.Contract, c *gin.Context) {
+				transitionElection(contract, c, function)
+			}))
+		}
+		v1.POST("/election/:electionID/compact", JwtMiddleware(users.ManageElections), withContract(contracts, compactVoteCounts))
+		v1.GET("/election/:electionID/ballots", JwtMiddleware(users.AuditBallots), withContract(contracts, getBallotRecords))
+		v1.GET("/election/:electionID/encryption", JwtMiddleware(users.ReadElections), withContract(contracts, getEncryptionInfo))
+		v1.GET("/election/:electionID/encryptedSums", JwtMiddleware(users.ManageElections), withContract(contracts, getEncryptedSums))
+		v1.POST("/election/:electionID/decryptionShare", JwtMiddleware(users.ManageElections), withContract(contracts, submitDecryptionShare))
+		v1.POST("/voter", JwtMiddleware(users.ManageVoters), withContract(contracts, createVoter))
+		v1.GET("/voters", JwtMiddleware(users.ReadElections), withContract(contracts, getAllVoters))
+		v1.GET("/voter/:voterID", JwtMiddleware(users.ReadElections), withContract(contracts, getVoter))
+		v1.POST("/vote", JwtMiddleware(users.CastVotes), withContract(contracts, castVote))
+		v1.GET("/receipt/:txID", JwtMiddleware(users.ReadElections), withContract(contracts, verifyReceipt))
+		v1.GET("/getFinalResult/:electionID", JwtMiddleware(users.ReadResults), withContract(contracts, getFinalResult))
+		v1.GET("/getRankedResult/:electionID", JwtMiddleware(users.ReadResults), withContract(contracts, getRankedResult))
+		v1.GET("/getSeatResult/:electionID", JwtMiddleware(users.ReadResults), withContract(contracts, getSeatResult))
 	}
 	return r
 }
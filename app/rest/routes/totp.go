@@ -0,0 +1,343 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/izqalan/fabric-voting/app/users"
+)
+
+// totpIssuer names the server in authenticator apps when tokens have no issuer
+const totpIssuer = "fabric-voting"
+
+// TOTPEnrollment is the secret to add to an authenticator app
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	// URI is the otpauth URI to show as QR code
+	URI string `json:"uri"`
+}
+
+// TOTPConfirmation is returned once the enrollment is confirmed, the recovery
+// codes are shown this once
+type TOTPConfirmation struct {
+	TokenPair
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type totpCode struct {
+	Code string `json:"code"`
+}
+
+// errors aborting a modification of the account, see users.UserStore.Modify
+var (
+	errInvalidCode = errors.New("invalid two-factor code")
+	errTOTPEnabled = errors.New("two-factor authentication is already enabled")
+	errNotEnrolled = errors.New("two-factor authentication is not enrolled")
+	errTOTPLocked  = errors.New("too many invalid two-factor codes")
+)
+
+// enrollmentMiddleware lets through the enrollment token returned by a login
+// lacking two-factor authentication, as well as access tokens
+func enrollmentMiddleware() gin.HandlerFunc {
+	return loginStepMiddleware(enrollmentToken, accessToken)
+}
+
+// loginStepMiddleware lets through tokens of the types, for the steps of a
+// login after the first factor
+func loginStepMiddleware(tokenTypes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenStr := authorizationToken(c)
+		if tokenStr == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, "Missing token")
+			return
+		}
+		var claims *Claims
+		var err error
+		for _, tokenType := range tokenTypes {
+			if claims, err = parseToken(tokenStr, tokenType); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, "Invalid token")
+			return
+		}
+		c.Set("userID", claims.UserID)
+		c.Set("claims", claims)
+		c.Next()
+	}
+}
+
+// @Summary Enroll in two-factor authentication
+// @Description generates the secret of an authenticator app, enabled once a code of it is confirmed. Accounts beyond voting must enroll, they are given an enrollment token when logging in without.
+// @Tags Auth
+// @Produce  json
+// @Success 200 {object} TOTPEnrollment "Secret to add to the app"
+// @Router /auth/totp/enroll [post]
+func enrollTOTP(credentials AuthCredentials) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := sessionUser(credentials, c)
+		if !ok {
+			return
+		}
+		var secret string
+		user, err := credentials.Store.Modify(user.Username, func(u *users.User) error {
+			if u.TOTPEnabled {
+				return errTOTPEnabled
+			}
+			var err error
+			secret, err = u.EnrollTOTP()
+			u.UpdatedAt = time.Now().UTC()
+			return err
+		})
+		if errors.Is(err, errTOTPEnabled) {
+			c.AbortWithStatusJSON(http.StatusConflict, "Two-factor authentication is already enabled")
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to generate secret")
+			return
+		}
+
+		issuer := signingKeys.Issuer
+		if issuer == "" {
+			issuer = totpIssuer
+		}
+		c.JSON(http.StatusOK, TOTPEnrollment{Secret: secret, URI: users.TOTPURI(issuer, user.Username, secret)})
+	}
+}
+
+// @Summary Confirm two-factor authentication
+// @Description enables two-factor authentication with a code of the enrolled secret, ends the session of the token and logs in again
+// @Tags Auth
+// @Accept  json
+// @Produce  json
+// @Param code body totpCode true "Code of the authenticator app"
+// @Success 200 {object} TOTPConfirmation "Tokens and recovery codes"
+// @Router /auth/totp/confirm [post]
+func confirmTOTP(credentials AuthCredentials) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request totpCode
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+		user, ok := sessionUser(credentials, c)
+		if !ok {
+			return
+		}
+		var codes []string
+		user, err := credentials.Store.Modify(user.Username, func(u *users.User) error {
+			switch {
+			case u.TOTPEnabled:
+				return errTOTPEnabled
+			case u.TOTPSecret == "":
+				return errNotEnrolled
+			}
+			var confirmed bool
+			var err error
+			codes, confirmed, err = u.ConfirmTOTP(request.Code, time.Now(), credentials.PasswordCost)
+			if err == nil && !confirmed {
+				err = errInvalidCode
+			}
+			u.UpdatedAt = time.Now().UTC()
+			return err
+		})
+		switch {
+		case errors.Is(err, errTOTPEnabled):
+			c.AbortWithStatusJSON(http.StatusConflict, "Two-factor authentication is already enabled")
+			return
+		case errors.Is(err, errNotEnrolled):
+			c.AbortWithStatusJSON(http.StatusBadRequest, "Enroll first")
+			return
+		case errors.Is(err, errInvalidCode):
+			c.AbortWithStatusJSON(http.StatusUnauthorized, "Invalid two-factor code")
+			return
+		case err != nil:
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to generate recovery codes")
+			return
+		}
+
+		// the enrollment token is spent, the new tokens carry the account's roles
+		if err := revoke(c.MustGet("claims").(*Claims)); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to revoke token")
+			return
+		}
+		pair, err := generateTokens(user)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to generate token")
+			return
+		}
+		c.JSON(http.StatusOK, TOTPConfirmation{TokenPair: pair, RecoveryCodes: codes})
+	}
+}
+
+// @Summary Verify the second factor
+// @Description completes a login at the identity provider of an account with two-factor authentication, with the token returned by the callback and a code of the authenticator app or a recovery code
+// @Tags Auth
+// @Accept  json
+// @Produce  json
+// @Param code body totpCode true "Code of the authenticator app"
+// @Success 200 {object} TokenPair "Tokens of the account"
+// @Router /auth/totp/verify [post]
+func verifyTOTP(credentials AuthCredentials) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request totpCode
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+		user, ok := sessionUser(credentials, c)
+		if !ok {
+			return
+		}
+		user, ok = spendTwoFactorCode(credentials, c, user.Username, request.Code)
+		if !ok {
+			return
+		}
+
+		// the token of the login is spent with the code
+		if err := revoke(c.MustGet("claims").(*Claims)); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to revoke token")
+			return
+		}
+		pair, err := generateTokens(user)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to generate token")
+			return
+		}
+		c.JSON(http.StatusOK, pair)
+	}
+}
+
+// @Summary Regenerate recovery codes
+// @Description replaces the recovery codes of the account, proven with a code of the authenticator app
+// @Tags Auth
+// @Accept  json
+// @Produce  json
+// @Param code body totpCode true "Code of the authenticator app"
+// @Success 200 {array} string "Recovery codes"
+// @Router /auth/totp/recoveryCodes [post]
+func regenerateRecoveryCodes(credentials AuthCredentials) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request totpCode
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+		user, ok := sessionUser(credentials, c)
+		if !ok {
+			return
+		}
+		// an invalid code leaves fn without error, so that its failure is counted
+		var codes []string
+		var codeErr error
+		_, err := credentials.Store.Modify(user.Username, func(u *users.User) error {
+			if !u.TOTPEnabled {
+				return errNotEnrolled
+			}
+			codeErr = checkTwoFactorCode(u, func(now time.Time) bool { return u.CheckTOTP(request.Code, now) })
+			if codeErr != nil {
+				return nil
+			}
+			var err error
+			codes, err = u.NewRecoveryCodes(credentials.PasswordCost)
+			u.UpdatedAt = time.Now().UTC()
+			return err
+		})
+		if err == nil {
+			err = codeErr
+		}
+		switch {
+		case errors.Is(err, errNotEnrolled):
+			c.AbortWithStatusJSON(http.StatusBadRequest, "Two-factor authentication is not enabled")
+			return
+		case errors.Is(err, errTOTPLocked):
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, "Too many invalid two-factor codes, try again later")
+			return
+		case errors.Is(err, errInvalidCode):
+			c.AbortWithStatusJSON(http.StatusUnauthorized, "Invalid two-factor code")
+			return
+		case err != nil:
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to generate recovery codes")
+			return
+		}
+		c.JSON(http.StatusOK, codes)
+	}
+}
+
+// abortEnrollment refuses the login of an account that must use two-factor
+// authentication but has not enrolled, with a token to enroll with
+func abortEnrollment(c *gin.Context, user users.User) {
+	token, err := signToken(user.Username, users.Scope{}, enrollmentToken, enrollmentLifetime)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+		"error":           "Two-factor enrollment required",
+		"enrollmentToken": token,
+	})
+}
+
+// spendTwoFactorCode checks the authenticator or recovery code against the
+// stored account and spends it in one step, so concurrent logins cannot both
+// use it. It aborts unless the code is valid, and once too many invalid codes
+// locked the second factor.
+func spendTwoFactorCode(credentials AuthCredentials, c *gin.Context, username, code string) (users.User, bool) {
+	var codeErr error
+	user, err := credentials.Store.Modify(username, func(u *users.User) error {
+		codeErr = checkTwoFactorCode(u, func(now time.Time) bool {
+			return u.CheckTOTP(code, now) || u.UseRecoveryCode(code)
+		})
+		return nil
+	})
+	if err == nil {
+		err = codeErr
+	}
+	if errors.Is(err, errTOTPLocked) {
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, "Too many invalid two-factor codes, try again later")
+		return user, false
+	}
+	if errors.Is(err, errInvalidCode) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, "Invalid two-factor code")
+		return user, false
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to update user")
+		return user, false
+	}
+	return user, true
+}
+
+// checkTwoFactorCode checks a code with check unless the second factor is
+// locked, counting invalid codes on the account. The caller stores the user
+// even when it fails, for the count to stick.
+func checkTwoFactorCode(u *users.User, check func(now time.Time) bool) error {
+	now := time.Now()
+	if u.TOTPLocked(now) {
+		return errTOTPLocked
+	}
+	valid := check(now)
+	u.RecordTOTPAttempt(valid, now)
+	if !valid {
+		return errInvalidCode
+	}
+	return nil
+}
+
+// sessionUser returns the account of the token, aborting if it is gone or disabled
+func sessionUser(credentials AuthCredentials, c *gin.Context) (users.User, bool) {
+	user, found, err := credentials.Store.Get(c.GetString("userID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, "Failed to look up user")
+		return user, false
+	}
+	if !found || user.Disabled {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, "Invalid token")
+		return user, false
+	}
+	return user, true
+}
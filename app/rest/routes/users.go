@@ -0,0 +1,295 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/izqalan/fabric-voting/app/users"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Account is a user as shown to admins, without the password hash
+type Account struct {
+	Username  string   `json:"username"`
+	Roles     []string `json:"roles"`
+	Elections []string `json:"elections,omitempty"`
+	// IdentityProvider is set for accounts logging in over OpenID Connect,
+	// DisplayName is the name the provider last claimed for them
+	IdentityProvider string `json:"identityProvider,omitempty"`
+	DisplayName      string `json:"displayName,omitempty"`
+	// TwoFactor tells whether the account logs in with an authenticator code
+	TwoFactor bool      `json:"twoFactor"`
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func newAccount(u users.User) Account {
+	return Account{Username: u.Username, Roles: u.Roles, Elections: u.Elections, IdentityProvider: u.IdentityProvider, DisplayName: u.DisplayName, TwoFactor: u.TOTPEnabled, Disabled: u.Disabled, CreatedAt: u.CreatedAt, UpdatedAt: u.UpdatedAt}
+}
+
+type NewAccount struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+	// Elections an election officer may manage
+	Elections []string `json:"elections"`
+}
+
+// @Summary Create User
+// @Description creates an account holding the roles: voter, election-officer, auditor and/or super-admin
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param user body NewAccount true "Account, roles default to voter"
+// @Success 200 {object} Account "User created"
+// @Router /user [post]
+func createUser(credentials AuthCredentials) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request NewAccount
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(request.Roles) == 0 {
+			request.Roles = []string{users.RoleVoter}
+		}
+		if err := users.ValidatePassword(request.Password); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := users.New(request.Username, request.Password, request.Roles, credentials.PasswordCost)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := validateElections(request.Elections); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		user.Elections = request.Elections
+		err = credentials.Store.Create(user)
+		if errors.Is(err, users.ErrExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "User created successfully.",
+			"data":    newAccount(user),
+			"status":  http.StatusOK,
+		})
+	}
+}
+
+// @Summary Get All Users
+// @Description lists every account ordered by username
+// @Tags User
+// @Produce  json
+// @Success 200 {array} Account "Users fetched"
+// @Router /users [get]
+func getUsers(credentials AuthCredentials) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		list, err := credentials.Store.List()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		accounts := make([]Account, len(list))
+		for i, u := range list {
+			accounts[i] = newAccount(u)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Users fetched successfully.",
+			"data":    accounts,
+			"status":  http.StatusOK,
+		})
+	}
+}
+
+// @Summary Disable or enable a User
+// @Description disabled accounts can no longer log in and their tokens are revoked, admins cannot disable themselves
+// @Tags User
+// @Produce  json
+// @Param username path string true "Username"
+// @Success 200 {object} Account "User updated"
+// @Router /user/{username}/disable [post]
+// @Router /user/{username}/enable [post]
+func setUserDisabled(credentials AuthCredentials, disabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username := c.Param("username")
+		if disabled && c.GetString("userID") == username {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "you cannot disable your own account"})
+			return
+		}
+		updateUser(credentials, c, func(u *users.User) error {
+			u.Disabled = disabled
+			if disabled {
+				return revocations.RevokeUser(u.Username)
+			}
+			return nil
+		})
+	}
+}
+
+// @Summary Set the roles of a User
+// @Description replaces the roles of the account and revokes its tokens, which carry the old roles. Admins cannot take away their own right to manage users.
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param username path string true "Username"
+// @Param roles body object true "{'roles':['voter','auditor']}"
+// @Success 200 {object} Account "User updated"
+// @Router /user/{username}/roles [post]
+func setUserRoles(credentials AuthCredentials) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request struct {
+			Roles []string `json:"roles"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		roles := users.NormalizeRoles(request.Roles)
+		if len(roles) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "at least one role is required"})
+			return
+		}
+		for _, role := range roles {
+			if !users.ValidRole(role) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "unknown role " + role})
+				return
+			}
+		}
+		if c.GetString("userID") == c.Param("username") && !users.Grants(roles, users.ManageUsers) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "you cannot remove your own right to manage users"})
+			return
+		}
+		updateUser(credentials, c, func(u *users.User) error {
+			u.Roles = roles
+			return revocations.RevokeUser(u.Username)
+		})
+	}
+}
+
+// @Summary Set the elections of an election officer
+// @Description replaces the elections the account may manage as election officer and revokes its tokens, which carry the old elections
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param username path string true "Username"
+// @Param elections body object true "{'elections':['election.<txID>']}"
+// @Success 200 {object} Account "User updated"
+// @Router /user/{username}/elections [post]
+func setUserElections(credentials AuthCredentials) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request struct {
+			Elections []string `json:"elections"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := validateElections(request.Elections); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		updateUser(credentials, c, func(u *users.User) error {
+			u.Elections = request.Elections
+			return revocations.RevokeUser(u.Username)
+		})
+	}
+}
+
+// @Summary Reset the password of a User
+// @Description the tokens issued to the user so far are revoked
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param username path string true "Username"
+// @Param password body object true "{'password':'new password'}"
+// @Success 200 {object} Account "User updated"
+// @Router /user/{username}/password [post]
+func resetPassword(credentials AuthCredentials) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request struct {
+			Password string `json:"password"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := users.ValidatePassword(request.Password); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		updateUser(credentials, c, func(u *users.User) error {
+			if err := u.SetPassword(request.Password, credentials.PasswordCost); err != nil {
+				return err
+			}
+			// sessions opened with the old password end
+			return revocations.RevokeUser(u.Username)
+		})
+	}
+}
+
+// @Summary Reset two-factor authentication
+// @Description removes the authenticator secret and recovery codes of an account that lost both and revokes its tokens, it enrolls again on its next login
+// @Tags User
+// @Produce  json
+// @Param username path string true "Username"
+// @Success 200 {object} Account "User updated"
+// @Router /user/{username}/totp/reset [post]
+func resetTOTP(credentials AuthCredentials) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		updateUser(credentials, c, func(u *users.User) error {
+			u.DisableTOTP()
+			return revocations.RevokeUser(u.Username)
+		})
+	}
+}
+
+// validateElections checks the election IDs fit in the elections attribute of
+// an officer identity, which separates them with commas
+func validateElections(elections []string) error {
+	for _, id := range elections {
+		if id == "" || strings.Contains(id, ",") {
+			return fmt.Errorf("invalid election ID %q", id)
+		}
+	}
+	return nil
+}
+
+// updateUser applies change to the user named in the path and stores it, in
+// one step so that concurrent changes of the account are not lost
+func updateUser(credentials AuthCredentials, c *gin.Context, change func(*users.User) error) {
+	user, err := credentials.Store.Modify(c.Param("username"), func(u *users.User) error {
+		if err := change(u); err != nil {
+			return err
+		}
+		u.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+	if errors.Is(err, users.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": users.ErrNotFound.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "User updated successfully.",
+		"data":    newAccount(user),
+		"status":  http.StatusOK,
+	})
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/izqalan/fabric-voting/app/ballot"
+	"github.com/izqalan/fabric-voting/app/users"
 	"google.golang.org/grpc/status"
 	"net/http"
 	"strings"
@@ -14,9 +16,18 @@ type voter struct {
 	UserID string `json:"userID"`
 }
 
+// Vote carries a single CandidateID, the Ranking of candidate IDs with the
+// most preferred first for ranked elections, the approved Choices for
+// approval elections, or one ciphertext per candidate with their proofs, the
+// EncryptedBallot for encrypted elections and the EncryptedChoices for
+// homomorphic elections
 type Vote struct {
-	CandidateID string `json:"candidateID"`
-	ElectionID  string `json:"electionID"`
+	CandidateID      string                  `json:"candidateID"`
+	ElectionID       string                  `json:"electionID"`
+	Ranking          []string                `json:"ranking,omitempty"`
+	Choices          []string                `json:"choices,omitempty"`
+	EncryptedBallot  *ballot.EncryptedBallot `json:"encryptedBallot,omitempty"`
+	EncryptedChoices *ballot.EncryptedBallot `json:"encryptedChoices,omitempty"`
 }
 
 type Response struct {
@@ -30,8 +41,12 @@ type voterHistory struct {
 }
 
 type voterHistoryItem struct {
-	ElectionID string `json:"electionID"`
-	VotedTo    string `json:"votedTo"`
+	ElectionID string   `json:"electionID"`
+	VotedTo    string   `json:"votedTo"`
+	Ranking    []string `json:"ranking,omitempty"`
+	Choices    []string `json:"choices,omitempty"`
+	// Voted is the only thing shown for secret ballot elections
+	Voted bool `json:"voted"`
 }
 
 type votersList struct {
@@ -45,16 +60,34 @@ type votersList struct {
 	} `json:"Record"`
 }
 
+// VoterPage is one page of voter IDs, pass Bookmark to fetch the next one.
+// Bookmark is empty on the last page.
+type VoterPage struct {
+	Voters   []string `json:"voters"`
+	Bookmark string   `json:"bookmark"`
+	Count    int      `json:"count"`
+}
+
 // @Summary Get All Voters
-// @Description Get all voters
+// @Description Get all voters, a page at a time
 // @Tags Election
 // @Accept  json
 // @Produce  json
-// @Success 200 {string} string "Elections fetched"
+// @Param pageSize query int false "Voters per page, 50 by default"
+// @Param bookmark query string false "Bookmark returned with the previous page"
+// @Param electionID query string false "Only voters who voted in this election, see hasVoted"
+// @Param hasVoted query bool false "Only voters who did (true) or did not (false) vote, in electionID if given"
+// @Param prefix query string false "Only voters whose ID starts with this prefix"
+// @Success 200 {object} VoterPage "Voters fetched"
 // @Router /voters [get]
 func getAllVoters(contract *client.Contract, c *gin.Context) {
-	// get all elections using queryByRange function chaincode
-	result, err := contract.EvaluateTransaction("queryByRange", "voter.", "voter.z")
+	pageSize, bookmark, ok := pageQuery(c)
+	if !ok {
+		return
+	}
+
+	result, err := contract.EvaluateTransaction("queryVoters", pageSize, bookmark,
+		c.Query("electionID"), c.Query("hasVoted"), c.Query("prefix"))
 	if err != nil {
 		if s, ok := status.FromError(err); ok {
 			c.JSON(http.StatusBadRequest, gin.H{"detail": s.Details(), "message": s.Message()})
@@ -64,23 +97,21 @@ func getAllVoters(contract *client.Contract, c *gin.Context) {
 		panic(fmt.Errorf("failed to query transaction: %w", err))
 	}
 
-	fmt.Printf("*** Transaction result: %s\n", string(result))
-
 	var response []votersList
-	err = json.Unmarshal(result, &response)
+	page, err := decodePage(result, &response)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		panic(fmt.Errorf("failed to unmarshal JSON data: %w", err))
 	}
 
-	finalResp := make([]string, len(response))
+	finalResp := VoterPage{Voters: make([]string, len(response)), Bookmark: page.Bookmark, Count: page.Count}
 
 	for i, list := range response {
-		finalResp[i] = list.Key
+		finalResp.Voters[i] = list.Key
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Elections fetched successfully.",
+		"message": "Voters fetched successfully.",
 		"data":    finalResp,
 		"status":  http.StatusOK,
 	})
@@ -97,14 +128,14 @@ func getAllVoters(contract *client.Contract, c *gin.Context) {
 func getVoter(contract *client.Contract, c *gin.Context) {
 
 	voterID := c.Param("voterID")
-	if role, _ := c.Get("role"); role.(string) != "admin" {
+	if !users.Grants(c.GetStringSlice("roles"), users.ReadVoters) {
 		if userID, _ := c.Get("userID"); strings.TrimPrefix(userID.(string), "voter.") != strings.TrimPrefix(voterID, "voter.") {
 			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"err": "you cant see history of this voter"})
 			return
 		}
 	}
 
-	// get all elections using queryByRange function chaincode
+	// get the voter with its election history
 	result, err := contract.EvaluateTransaction("getVoter", voterID)
 	if err != nil {
 		if s, ok := status.FromError(err); ok {
@@ -141,6 +172,9 @@ func getVoter(contract *client.Contract, c *gin.Context) {
 		finalRes.History[i] = voterHistoryItem{
 			ElectionID: s.ElectionID,
 			VotedTo:    s.VotedTo,
+			Ranking:    s.Ranking,
+			Choices:    s.Choices,
+			Voted:      s.Voted || s.VotedTo != "",
 		}
 	}
 
@@ -193,8 +227,8 @@ func createVoter(contract *client.Contract, c *gin.Context) {
 // @Tags Ballot
 // @Accept  json
 // @Produce  json
-// @Body  {object} voterID, candidateID
-// @Success 200 {string} string "Vote casted"
+// @Body  {object} candidateID, electionID, ranking, choices, encryptedBallot, encryptedChoices
+// @Success 200 {object} Receipt "Vote casted, data holds the receipt"
 // @Router /ballot/Vote [post]
 func castVote(contract *client.Contract, c *gin.Context) {
 
@@ -211,7 +245,38 @@ func castVote(contract *client.Contract, c *gin.Context) {
 	}
 
 	fmt.Println("vote Info", userID, vote)
-	_, err := contract.SubmitTransaction("vote", userID.(string), vote.CandidateID, vote.ElectionID)
+	function, ballotArg := "vote", vote.CandidateID
+	if len(vote.Ranking) > 0 {
+		ranking, _ := json.Marshal(vote.Ranking)
+		function, ballotArg = "voteRanked", string(ranking)
+	} else if vote.EncryptedBallot != nil {
+		encrypted, _ := json.Marshal(vote.EncryptedBallot)
+		function, ballotArg = "voteEncrypted", string(encrypted)
+	} else if vote.EncryptedChoices != nil {
+		encrypted, _ := json.Marshal(vote.EncryptedChoices)
+		function, ballotArg = "voteHomomorphic", string(encrypted)
+	} else if len(vote.Choices) > 0 {
+		choices, _ := json.Marshal(vote.Choices)
+		function, ballotArg = "voteApproval", string(choices)
+	}
+
+	// the nonce goes in transient data so only the voter learns it, with the
+	// receipt. Secret ballots are stored under the random ballot key, which is
+	// forgotten once the vote is submitted.
+	nonce, err := newNonce()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ballotKey, err := newNonce()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	result, err := contract.Submit(function,
+		client.WithArguments(userID.(string), ballotArg, vote.ElectionID),
+		client.WithTransient(map[string][]byte{"nonce": []byte(nonce), "ballotKey": []byte(ballotKey)}),
+	)
 	if err != nil {
 		if s, ok := status.FromError(err); ok {
 			c.JSON(http.StatusBadRequest, gin.H{"detail": s.Details(), "message": s.Message()})
@@ -223,8 +288,16 @@ func castVote(contract *client.Contract, c *gin.Context) {
 
 	fmt.Printf("*** Transaction committed successfully\n")
 
+	var voteReceipt Receipt
+	if err := json.Unmarshal(result, &voteReceipt); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	voteReceipt.Nonce = nonce
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Vote casted. Txn committed successfully.",
+		"data":    voteReceipt,
 		"status":  http.StatusOK,
 	})
 }
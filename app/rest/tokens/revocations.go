@@ -0,0 +1,197 @@
+package tokens
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	revokedTokensBucket = []byte("tokens")
+	revokedUsersBucket  = []byte("users")
+)
+
+// Revocations lists the tokens revoked before they expire, by their ID, and
+// the token version of every user whose tokens were all revoked. Tokens carry
+// the version of their user when issued and those of an older version are
+// rejected; unlike a cutoff time, which the whole-second issue time of a token
+// cannot be compared to, it tells a token issued right after a revocation from
+// one issued right before. The list is kept in memory, checking it on every
+// request is cheap, and written through to a BoltDB file when opened with
+// OpenRevocations.
+type Revocations struct {
+	mu sync.RWMutex
+	// token ID to expiry, after which the token is rejected anyway
+	tokens map[string]time.Time
+	// username to the version of the tokens issued to them now
+	users map[string]int64
+	db    *bolt.DB
+}
+
+// NewRevocations returns a list kept in memory only
+func NewRevocations() *Revocations {
+	return &Revocations{tokens: map[string]time.Time{}, users: map[string]int64{}}
+}
+
+// OpenRevocations loads the list from path, creating the file if needed
+func OpenRevocations(path string) (*Revocations, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open revocation list %s: %w", path, err)
+	}
+	r := NewRevocations()
+	r.db = db
+	err = db.Update(func(tx *bolt.Tx) error {
+		tokens, err := tx.CreateBucketIfNotExists(revokedTokensBucket)
+		if err != nil {
+			return err
+		}
+		err = tokens.ForEach(func(key, value []byte) error {
+			t, err := time.Parse(time.RFC3339Nano, string(value))
+			if err != nil {
+				return fmt.Errorf("invalid revocation of %s: %w", key, err)
+			}
+			r.tokens[string(key)] = t
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		users, err := tx.CreateBucketIfNotExists(revokedUsersBucket)
+		if err != nil {
+			return err
+		}
+		return users.ForEach(func(key, value []byte) error {
+			version, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid revocation of %s: %w", key, err)
+			}
+			r.users[string(key)] = version
+			return nil
+		})
+	})
+	if err == nil {
+		err = r.Prune(time.Now())
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Revocations) Close() error {
+	if r.db == nil {
+		return nil
+	}
+	return r.db.Close()
+}
+
+// Revoke rejects the token with the ID until it expires
+func (r *Revocations) Revoke(id string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.put(revokedTokensBucket, id, expiresAt.UTC().Format(time.RFC3339Nano)); err != nil {
+		return err
+	}
+	r.tokens[id] = expiresAt
+	return nil
+}
+
+// ErrRevoked is returned by RevokeOnce for a token that was already revoked
+var ErrRevoked = errors.New("token was already revoked")
+
+// RevokeOnce revokes the token with the ID like Revoke, failing with
+// ErrRevoked if it was revoked already. Of concurrent calls for one token only
+// the first succeeds, which makes a token single use.
+func (r *Revocations) RevokeOnce(id string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, found := r.tokens[id]; found {
+		return ErrRevoked
+	}
+	if err := r.put(revokedTokensBucket, id, expiresAt.UTC().Format(time.RFC3339Nano)); err != nil {
+		return err
+	}
+	r.tokens[id] = expiresAt
+	return nil
+}
+
+// RevokeUser rejects every token issued to the user so far by moving them to
+// the next token version
+func (r *Revocations) RevokeUser(username string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	version := r.users[username] + 1
+	if err := r.put(revokedUsersBucket, username, strconv.FormatInt(version, 10)); err != nil {
+		return err
+	}
+	r.users[username] = version
+	return nil
+}
+
+// put writes through to the file, if any, the caller holds the lock
+func (r *Revocations) put(bucket []byte, key, value string) error {
+	if r.db == nil {
+		return nil
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), []byte(value))
+	})
+}
+
+// UserVersion returns the version the tokens issued to the user now carry
+func (r *Revocations) UserVersion(username string) int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.users[username]
+}
+
+// Revoked tells whether the token with the ID, issued to the user with the
+// token version, was revoked
+func (r *Revocations) Revoked(id, username string, version int64) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if _, found := r.tokens[id]; found {
+		return true
+	}
+	return version < r.users[username]
+}
+
+// Prune forgets the tokens expired by now, their signature check rejects them
+func (r *Revocations) Prune(now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var expired []string
+	for id, expiresAt := range r.tokens {
+		if expiresAt.Before(now) {
+			expired = append(expired, id)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	if r.db != nil {
+		err := r.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(revokedTokensBucket)
+			for _, id := range expired {
+				if err := bucket.Delete([]byte(id)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, id := range expired {
+		delete(r.tokens, id)
+	}
+	return nil
+}
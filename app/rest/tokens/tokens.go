@@ -0,0 +1,232 @@
+// Package tokens signs and verifies the access tokens of the REST server.
+//
+// Tokens are JWTs whose kid header names the key that signed them. A KeySet
+// holds the active key, signing new tokens, and the keys it replaced, which
+// keep verifying tokens issued before a rotation until they expire. The public
+// halves of RS256 and EdDSA keys are published as a JWKS so other services can
+// verify the tokens without sharing a secret, HS256 keys stay private.
+package tokens
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// MinSecretLength is the shortest HS256 secret NewHMACKey accepts
+const MinSecretLength = 32
+
+// Key is a signing key and the algorithm it signs with
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+	// private signs, public verifies, both are the secret for HS256
+	private interface{}
+	public  interface{}
+}
+
+// NewHMACKey returns an HS256 key
+func NewHMACKey(id string, secret []byte) (*Key, error) {
+	if len(secret) < MinSecretLength {
+		return nil, fmt.Errorf("secret of key %s must be at least %d bytes", id, MinSecretLength)
+	}
+	return &Key{ID: id, Method: jwt.SigningMethodHS256, private: secret, public: secret}, nil
+}
+
+// ParsePrivateKey reads a PEM encoded RSA key, signing with RS256, or Ed25519
+// key, signing with EdDSA
+func ParsePrivateKey(id string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("key %s is not PEM encoded", id)
+	}
+	var private interface{}
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key %s: %w", id, err)
+	}
+
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key %s must be at least 2048 bits", id)
+		}
+		return &Key{ID: id, Method: jwt.SigningMethodRS256, private: k, public: &k.PublicKey}, nil
+	case ed25519.PrivateKey:
+		return &Key{ID: id, Method: jwt.SigningMethodEdDSA, private: k, public: k.Public()}, nil
+	default:
+		return nil, fmt.Errorf("key %s must be an RSA or Ed25519 key, got %T", id, private)
+	}
+}
+
+// GenerateKey returns a new EdDSA key
+func GenerateKey(id string) (*Key, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{ID: id, Method: jwt.SigningMethodEdDSA, private: private, public: public}, nil
+}
+
+// KeySet signs tokens with the active key and verifies them with any key
+type KeySet struct {
+	active *Key
+	keys   map[string]*Key
+	// order of the keys in the JWKS
+	ids []string
+	// Issuer is written to and required in every token, unless empty
+	Issuer string
+}
+
+// NewKeySet returns the keys, the one named active signing new tokens
+func NewKeySet(keys []*Key, active, issuer string) (*KeySet, error) {
+	s := &KeySet{keys: map[string]*Key{}, Issuer: issuer}
+	for _, key := range keys {
+		if _, found := s.keys[key.ID]; found {
+			return nil, fmt.Errorf("duplicate key %s", key.ID)
+		}
+		s.keys[key.ID] = key
+		s.ids = append(s.ids, key.ID)
+		if key.ID == active {
+			s.active = key
+		}
+	}
+	if s.active == nil {
+		return nil, fmt.Errorf("active key %s not found", active)
+	}
+	return s, nil
+}
+
+// RegisteredClaims returns the issuer, validity and a new ID of a token issued now
+func (s *KeySet) RegisteredClaims(lifetime time.Duration) jwt.RegisteredClaims {
+	now := time.Now()
+	return jwt.RegisteredClaims{
+		ID:        NewID(),
+		Issuer:    s.Issuer,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(lifetime)),
+	}
+}
+
+// NewID returns a random token ID
+func NewID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+// Sign returns the token of the claims signed with the active key
+func (s *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(s.active.Method, claims)
+	token.Header["kid"] = s.active.ID
+	return token.SignedString(s.active.private)
+}
+
+// Parse verifies the token with the key its kid header names and fills claims
+func (s *KeySet) Parse(tokenStr string, claims jwt.Claims) error {
+	options := []jwt.ParserOption{}
+	if s.Issuer != "" {
+		options = append(options, jwt.WithIssuer(s.Issuer))
+	}
+	_, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		id, _ := token.Header["kid"].(string)
+		key, found := s.keys[id]
+		if !found {
+			return nil, fmt.Errorf("unknown key %q", id)
+		}
+		// the key decides the algorithm, never the token
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, errors.New("invalid signing method")
+		}
+		return key.public, nil
+	}, options...)
+	return err
+}
+
+// JWK is the public half of a key, as defined by RFC 7517
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA modulus and exponent
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 curve and public key
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys verifying tokens, HS256 keys left out
+func (s *KeySet) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	encode := base64.RawURLEncoding.EncodeToString
+	for _, id := range s.ids {
+		key := s.keys[id]
+		jwk := JWK{KeyID: id, Use: "sig", Algorithm: key.Method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = encode(public.N.Bytes())
+			jwk.E = encode(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = encode(public)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// PublicKey returns the public key of a JWK, to verify tokens with elsewhere
+func (j JWK) PublicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch j.KeyType {
+	case "RSA":
+		n, err := decode(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "OKP":
+		x, err := decode(j.X)
+		if err != nil {
+			return nil, err
+		}
+		if j.Curve != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported curve %s", j.Curve)
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", j.KeyType)
+	}
+}
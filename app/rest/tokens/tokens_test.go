@@ -0,0 +1,239 @@
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func rsaKey(t *testing.T, id string) *Key {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)})
+	key, err := ParsePrivateKey(id, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func sign(t *testing.T, keys *KeySet, subject string) string {
+	claims := keys.RegisteredClaims(time.Hour)
+	claims.Subject = subject
+	token, err := keys.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestRotation(t *testing.T) {
+	old := rsaKey(t, "old")
+	current, err := GenerateKey("current")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := NewKeySet([]*Key{old}, "old", "fabric-voting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := NewKeySet([]*Key{current, old}, "current", "fabric-voting")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tokens issued before the rotation stay valid
+	claims := &jwt.RegisteredClaims{}
+	if err := after.Parse(sign(t, before, "alice"), claims); err != nil || claims.Subject != "alice" {
+		t.Errorf("expected the old token to verify, got %v", err)
+	}
+
+	token := sign(t, after, "bob")
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &jwt.RegisteredClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header["kid"] != "current" || parsed.Method.Alg() != "EdDSA" {
+		t.Errorf("expected an EdDSA token signed by current, got %v", parsed.Header)
+	}
+	if err := before.Parse(token, &jwt.RegisteredClaims{}); err == nil {
+		t.Error("expected a token of an unknown key to be rejected")
+	}
+
+	// the JWKS verifies tokens without the private keys
+	jwks := after.JWKS()
+	if len(jwks.Keys) != 2 || jwks.Keys[0].KeyType != "OKP" || jwks.Keys[1].KeyType != "RSA" {
+		t.Fatalf("unexpected key set %+v", jwks)
+	}
+	for _, jwk := range jwks.Keys {
+		public, err := jwk.PublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		subject := "signed by " + jwk.KeyID
+		keys := map[string]*KeySet{"current": after, "old": before}
+		_, err = jwt.Parse(sign(t, keys[jwk.KeyID], subject), func(*jwt.Token) (interface{}, error) { return public, nil })
+		if err != nil {
+			t.Errorf("failed to verify with the JWK of %s: %v", jwk.KeyID, err)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	secret := []byte(strings.Repeat("s", MinSecretLength))
+	hmacKey, err := NewHMACKey("hmac", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSigner := rsaKey(t, "rsa")
+	keys, err := NewKeySet([]*Key{rsaSigner, hmacKey}, "rsa", "fabric-voting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jwks := keys.JWKS(); len(jwks.Keys) != 1 {
+		t.Errorf("expected the HS256 key to stay private, got %+v", jwks)
+	}
+
+	// a token naming the RSA key but signed with HS256 must not verify
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, keys.RegisteredClaims(time.Hour))
+	forged.Header["kid"] = "rsa"
+	forgedStr, err := forged.SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Parse(forgedStr, &jwt.RegisteredClaims{}); err == nil {
+		t.Error("expected an algorithm mismatch to be rejected")
+	}
+
+	other, err := NewKeySet([]*Key{rsaSigner}, "rsa", "someone-else")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Parse(sign(t, other, "alice"), &jwt.RegisteredClaims{}); err == nil {
+		t.Error("expected a token of another issuer to be rejected")
+	}
+
+	expired := keys.RegisteredClaims(-time.Minute)
+	expiredStr, err := keys.Sign(expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Parse(expiredStr, &jwt.RegisteredClaims{}); err == nil {
+		t.Error("expected an expired token to be rejected")
+	}
+
+	if _, err := NewHMACKey("short", []byte("short")); err == nil {
+		t.Error("expected a short secret to be rejected")
+	}
+	if _, err := NewKeySet([]*Key{rsaSigner, rsaSigner}, "rsa", ""); err == nil {
+		t.Error("expected duplicate keys to be rejected")
+	}
+	if _, err := NewKeySet([]*Key{rsaSigner}, "missing", ""); err == nil {
+		t.Error("expected a missing active key to be rejected")
+	}
+}
+
+func TestRevocations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocations.db")
+	r, err := OpenRevocations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := r.Revoke("expired", now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Revoke("lost-device", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RevokeUser("mallory"); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	// the list survives a restart, without the tokens that expired meanwhile
+	r, err = OpenRevocations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, found := r.tokens["expired"]; found {
+		t.Error("expected the expired token to be pruned")
+	}
+	if got := r.UserVersion("mallory"); got != 1 {
+		t.Errorf("expected mallory's tokens to be at version 1, got %d", got)
+	}
+	for _, c := range []struct {
+		id, username string
+		version      int64
+		revoked      bool
+	}{
+		{"lost-device", "alice", 0, true},
+		{"other", "alice", 0, false},
+		{"other", "mallory", 0, true},
+		// issued right after the revocation, within the same second
+		{"other", "mallory", 1, false},
+	} {
+		if got := r.Revoked(c.id, c.username, c.version); got != c.revoked {
+			t.Errorf("Revoked(%s, %s, %d) = %v", c.id, c.username, c.version, got)
+		}
+	}
+
+	// revoking again moves on to the next version
+	if err := r.RevokeUser("mallory"); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Revoked("other", "mallory", 1) {
+		t.Error("expected the tokens of version 1 to be revoked")
+	}
+}
+
+func TestRevokeOnce(t *testing.T) {
+	r := NewRevocations()
+	expiresAt := time.Now().Add(time.Hour)
+
+	// of concurrent uses of one token only the first gets through
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := r.RevokeOnce("refresh", expiresAt)
+			if err != nil && !errors.Is(err, ErrRevoked) {
+				t.Error(err)
+				return
+			}
+			if err == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if succeeded != 1 {
+		t.Errorf("expected one use of the token to succeed, got %d", succeeded)
+	}
+	if !r.Revoked("refresh", "alice", 0) {
+		t.Error("expected the token to be revoked")
+	}
+	if err := r.Revoke("other", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RevokeOnce("other", expiresAt); !errors.Is(err, ErrRevoked) {
+		t.Errorf("expected a revoked token to be refused, got %v", err)
+	}
+}
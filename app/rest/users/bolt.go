@@ -0,0 +1,161 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	usersBucket = []byte("users")
+	// externalBucket maps the identity provider and subject of external
+	// accounts to their username
+	externalBucket = []byte("external")
+)
+
+// BoltStore keeps the users in a BoltDB file, as JSON under their username
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens the store in path, creating the file if needed. Only one
+// process can have it open at a time.
+func OpenBolt(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open user store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{usersBucket, externalBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) Get(username string) (user User, found bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(usersBucket).Get([]byte(username))
+		if data == nil {
+			return nil
+		}
+		found = true
+		user, err = decodeUser(data)
+		return err
+	})
+	return user, found, err
+}
+
+func (s *BoltStore) GetExternal(identityProvider, subject string) (user User, found bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		username := tx.Bucket(externalBucket).Get(externalKey(identityProvider, subject))
+		if username == nil {
+			return nil
+		}
+		data := tx.Bucket(usersBucket).Get(username)
+		if data == nil {
+			return nil
+		}
+		found = true
+		user, err = decodeUser(data)
+		return err
+	})
+	return user, found, err
+}
+
+func (s *BoltStore) Create(user User) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(usersBucket).Get([]byte(user.Username)) != nil {
+			return ErrExists
+		}
+		return putUser(tx, user)
+	})
+}
+
+func (s *BoltStore) Update(user User) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(usersBucket).Get([]byte(user.Username)) == nil {
+			return ErrNotFound
+		}
+		return putUser(tx, user)
+	})
+}
+
+// Modify runs fn within the write transaction, which BoltDB runs one at a time
+func (s *BoltStore) Modify(username string, fn func(*User) error) (user User, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(usersBucket).Get([]byte(username))
+		if data == nil {
+			return ErrNotFound
+		}
+		if user, err = decodeUser(data); err != nil {
+			return err
+		}
+		if err := fn(&user); err != nil {
+			return err
+		}
+		return putUser(tx, user)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s *BoltStore) List() ([]User, error) {
+	list := []User{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// keys are iterated in byte order
+		return tx.Bucket(usersBucket).ForEach(func(_, data []byte) error {
+			user, err := decodeUser(data)
+			if err != nil {
+				return err
+			}
+			list = append(list, user)
+			return nil
+		})
+	})
+	return list, err
+}
+
+// decodeUser reads a stored user, accounts stored before roles were split up
+// get the current ones
+func decodeUser(data []byte) (User, error) {
+	var user User
+	err := json.Unmarshal(data, &user)
+	user.Roles = NormalizeRoles(user.Roles)
+	return user, err
+}
+
+// putUser stores the user and indexes the subject of external accounts
+func putUser(tx *bolt.Tx, user User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	if user.IdentityProvider != "" && user.Subject != "" {
+		err := tx.Bucket(externalBucket).Put(externalKey(user.IdentityProvider, user.Subject), []byte(user.Username))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(usersBucket).Put([]byte(user.Username), data)
+}
+
+// externalKey joins the issuer and subject with a byte neither contains
+func externalKey(identityProvider, subject string) []byte {
+	return []byte(identityProvider + "\x00" + subject)
+}
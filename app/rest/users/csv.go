@@ -0,0 +1,90 @@
+package users
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ImportResult counts the accounts an import created and the ones it left
+// alone because the username was taken
+type ImportResult struct {
+	Created int `json:"created"`
+	Skipped int `json:"skipped"`
+}
+
+// ImportCSV creates the accounts listed in a CSV file with the header
+//
+//	username,password,roles
+//
+// roles being separated by semicolons, voter when empty, the legacy roles user
+// and admin standing for voter and super-admin. A password that is
+// already a bcrypt hash is stored as is, others are hashed with the cost, and
+// a row without password fails the import. Existing users are kept unchanged.
+func ImportCSV(store UserStore, r io.Reader, cost int) (ImportResult, error) {
+	var result ImportResult
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return result, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	if strings.Join(header, ",") != "username,password,roles" {
+		return result, fmt.Errorf("unexpected CSV header %q, expected username,password,roles", strings.Join(header, ","))
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		roles := []string{RoleVoter}
+		if record[2] != "" {
+			roles = strings.Split(record[2], ";")
+		}
+		user, err := newImported(record[0], record[1], roles, cost)
+		if err != nil {
+			return result, fmt.Errorf("line %d: %w", line, err)
+		}
+		err = store.Create(user)
+		if errors.Is(err, ErrExists) {
+			result.Skipped++
+			continue
+		}
+		if err != nil {
+			return result, fmt.Errorf("line %d: %w", line, err)
+		}
+		result.Created++
+	}
+}
+
+func newImported(username, password string, roles []string, cost int) (User, error) {
+	// bcrypt accepts an empty password, which anybody knowing the username could log in with
+	if password == "" {
+		return User{}, errors.New("password is required")
+	}
+	if !isBcryptHash(password) {
+		return New(username, password, roles, cost)
+	}
+	user, err := newUser(username, roles)
+	user.PasswordHash = password
+	return user, err
+}
+
+func isBcryptHash(password string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(password, prefix) {
+			return true
+		}
+	}
+	return false
+}
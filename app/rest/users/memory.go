@@ -0,0 +1,80 @@
+package users
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps the users in memory, for tests and throwaway servers
+type MemoryStore struct {
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{users: map[string]User{}}
+}
+
+func (s *MemoryStore) Get(username string) (User, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, found := s.users[username]
+	return user, found, nil
+}
+
+func (s *MemoryStore) GetExternal(identityProvider, subject string) (User, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, user := range s.users {
+		if user.Subject != "" && user.IdentityProvider == identityProvider && user.Subject == subject {
+			return user, true, nil
+		}
+	}
+	return User{}, false, nil
+}
+
+func (s *MemoryStore) Create(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.users[user.Username]; found {
+		return ErrExists
+	}
+	s.users[user.Username] = user
+	return nil
+}
+
+func (s *MemoryStore) Update(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.users[user.Username]; !found {
+		return ErrNotFound
+	}
+	s.users[user.Username] = user
+	return nil
+}
+
+func (s *MemoryStore) Modify(username string, fn func(*User) error) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, found := s.users[username]
+	if !found {
+		return User{}, ErrNotFound
+	}
+	// fn changes a copy, its slices are replaced rather than written to
+	if err := fn(&user); err != nil {
+		return User{}, err
+	}
+	s.users[username] = user
+	return user, nil
+}
+
+func (s *MemoryStore) List() ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		list = append(list, user)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list, nil
+}
@@ -0,0 +1,161 @@
+package users
+
+import "strings"
+
+// roles an account can hold, an account can hold several
+const (
+	RoleVoter           = "voter"
+	RoleElectionOfficer = "election-officer"
+	RoleAuditor         = "auditor"
+	RoleSuperAdmin      = "super-admin"
+)
+
+// legacyRoles are the roles accounts held before roles were split up
+var legacyRoles = map[string]string{
+	"user":  RoleVoter,
+	"admin": RoleSuperAdmin,
+}
+
+// Permission is an action a route requires, granted by roles
+type Permission string
+
+const (
+	// ReadElections covers elections, candidates, receipts and one's own voter record
+	ReadElections   Permission = "elections:read"
+	CreateElections Permission = "elections:create"
+	// ManageElections covers the candidates, lifecycle and tally of an election
+	ManageElections Permission = "elections:manage"
+	// ReadVoters covers the voter records and histories of everyone
+	ReadVoters   Permission = "voters:read"
+	ManageVoters Permission = "voters:manage"
+	CastVotes    Permission = "votes:cast"
+	ReadResults  Permission = "results:read"
+	AuditBallots Permission = "ballots:audit"
+	ManageUsers  Permission = "users:manage"
+)
+
+// rolePermissions is the permission model. Super admins may do anything but
+// vote, votes are bound to the voter identity of the account.
+var rolePermissions = map[string][]Permission{
+	RoleVoter:           {ReadElections, CastVotes},
+	RoleElectionOfficer: {ReadElections, ManageElections, ReadVoters, ManageVoters, ReadResults},
+	RoleAuditor:         {ReadElections, ReadVoters, ReadResults, AuditBallots},
+	RoleSuperAdmin:      {ReadElections, CreateElections, ManageElections, ReadVoters, ManageVoters, ReadResults, AuditBallots, ManageUsers},
+}
+
+// scopedPermissions are granted to election officers for the elections in the
+// scope of their account only. Voters are not bound to an election, officers
+// register them regardless of their scope.
+var scopedPermissions = map[Permission]bool{
+	ManageElections: true,
+	ReadResults:     true,
+}
+
+// twoFactorPermissions are the permissions requiring accounts to log in with
+// a second factor, everything beyond voting and reading elections
+var twoFactorPermissions = []Permission{CreateElections, ManageElections, ReadVoters, ManageVoters, ReadResults, AuditBallots, ManageUsers}
+
+// TwoFactorRequired tells whether the roles require logging in with a second factor
+func TwoFactorRequired(roles []string) bool {
+	for _, permission := range twoFactorPermissions {
+		if len(RolesGranting(roles, permission)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidRole tells whether accounts can be given the role
+func ValidRole(role string) bool {
+	_, found := rolePermissions[role]
+	return found
+}
+
+// NormalizeRoles replaces legacy roles and drops duplicates
+func NormalizeRoles(roles []string) []string {
+	normalized := make([]string, 0, len(roles))
+	seen := map[string]bool{}
+	for _, role := range roles {
+		if current, found := legacyRoles[role]; found {
+			role = current
+		}
+		if !seen[role] {
+			seen[role] = true
+			normalized = append(normalized, role)
+		}
+	}
+	return normalized
+}
+
+// RoleGrants tells whether the role grants every permission
+func RoleGrants(role string, permissions ...Permission) bool {
+	for _, permission := range permissions {
+		granted := false
+		for _, p := range rolePermissions[role] {
+			if p == permission {
+				granted = true
+				break
+			}
+		}
+		if !granted {
+			return false
+		}
+	}
+	return true
+}
+
+// Grants tells whether one of the roles grants every permission
+func Grants(roles []string, permissions ...Permission) bool {
+	return len(RolesGranting(roles, permissions...)) > 0
+}
+
+// RolesGranting returns the roles granting every permission
+func RolesGranting(roles []string, permissions ...Permission) []string {
+	var granting []string
+	for _, role := range roles {
+		if RoleGrants(role, permissions...) {
+			granting = append(granting, role)
+		}
+	}
+	return granting
+}
+
+// Scope is what a request acts with, the roles of the account and the
+// elections its election-officer role is limited to
+type Scope struct {
+	Roles     []string
+	Elections []string
+}
+
+// GrantsIn tells whether one of the roles grants every permission on the election
+func (s Scope) GrantsIn(electionID string, permissions ...Permission) bool {
+	return len(s.RolesGrantingIn(electionID, permissions...)) > 0
+}
+
+// RolesGrantingIn returns the roles granting every permission on the election.
+// Officers only get the scoped permissions on the elections in their scope.
+func (s Scope) RolesGrantingIn(electionID string, permissions ...Permission) []string {
+	scoped := false
+	for _, permission := range permissions {
+		scoped = scoped || scopedPermissions[permission]
+	}
+	var granting []string
+	for _, role := range RolesGranting(s.Roles, permissions...) {
+		if role != RoleElectionOfficer || !scoped || InScope(s.Elections, electionID) {
+			granting = append(granting, role)
+		}
+	}
+	return granting
+}
+
+// InScope tells whether the election is one of the elections, with or without
+// the election. prefix of the ledger keys
+func InScope(elections []string, electionID string) bool {
+	electionID = strings.TrimPrefix(electionID, "election.")
+	for _, id := range elections {
+		if electionID != "" && strings.TrimPrefix(id, "election.") == electionID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// time-based one-time passwords as defined by RFC 6238, with the settings every
+// authenticator app supports
+const (
+	TOTPPeriod  = 30 * time.Second
+	TOTPDigits  = 6
+	totpModulus = 1000000
+	// TOTPSkew is how many periods a code may be early or late, for clock drift
+	TOTPSkew = 1
+	// RecoveryCodeCount is how many recovery codes an enrollment gets
+	RecoveryCodeCount = 10
+	// MaxTOTPFailures is how many invalid codes in a row lock the second
+	// factor for TOTPLockout, against guessing the six digits
+	MaxTOTPFailures = 5
+	TOTPLockout     = 15 * time.Minute
+)
+
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random base32 secret to add to an authenticator app
+func NewTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return secretEncoding.EncodeToString(secret), nil
+}
+
+// TOTPCode returns the code of the secret at the time
+func TOTPCode(secret string, t time.Time) (string, error) {
+	return totpCode(secret, t.Unix()/int64(TOTPPeriod/time.Second))
+}
+
+func totpCode(secret string, step int64) (string, error) {
+	key, err := secretEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", fmt.Errorf("invalid TOTP secret: %w", err)
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TOTPDigits, value%totpModulus), nil
+}
+
+// TOTPURI returns the otpauth URI authenticator apps read from a QR code
+func TOTPURI(issuer, username, secret string) string {
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(TOTPDigits)},
+		"period":    {fmt.Sprint(int(TOTPPeriod / time.Second))},
+	}
+	label := url.PathEscape(issuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// EnrollTOTP gives the user a new secret, enabled once ConfirmTOTP accepts a
+// code of it
+func (u *User) EnrollTOTP() (string, error) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	u.TOTPSecret = secret
+	u.TOTPEnabled = false
+	u.TOTPLastStep = 0
+	u.RecoveryCodes = nil
+	return secret, nil
+}
+
+// ConfirmTOTP enables the enrolled secret if the code is valid and returns new
+// recovery codes, hashed with the bcrypt cost
+func (u *User) ConfirmTOTP(code string, now time.Time, cost int) ([]string, bool, error) {
+	if u.TOTPEnabled || !u.CheckTOTP(code, now) {
+		return nil, false, nil
+	}
+	codes, err := u.NewRecoveryCodes(cost)
+	if err != nil {
+		return nil, false, err
+	}
+	u.TOTPEnabled = true
+	return codes, true, nil
+}
+
+// CheckTOTP tells whether the code is valid at the time. Every code is
+// accepted once, the caller stores the user to remember it was used.
+func (u *User) CheckTOTP(code string, now time.Time) bool {
+	if u.TOTPSecret == "" || len(code) != TOTPDigits {
+		return false
+	}
+	current := now.Unix() / int64(TOTPPeriod/time.Second)
+	for step := current - TOTPSkew; step <= current+TOTPSkew; step++ {
+		if step <= u.TOTPLastStep {
+			continue
+		}
+		expected, err := totpCode(u.TOTPSecret, step)
+		if err != nil {
+			return false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			u.TOTPLastStep = step
+			return true
+		}
+	}
+	return false
+}
+
+// TOTPLocked tells whether too many invalid codes locked the second factor
+func (u *User) TOTPLocked(now time.Time) bool {
+	return now.Before(u.TOTPLockedUntil)
+}
+
+// RecordTOTPAttempt counts an invalid code and locks the second factor after
+// MaxTOTPFailures of them, a valid code resets the count. The caller stores
+// the user.
+func (u *User) RecordTOTPAttempt(valid bool, now time.Time) {
+	if valid {
+		u.TOTPFailures = 0
+		return
+	}
+	u.TOTPFailures++
+	if u.TOTPFailures >= MaxTOTPFailures {
+		u.TOTPFailures = 0
+		u.TOTPLockedUntil = now.Add(TOTPLockout)
+	}
+}
+
+// NewRecoveryCodes replaces the recovery codes of the user, returning the codes
+// to show once, only their hashes are kept
+func (u *User) NewRecoveryCodes(cost int) ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		random := make([]byte, 5)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(secretEncoding.EncodeToString(random))
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), cost)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = string(hash)
+	}
+	u.RecoveryCodes = hashes
+	return codes, nil
+}
+
+// UseRecoveryCode tells whether the code is an unused recovery code and
+// removes it, the caller stores the user
+func (u *User) UseRecoveryCode(code string) bool {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	for i, hash := range u.RecoveryCodes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// DisableTOTP removes the secret and recovery codes, for users who lost both
+func (u *User) DisableTOTP() {
+	u.TOTPSecret = ""
+	u.TOTPEnabled = false
+	u.TOTPLastStep = 0
+	u.TOTPFailures = 0
+	u.TOTPLockedUntil = time.Time{}
+	u.RecoveryCodes = nil
+}
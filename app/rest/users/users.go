@@ -0,0 +1,146 @@
+// Package users keeps the accounts people log in to the REST server with.
+//
+// Passwords are stored as bcrypt hashes. Accounts live in a UserStore, a
+// BoltDB file in production, and can be bulk loaded with ImportCSV.
+package users
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrNotFound = errors.New("user not found")
+	ErrExists   = errors.New("user already exists")
+)
+
+// MinPasswordLength is the shortest password ValidatePassword accepts
+const MinPasswordLength = 8
+
+type User struct {
+	Username     string   `json:"username"`
+	PasswordHash string   `json:"passwordHash"`
+	Roles        []string `json:"roles"`
+	// Elections limit the election-officer role to these election IDs
+	Elections []string `json:"elections,omitempty"`
+	// IdentityProvider is the issuer logging the user in over OpenID Connect,
+	// empty for accounts logging in with a password
+	IdentityProvider string `json:"identityProvider,omitempty"`
+	// Subject is the user's ID at the identity provider, which finds the
+	// account on login. The username is picked on the first login and kept,
+	// DisplayName follows the name the provider claims.
+	Subject     string `json:"subject,omitempty"`
+	DisplayName string `json:"displayName,omitempty"`
+	// TOTPSecret is the base32 secret of the user's authenticator app, it is
+	// checked on login once a code confirmed the enrollment
+	TOTPSecret  string `json:"totpSecret,omitempty"`
+	TOTPEnabled bool   `json:"totpEnabled,omitempty"`
+	// TOTPLastStep is the time step of the last accepted code, codes are used once
+	TOTPLastStep int64 `json:"totpLastStep,omitempty"`
+	// TOTPFailures counts the invalid codes since the last valid one, reaching
+	// MaxTOTPFailures locks the second factor until TOTPLockedUntil
+	TOTPFailures    int       `json:"totpFailures,omitempty"`
+	TOTPLockedUntil time.Time `json:"totpLockedUntil,omitempty"`
+	// RecoveryCodes are bcrypt hashes of the unused recovery codes
+	RecoveryCodes []string  `json:"recoveryCodes,omitempty"`
+	Disabled      bool      `json:"disabled"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// UserStore stores accounts by username
+type UserStore interface {
+	// Get returns the user, found being false if there is none
+	Get(username string) (user User, found bool, err error)
+	// Create adds a user, failing with ErrExists if the username is taken
+	Create(user User) error
+	// Update replaces a user, failing with ErrNotFound if there is none
+	Update(user User) error
+	// Modify applies fn to the stored user and stores the result, with no
+	// other change to the user in between, and returns the stored user. An
+	// error of fn is returned as is and leaves the stored user unchanged. It
+	// fails with ErrNotFound if there is no user.
+	Modify(username string, fn func(*User) error) (User, error)
+	// GetExternal returns the user with the subject at the identity provider,
+	// found being false if there is none
+	GetExternal(identityProvider, subject string) (user User, found bool, err error)
+	// List returns every user ordered by username
+	List() ([]User, error)
+}
+
+// HasRole tells whether the user holds the role
+func (u User) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidatePassword checks a password chosen through the API against the
+// password policy. Imported accounts keep the passwords they had.
+func ValidatePassword(password string) error {
+	if len(password) < MinPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	}
+	return nil
+}
+
+// SetPassword hashes the password with the bcrypt cost
+func (u *User) SetPassword(password string, cost int) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = string(hash)
+	return nil
+}
+
+// CheckPassword tells whether the password matches the stored hash
+func (u User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// New returns an enabled user with the roles and password
+func New(username, password string, roles []string, cost int) (User, error) {
+	u, err := newUser(username, roles)
+	if err != nil {
+		return u, err
+	}
+	return u, u.SetPassword(password, cost)
+}
+
+// NewExternal returns an enabled user without password who logs in at the
+// identity provider as subject
+func NewExternal(username, identityProvider, subject string, roles []string) (User, error) {
+	if subject == "" {
+		return User{}, errors.New("subject is required")
+	}
+	u, err := newUser(username, roles)
+	u.IdentityProvider = identityProvider
+	u.Subject = subject
+	u.DisplayName = username
+	return u, err
+}
+
+// newUser returns an enabled user with the roles and no password
+func newUser(username string, roles []string) (User, error) {
+	if username == "" {
+		return User{}, errors.New("username is required")
+	}
+	roles = NormalizeRoles(roles)
+	if len(roles) == 0 {
+		return User{}, errors.New("at least one role is required")
+	}
+	for _, role := range roles {
+		if !ValidRole(role) {
+			return User{}, fmt.Errorf("unknown role %s", role)
+		}
+	}
+	now := time.Now().UTC()
+	return User{Username: username, Roles: roles, CreatedAt: now, UpdatedAt: now}, nil
+}
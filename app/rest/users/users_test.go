@@ -0,0 +1,343 @@
+package users
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testStore runs the behaviour every UserStore shares
+func testStore(t *testing.T, store UserStore) {
+	alice, err := New("alice", "alice-password", []string{RoleVoter, RoleSuperAdmin}, bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(alice); !errors.Is(err, ErrExists) {
+		t.Errorf("expected ErrExists, got %v", err)
+	}
+
+	got, found, err := store.Get("alice")
+	if err != nil || !found {
+		t.Fatalf("expected alice, got found=%v err=%v", found, err)
+	}
+	if !got.CheckPassword("alice-password") || got.CheckPassword("wrong") {
+		t.Error("password check failed")
+	}
+	if !got.HasRole(RoleSuperAdmin) || got.HasRole(RoleAuditor) {
+		t.Errorf("unexpected roles %v", got.Roles)
+	}
+
+	got.Disabled = true
+	if err := store.Update(got); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, _ := store.Get("alice"); !got.Disabled {
+		t.Error("expected the update to be stored")
+	}
+	if err := store.Update(User{Username: "bob"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, found, err := store.Get("bob"); found || err != nil {
+		t.Errorf("expected no bob, got found=%v err=%v", found, err)
+	}
+
+	// concurrent modifications all apply, none overwrites another
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.Modify("alice", func(u *User) error {
+				u.TOTPLastStep++
+				return nil
+			}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got, _, _ := store.Get("alice"); got.TOTPLastStep != 20 {
+		t.Errorf("expected 20 modifications, got %d", got.TOTPLastStep)
+	}
+	refused := errors.New("refused")
+	_, err = store.Modify("alice", func(u *User) error {
+		u.Disabled = false
+		return refused
+	})
+	if !errors.Is(err, refused) {
+		t.Errorf("expected the error of the modification, got %v", err)
+	}
+	if got, _, _ := store.Get("alice"); !got.Disabled {
+		t.Error("expected a failed modification to leave the user unchanged")
+	}
+	if _, err := store.Modify("bob", func(*User) error { return nil }); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// external accounts are found by their subject at the provider
+	if _, err := NewExternal("carol", "https://idp", "", nil); err == nil {
+		t.Error("expected an external account to require a subject")
+	}
+	carol, err := NewExternal("carol", "https://idp", "c-1", []string{RoleVoter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(carol); err != nil {
+		t.Fatal(err)
+	}
+	if got, found, err := store.GetExternal("https://idp", "c-1"); !found || err != nil || got.Username != "carol" {
+		t.Errorf("expected carol by subject, got %v found=%v err=%v", got.Username, found, err)
+	}
+	if _, found, _ := store.GetExternal("https://other", "c-1"); found {
+		t.Error("expected subjects to be scoped by provider")
+	}
+
+	if err := store.Create(User{Username: "aaron"}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[0].Username != "aaron" || list[1].Username != "alice" {
+		t.Errorf("unexpected list %v", list)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	store, err := OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+	store.Close()
+
+	// users survive reopening the file
+	store, err = OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, found, err := store.Get("alice"); !found || err != nil {
+		t.Errorf("expected alice after reopening, got found=%v err=%v", found, err)
+	}
+	if _, found, err := store.GetExternal("https://idp", "c-1"); !found || err != nil {
+		t.Errorf("expected carol by subject after reopening, got found=%v err=%v", found, err)
+	}
+
+	// accounts stored with the legacy roles read as the current ones
+	if err := store.Create(User{Username: "legacy", Roles: []string{"admin"}}); err != nil {
+		t.Fatal(err)
+	}
+	if legacy, _, _ := store.Get("legacy"); len(legacy.Roles) != 1 || legacy.Roles[0] != RoleSuperAdmin {
+		t.Errorf("unexpected legacy roles %v", legacy.Roles)
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hashed-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	if err := store.Create(User{Username: "carol", Roles: []string{RoleVoter}}); err != nil {
+		t.Fatal(err)
+	}
+
+	csv := "username,password,roles\n" +
+		"alice,1234,user;admin;voter\n" +
+		"bob," + string(hash) + ",\n" +
+		"carol,carol,admin\n"
+	result, err := ImportCSV(store, strings.NewReader(csv), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Created != 2 || result.Skipped != 1 {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	// the legacy roles are imported as their replacements
+	alice, _, _ := store.Get("alice")
+	if !alice.CheckPassword("1234") || len(alice.Roles) != 2 || !alice.HasRole(RoleVoter) || !alice.HasRole(RoleSuperAdmin) {
+		t.Errorf("unexpected alice %+v", alice)
+	}
+	bob, _, _ := store.Get("bob")
+	if !bob.CheckPassword("hashed-password") || !bob.HasRole(RoleVoter) {
+		t.Errorf("unexpected bob %+v", bob)
+	}
+	if carol, _, _ := store.Get("carol"); carol.HasRole(RoleSuperAdmin) {
+		t.Error("expected the existing carol to be kept")
+	}
+
+	if _, err := ImportCSV(store, strings.NewReader("name,password\n"), bcrypt.MinCost); err == nil {
+		t.Error("expected an error for a wrong header")
+	}
+	_, err = ImportCSV(store, strings.NewReader("username,password,roles\ndave,pw,admin;observer\n"), bcrypt.MinCost)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected an error on line 2, got %v", err)
+	}
+	_, err = ImportCSV(store, strings.NewReader("username,password,roles\neve,,voter\n"), bcrypt.MinCost)
+	if err == nil || !strings.Contains(err.Error(), "password is required") {
+		t.Errorf("expected a row without password to be refused, got %v", err)
+	}
+	if _, found, _ := store.Get("eve"); found {
+		t.Error("expected eve not to be imported")
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	officerAndVoter := []string{RoleVoter, RoleElectionOfficer}
+	if !Grants(officerAndVoter, ManageElections) || !Grants(officerAndVoter, CastVotes) {
+		t.Error("expected the roles to add up")
+	}
+	if Grants(officerAndVoter, ManageElections, CastVotes) {
+		t.Error("expected no single role to grant both")
+	}
+	if got := RolesGranting(officerAndVoter, CastVotes); len(got) != 1 || got[0] != RoleVoter {
+		t.Errorf("expected only the voter role to cast votes, got %v", got)
+	}
+	if Grants([]string{RoleSuperAdmin}, CastVotes) {
+		t.Error("expected super admins not to vote")
+	}
+	if Grants([]string{RoleAuditor}, ManageUsers) || !Grants([]string{RoleAuditor}, AuditBallots) {
+		t.Error("unexpected auditor permissions")
+	}
+	if Grants(nil) || !Grants([]string{RoleVoter}) {
+		t.Error("expected no permission to require any role")
+	}
+	if got := NormalizeRoles([]string{"user", "admin", RoleVoter}); len(got) != 2 || got[0] != RoleVoter || got[1] != RoleSuperAdmin {
+		t.Errorf("unexpected normalized roles %v", got)
+	}
+}
+
+func TestScope(t *testing.T) {
+	officer := Scope{Roles: []string{RoleVoter, RoleElectionOfficer, RoleAuditor}, Elections: []string{"election.e1"}}
+	if !officer.GrantsIn("e1", ManageElections) || !officer.GrantsIn("election.e1", ManageElections) {
+		t.Error("expected the officer to manage e1, with or without the key prefix")
+	}
+	if officer.GrantsIn("e2", ManageElections) || officer.GrantsIn("", ManageElections) {
+		t.Error("expected the officer not to manage other elections")
+	}
+	// auditors read every result, the officer role only those in scope
+	if got := officer.RolesGrantingIn("e2", ReadResults); len(got) != 1 || got[0] != RoleAuditor {
+		t.Errorf("expected only the auditor role on e2, got %v", got)
+	}
+	if got := officer.RolesGrantingIn("e1", ReadResults); len(got) != 2 {
+		t.Errorf("expected the officer and auditor roles on e1, got %v", got)
+	}
+	// permissions that are not scoped hold everywhere
+	if !officer.GrantsIn("e2", ReadElections) || !officer.GrantsIn("e2", ManageVoters) {
+		t.Error("expected unscoped permissions on every election")
+	}
+	admin := Scope{Roles: []string{RoleSuperAdmin}}
+	if !admin.GrantsIn("e2", ManageElections) || !admin.GrantsIn("e2", CreateElections) {
+		t.Error("expected super admins to be unscoped")
+	}
+	if officer.GrantsIn("e1", CreateElections) {
+		t.Error("expected officers not to create elections")
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// test vectors of RFC 6238, truncated to six digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	for at, want := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+		if got, err := TOTPCode(secret, time.Unix(at, 0)); err != nil || got != want {
+			t.Errorf("expected %s at %d, got %s %v", want, at, got, err)
+		}
+	}
+
+	user, err := New("root", "root-password", []string{RoleSuperAdmin}, bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !TwoFactorRequired(user.Roles) || TwoFactorRequired([]string{RoleVoter}) {
+		t.Error("expected two-factor authentication for admins only")
+	}
+	if _, err := user.EnrollTOTP(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	code, err := TOTPCode(user.TOTPSecret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	if _, confirmed, _ := user.ConfirmTOTP(wrong, now, bcrypt.MinCost); confirmed {
+		t.Error("expected a wrong code not to confirm the enrollment")
+	}
+	recovery, confirmed, err := user.ConfirmTOTP(code, now, bcrypt.MinCost)
+	if err != nil || !confirmed || !user.TOTPEnabled || len(recovery) != RecoveryCodeCount {
+		t.Fatalf("expected the enrollment to be confirmed, got %v %v", confirmed, err)
+	}
+
+	// codes are used once, a late code of the previous period is refused after it
+	if user.CheckTOTP(code, now) {
+		t.Error("expected a used code to be refused")
+	}
+	previous, _ := TOTPCode(user.TOTPSecret, now.Add(-TOTPPeriod))
+	if user.CheckTOTP(previous, now) {
+		t.Error("expected an older code to be refused")
+	}
+	next, _ := TOTPCode(user.TOTPSecret, now.Add(TOTPPeriod))
+	if !user.CheckTOTP(next, now) {
+		t.Error("expected a code of the next period to be accepted")
+	}
+	late, _ := TOTPCode(user.TOTPSecret, now.Add(5*TOTPPeriod))
+	if user.CheckTOTP(late, now) {
+		t.Error("expected a code far off to be refused")
+	}
+
+	if !user.UseRecoveryCode(strings.ToUpper(recovery[3])) || user.UseRecoveryCode(recovery[3]) {
+		t.Error("expected a recovery code to work once")
+	}
+	if len(user.RecoveryCodes) != RecoveryCodeCount-1 {
+		t.Errorf("expected %d recovery codes left, got %d", RecoveryCodeCount-1, len(user.RecoveryCodes))
+	}
+
+	user.DisableTOTP()
+	if user.TOTPEnabled || user.CheckTOTP(next, now) || user.UseRecoveryCode(recovery[0]) {
+		t.Error("expected two-factor authentication to be disabled")
+	}
+}
+
+func TestTOTPLockout(t *testing.T) {
+	var user User
+	now := time.Now()
+	for i := 0; i < MaxTOTPFailures-1; i++ {
+		user.RecordTOTPAttempt(false, now)
+	}
+	user.RecordTOTPAttempt(true, now)
+	if user.TOTPFailures != 0 || user.TOTPLocked(now) {
+		t.Errorf("expected a valid code to reset the count, got %d", user.TOTPFailures)
+	}
+	for i := 0; i < MaxTOTPFailures; i++ {
+		if user.TOTPLocked(now) {
+			t.Fatalf("expected %d invalid codes not to lock", i)
+		}
+		user.RecordTOTPAttempt(false, now)
+	}
+	if !user.TOTPLocked(now) || user.TOTPLocked(now.Add(TOTPLockout)) {
+		t.Errorf("expected a lock for %v, until %v", TOTPLockout, user.TOTPLockedUntil)
+	}
+	user.DisableTOTP()
+	if user.TOTPLocked(now) {
+		t.Error("expected a reset to lift the lock")
+	}
+}
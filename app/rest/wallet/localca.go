@@ -0,0 +1,110 @@
+package wallet
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+)
+
+// attributesOID is the certificate extension Fabric CA stores attributes in,
+// its value being the JSON object {"attrs":{...}}
+var attributesOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+// LocalCA stands in for a Fabric CA, signing certificates with the key of the
+// organization's CA itself, such as the one cryptogen generates for the test
+// network. Peers accept them as client identities of the organization.
+//
+// It is only meant for the test network. The server holds the CA's private
+// key and issues certificates no Fabric CA registered, so they cannot be
+// revoked through it.
+type LocalCA struct {
+	MspID    string
+	Validity time.Duration
+
+	certificate *x509.Certificate
+	key         crypto.Signer
+}
+
+// NewLocalCA loads the CA certificate and private key from PEM files
+func NewLocalCA(mspID, certPath, keyPath string) (*LocalCA, error) {
+	certificatePEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+	certificate, err := identity.CertificateFromPEM(certificatePEM)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA private key: %w", err)
+	}
+	privateKey, err := identity.PrivateKeyFromPEM(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA private key type %T", privateKey)
+	}
+
+	return &LocalCA{MspID: mspID, Validity: 365 * 24 * time.Hour, certificate: certificate, key: key}, nil
+}
+
+// Enroll issues a client certificate for name carrying the attributes
+func (ca *LocalCA) Enroll(name string, attributes map[string]string) (Entry, error) {
+	var entry Entry
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return entry, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return entry, err
+	}
+	attrs, err := json.Marshal(map[string]map[string]string{"attrs": attributes})
+	if err != nil {
+		return entry, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		// the client OU makes it a client identity to MSPs with node OUs enabled
+		Subject:               pkix.Name{CommonName: name, OrganizationalUnit: []string{"client"}},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(ca.Validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		ExtraExtensions:       []pkix.Extension{{Id: attributesOID, Value: attrs}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		return entry, fmt.Errorf("failed to sign certificate: %w", err)
+	}
+	privateKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return entry, err
+	}
+
+	entry.MspID = ca.MspID
+	entry.Type = "X.509"
+	entry.Version = 1
+	entry.Credentials.Certificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	entry.Credentials.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKey}))
+	return entry, nil
+}
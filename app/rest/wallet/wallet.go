@@ -0,0 +1,163 @@
+// Package wallet keeps the Fabric identities the REST server submits
+// transactions with, one for every user and role, so the ledger records who
+// signed each transaction instead of a single shared identity.
+//
+// Identities are stored one file per label in the wallet format of the Fabric
+// SDKs. Users the wallet does not know yet are enrolled on first use through an
+// Enroller, either a Fabric CA client or the LocalCA stand-in.
+package wallet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+)
+
+// Entry is an enrolled identity
+type Entry struct {
+	Credentials Credentials `json:"credentials"`
+	MspID       string      `json:"mspId"`
+	Type        string      `json:"type"`
+	Version     int         `json:"version"`
+}
+
+// Credentials are the PEM encoded certificate and PKCS #8 private key of an identity
+type Credentials struct {
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"privateKey"`
+}
+
+// Identity returns the identity to connect to the gateway with
+func (e Entry) Identity() (*identity.X509Identity, error) {
+	certificate, err := identity.CertificateFromPEM([]byte(e.Credentials.Certificate))
+	if err != nil {
+		return nil, err
+	}
+	return identity.NewX509Identity(e.MspID, certificate)
+}
+
+// Sign returns the function signing transactions for the identity
+func (e Entry) Sign() (identity.Sign, error) {
+	privateKey, err := identity.PrivateKeyFromPEM([]byte(e.Credentials.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	return identity.NewPrivateKeySign(privateKey)
+}
+
+// Enroller issues an identity named name whose certificate carries the
+// attributes, for the chaincode to read with the client identity library
+type Enroller interface {
+	Enroll(name string, attributes map[string]string) (Entry, error)
+}
+
+// Wallet is a directory of enrolled identities
+type Wallet struct {
+	dir      string
+	enroller Enroller
+
+	mu sync.Mutex
+	// enrollments in progress by label, requests for a label being enrolled
+	// wait for it instead of enrolling it again
+	enrolling map[string]*enrollment
+}
+
+// enrollment is an identity being enrolled, done is closed once entry and err are set
+type enrollment struct {
+	done  chan struct{}
+	entry Entry
+	err   error
+}
+
+// New opens the wallet in dir, creating it if needed
+func New(dir string, enroller Enroller) (*Wallet, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create wallet directory: %w", err)
+	}
+	return &Wallet{dir: dir, enroller: enroller, enrolling: map[string]*enrollment{}}, nil
+}
+
+func (w *Wallet) path(label string) string {
+	return filepath.Join(w.dir, url.PathEscape(label)+".id")
+}
+
+// Get returns the identity stored under label, found being false if there is none
+func (w *Wallet) Get(label string) (entry Entry, found bool, err error) {
+	data, err := os.ReadFile(w.path(label))
+	if errors.Is(err, os.ErrNotExist) {
+		return entry, false, nil
+	}
+	if err != nil {
+		return entry, false, fmt.Errorf("failed to read identity %s: %w", label, err)
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return entry, false, fmt.Errorf("failed to decode identity %s: %w", label, err)
+	}
+	return entry, true, nil
+}
+
+// Put stores the identity under label
+func (w *Wallet) Put(label string, entry Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	// write aside and rename so a crash never leaves half an identity behind
+	tmp := w.path(label) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write identity %s: %w", label, err)
+	}
+	return os.Rename(tmp, w.path(label))
+}
+
+// Identity returns the identity stored under label, enrolling it with the
+// attributes first if the wallet does not have it yet. Every label is enrolled
+// once however many callers ask for it meanwhile, and enrolling one label does
+// not hold up the others.
+func (w *Wallet) Identity(label string, attributes map[string]string) (Entry, error) {
+	// Put renames complete files into place, so reading needs no lock
+	entry, found, err := w.Get(label)
+	if err != nil || found {
+		return entry, err
+	}
+	if w.enroller == nil {
+		return entry, fmt.Errorf("identity %s is not in the wallet", label)
+	}
+
+	w.mu.Lock()
+	if e, ok := w.enrolling[label]; ok {
+		w.mu.Unlock()
+		<-e.done
+		return e.entry, e.err
+	}
+	e := &enrollment{done: make(chan struct{})}
+	w.enrolling[label] = e
+	w.mu.Unlock()
+
+	e.entry, e.err = w.enroll(label, attributes)
+
+	w.mu.Lock()
+	delete(w.enrolling, label)
+	w.mu.Unlock()
+	close(e.done)
+	return e.entry, e.err
+}
+
+func (w *Wallet) enroll(label string, attributes map[string]string) (Entry, error) {
+	// an enrollment finishing between the caller's Get and taking over the label
+	entry, found, err := w.Get(label)
+	if err != nil || found {
+		return entry, err
+	}
+	entry, err = w.enroller.Enroll(label, attributes)
+	if err != nil {
+		return entry, fmt.Errorf("failed to enroll %s: %w", label, err)
+	}
+	return entry, w.Put(label, entry)
+}
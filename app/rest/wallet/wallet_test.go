@@ -0,0 +1,198 @@
+package wallet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+)
+
+// newTestCA writes a self-signed CA certificate and key to dir, as cryptogen does
+func newTestCA(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca.org1.example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, "ca-cert.pem")
+	keyPath := filepath.Join(dir, "priv_sk")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestLocalCAEnroll(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := newTestCA(t, dir)
+	ca, err := NewLocalCA("Org1MSP", certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := New(filepath.Join(dir, "wallet"), ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := w.Identity("user1.voter", map[string]string{"role": "voter", "voterID": "user1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := entry.Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.MspID() != "Org1MSP" {
+		t.Errorf("expected MSP ID Org1MSP, got %s", id.MspID())
+	}
+
+	// the certificate chains to the CA and carries the attributes
+	certificate, err := identity.CertificateFromPEM([]byte(entry.Credentials.Certificate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	if _, err := certificate.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		t.Errorf("certificate does not chain to the CA: %v", err)
+	}
+	var attrs struct {
+		Attrs map[string]string `json:"attrs"`
+	}
+	for _, ext := range certificate.Extensions {
+		if ext.Id.Equal(attributesOID) {
+			if err := json.Unmarshal(ext.Value, &attrs); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if attrs.Attrs["role"] != "voter" || attrs.Attrs["voterID"] != "user1" {
+		t.Errorf("unexpected attributes %v", attrs.Attrs)
+	}
+
+	// the private key signs for the certificate
+	sign, err := entry.Sign()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("proposal"))
+	signature, err := sign(digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(certificate.PublicKey.(*ecdsa.PublicKey), digest[:], signature) {
+		t.Error("signature does not verify against the certificate")
+	}
+
+	// later calls read the identity back instead of enrolling again
+	again, err := w.Identity("user1.voter", map[string]string{"role": "voter", "voterID": "user1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Credentials.Certificate != entry.Credentials.Certificate {
+		t.Error("expected the stored identity to be reused")
+	}
+}
+
+func TestWalletWithoutEnroller(t *testing.T) {
+	w, err := New(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Identity("../admin", nil); err == nil {
+		t.Error("expected an error for an unknown identity")
+	}
+	if _, found, err := w.Get("../admin"); err != nil || found {
+		t.Errorf("expected no identity, got found=%v err=%v", found, err)
+	}
+}
+
+// slowEnroller counts enrollments and holds up those of the blocked label
+type slowEnroller struct {
+	mu      sync.Mutex
+	count   map[string]int
+	blocked string
+	release chan struct{}
+}
+
+func (e *slowEnroller) Enroll(name string, attributes map[string]string) (Entry, error) {
+	e.mu.Lock()
+	e.count[name]++
+	e.mu.Unlock()
+	if name == e.blocked {
+		<-e.release
+	}
+	return Entry{MspID: "Org1MSP", Type: "X.509", Version: 1, Credentials: Credentials{Certificate: name}}, nil
+}
+
+func TestWalletConcurrentEnrollment(t *testing.T) {
+	enroller := &slowEnroller{count: map[string]int{}, blocked: "user1.voter", release: make(chan struct{})}
+	w, err := New(t.TempDir(), enroller)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entry, err := w.Identity("user1.voter", nil)
+			if err != nil || entry.Credentials.Certificate != "user1.voter" {
+				t.Errorf("unexpected identity %+v, %v", entry, err)
+			}
+		}()
+	}
+
+	// another identity is enrolled while the first one is still waiting
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := w.Identity("user2.voter", nil); err != nil {
+			t.Error(err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("enrolling one identity held up another")
+	}
+	close(enroller.release)
+	wg.Wait()
+
+	if enroller.count["user1.voter"] != 1 || enroller.count["user2.voter"] != 1 {
+		t.Errorf("expected every identity to be enrolled once, got %v", enroller.count)
+	}
+}
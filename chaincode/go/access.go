@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// Callers are told apart by the "role" attribute of their X.509 certificate,
+// set when the identity is registered with the Fabric CA, e.g.
+//
+//	fabric-ca-client register --id.name alice --id.attrs 'role=voter:ecert,voterID=alice:ecert'
+//
+// Identities without the attribute, such as those issued by cryptogen, have no role.
+// Voters also carry the ID of the voter they may cast ballots for, officers
+// the comma separated IDs of the elections they run, e.g.
+//
+//	--id.attrs 'role=officer:ecert,elections=election.<txID>\,election.<txID>:ecert'
+//
+// Trustees of encrypted elections submit decryption shares as the user the
+// election records for them, which is the voterID attribute of their identity.
+//
+// Networks whose clients still submit everything with one shared identity, as
+// the REST server did before it enrolled an identity per user, can turn the
+// checks off until they are moved over. An admin of the organization's MSP
+// invokes setRoleChecks with "false", every client is then trusted as before
+// the checks existed, and with "true" to enforce them again.
+const (
+	roleAttribute      = "role"
+	voterIDAttribute   = "voterID"
+	electionsAttribute = "elections"
+	roleAdmin          = "admin"
+	roleAuditor        = "auditor"
+	roleOfficer        = "officer"
+	roleVoter          = "voter"
+)
+
+// functionRoles lists the roles allowed to invoke the functions changing the
+// ledger or reading raw ballots, Invoke checks them before dispatching.
+// Functions missing from it are open to every member of the channel.
+var functionRoles = map[string][]string{
+	"createElection":        {roleAdmin},
+	"updateElection":        {roleAdmin, roleOfficer},
+	"openElection":          {roleAdmin, roleOfficer},
+	"closeElection":         {roleAdmin, roleOfficer},
+	"tallyElection":         {roleAdmin, roleOfficer},
+	"archiveElection":       {roleAdmin, roleOfficer},
+	"createVoter":           {roleAdmin, roleOfficer},
+	"createCandidate":       {roleAdmin, roleOfficer},
+	"compactVoteCounts":     {roleAdmin, roleOfficer},
+	"migrateKeys":           {roleAdmin},
+	"submitDecryptionShare": {roleAdmin, roleOfficer},
+	"getFinalResult":        {roleAdmin, roleAuditor, roleOfficer},
+	"getRankedResult":       {roleAdmin, roleAuditor, roleOfficer},
+	"getSeatResult":         {roleAdmin, roleAuditor, roleOfficer},
+	"vote":                  {roleVoter, roleAdmin},
+	"voteRanked":            {roleVoter, roleAdmin},
+	"voteApproval":          {roleVoter, roleAdmin},
+	"voteEncrypted":         {roleVoter, roleAdmin},
+	"voteHomomorphic":       {roleVoter, roleAdmin},
+	"getBallotRecords":      {roleAdmin, roleAuditor},
+	"getEncryptedBallots":   {roleAdmin, roleAuditor, roleOfficer},
+}
+
+// electionArgs gives the argument holding the election ID of the functions
+// officers may only invoke for the elections listed in their identity. Voters
+// are not bound to an election, so any officer may register them.
+var electionArgs = map[string]int{
+	"updateElection":        0,
+	"openElection":          0,
+	"closeElection":         0,
+	"tallyElection":         0,
+	"archiveElection":       0,
+	"createCandidate":       2,
+	"compactVoteCounts":     0,
+	"submitDecryptionShare": 0,
+	"getFinalResult":        0,
+	"getRankedResult":       0,
+	"getSeatResult":         0,
+	"getEncryptedBallots":   0,
+}
+
+// roleChecksKey is the config entry turning the checks off when "false"
+const roleChecksKey = "roleChecks"
+
+// roleChecks tells whether the identity checks are enforced, which they are
+// unless turned off with setRoleChecks
+func roleChecks(stub shim.ChaincodeStubInterface) (bool, error) {
+	value, err := getEntity(stub, configObjectType, roleChecksKey)
+	if err != nil {
+		return false, fmt.Errorf("failed to read role checks: %w", err)
+	}
+	return string(value) != "false", nil
+}
+
+// setRoleChecks turns the identity checks on or off, only admins of the MSP
+// may, as their certificates carry the admin OU rather than a role attribute
+// args: "true" or "false"
+func (t *VotingChaincode) setRoleChecks(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	enabled, err := strconv.ParseBool(args[0])
+	if err != nil {
+		return shim.Error("Invalid role checks flag: " + args[0])
+	}
+	admin, err := cid.HasOUValue(stub, "admin")
+	if err != nil {
+		return shim.Error("failed to read client identity: " + err.Error())
+	}
+	if !admin {
+		return shim.Error("only admins of the MSP may change the role checks")
+	}
+	if err := putEntity(stub, configObjectType, roleChecksKey, []byte(strconv.FormatBool(enabled))); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// requireRole fails unless the submitting identity has one of the roles
+func requireRole(stub shim.ChaincodeStubInterface, roles ...string) error {
+	if enabled, err := roleChecks(stub); err != nil || !enabled {
+		return err
+	}
+	role, found, err := cid.GetAttributeValue(stub, roleAttribute)
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %w", err)
+	}
+	if found && contains(roles, role) {
+		return nil
+	}
+	mspID, _ := cid.GetMSPID(stub)
+	return fmt.Errorf("identity of %s is not allowed, requires role %s", mspID, strings.Join(roles, " or "))
+}
+
+// requireElectionScope fails if the submitter is an officer whose identity
+// does not list the election, other roles are not scoped
+func requireElectionScope(stub shim.ChaincodeStubInterface, electionID string) error {
+	if enabled, err := roleChecks(stub); err != nil || !enabled {
+		return err
+	}
+	role, _, err := cid.GetAttributeValue(stub, roleAttribute)
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %w", err)
+	}
+	if role != roleOfficer {
+		return nil
+	}
+	elections, _, err := cid.GetAttributeValue(stub, electionsAttribute)
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %w", err)
+	}
+	electionID = strings.TrimPrefix(electionID, "election.")
+	for _, id := range strings.Split(elections, ",") {
+		if id != "" && strings.TrimPrefix(id, "election.") == electionID {
+			return nil
+		}
+	}
+	return fmt.Errorf("officer is not allowed to act on election %s", electionID)
+}
+
+// requireVoter fails unless the submitting identity is the voter, so nobody
+// can cast a ballot in someone else's name
+func requireVoter(stub shim.ChaincodeStubInterface, voterID string) error {
+	if enabled, err := roleChecks(stub); err != nil || !enabled {
+		return err
+	}
+	id, found, err := cid.GetAttributeValue(stub, voterIDAttribute)
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %w", err)
+	}
+	if !strings.HasPrefix(id, "voter.") {
+		id = "voter." + id
+	}
+	if !found || id != voterID {
+		return fmt.Errorf("submitter is not allowed to vote as %s", voterID)
+	}
+	return nil
+}
+
+// requireTrustee checks the submitter is the user recorded for a trustee of
+// an encrypted election, named by the voterID attribute of their identity like
+// voters are
+func requireTrustee(stub shim.ChaincodeStubInterface, trusteeID string) error {
+	if enabled, err := roleChecks(stub); err != nil || !enabled {
+		return err
+	}
+	id, found, err := cid.GetAttributeValue(stub, voterIDAttribute)
+	if err != nil {
+		return fmt.Errorf("failed to read client identity: %w", err)
+	}
+	if !strings.HasPrefix(id, "voter.") {
+		id = "voter." + id
+	}
+	if !strings.HasPrefix(trusteeID, "voter.") {
+		trusteeID = "voter." + trusteeID
+	}
+	if !found || id != trusteeID {
+		return fmt.Errorf("submitter is not the trustee %s", trusteeID)
+	}
+	return nil
+}
+
+// canSeeChoices tells whether the submitter may read who the voter voted for,
+// which only auditors, admins and the voter themselves can
+func canSeeChoices(stub shim.ChaincodeStubInterface, voterID string) bool {
+	return requireRole(stub, roleAdmin, roleAuditor) == nil || requireVoter(stub, voterID) == nil
+}
+
+// redactChoices leaves only whether the voter took part in each election
+func redactChoices(v *voterV2) {
+	for i, h := range v.ElectionHistory {
+		v.ElectionHistory[i] = ElectionHistory{ElectionID: h.ElectionID, Voted: h.voted(), Nullifier: h.Nullifier}
+	}
+}
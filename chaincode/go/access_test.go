@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// attributesOID is the certificate extension the Fabric CA stores attributes in
+var attributesOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+// identity returns a serialized Org1MSP identity whose certificate carries the
+// attributes and organizational units, as the Fabric CA and cryptogen issue them
+func identity(t *testing.T, attributes map[string]string, units ...string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client", OrganizationalUnit: units},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if attributes != nil {
+		value, _ := json.Marshal(map[string]interface{}{"attrs": attributes})
+		template.ExtraExtensions = []pkix.Extension{{Id: attributesOID, Value: value}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialized, err := proto.Marshal(&msp.SerializedIdentity{
+		Mspid:   "Org1MSP",
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serialized
+}
+
+// newStub returns a stub of the chaincode submitting as an admin
+func newStub(t *testing.T) *shimtest.MockStub {
+	stub := shimtest.NewMockStub("voting", new(VotingChaincode))
+	stub.Creator = identity(t, map[string]string{"role": roleAdmin})
+	return stub
+}
+
+var txCount int
+
+// invoke runs the function as a transaction of its own
+func invoke(stub *shimtest.MockStub, function string, args ...string) pb.Response {
+	txCount++
+	input := [][]byte{[]byte(function)}
+	for _, arg := range args {
+		input = append(input, []byte(arg))
+	}
+	// the gateway sends every vote a random nonce and ballot key, unless the
+	// test set its own
+	if stub.TransientMap == nil {
+		stub.TransientMap = map[string][]byte{
+			"nonce":        []byte(fmt.Sprintf("nonce of tx%d", txCount)),
+			ballotKeyField: []byte(fmt.Sprintf("ballot key of tx%d", txCount)),
+		}
+		defer func() { stub.TransientMap = nil }()
+	}
+	return stub.MockInvoke(fmt.Sprintf("tx%d", txCount), input)
+}
+
+// mustInvoke fails the test unless the function succeeds and returns its payload
+func mustInvoke(t *testing.T, stub *shimtest.MockStub, function string, args ...string) string {
+	t.Helper()
+	res := invoke(stub, function, args...)
+	if res.Status != shim.OK {
+		t.Fatalf("%s%v: %s", function, args, res.Message)
+	}
+	return string(res.Payload)
+}
+
+func TestRoleChecks(t *testing.T) {
+	stub := newStub(t)
+	admin := stub.Creator
+	shared := identity(t, nil)
+	mspAdmin := identity(t, nil, "admin")
+
+	// an identity without role attributes, as cryptogen issues them, is refused
+	stub.Creator = shared
+	if res := invoke(stub, "createElection", "e", "2020-01-01", "2099-01-01"); res.Status == shim.OK {
+		t.Error("expected an identity without role to be refused")
+	}
+	// only MSP admins change the checks, whatever role attribute they carry
+	for _, creator := range [][]byte{shared, admin} {
+		stub.Creator = creator
+		if res := invoke(stub, "setRoleChecks", "false"); res.Status == shim.OK {
+			t.Error("expected a client to be refused turning the checks off")
+		}
+	}
+
+	stub.Creator = mspAdmin
+	mustInvoke(t, stub, "setRoleChecks", "false")
+
+	// with the checks off the shared identity runs the election and votes for anyone
+	stub.Creator = shared
+	electionID := mustInvoke(t, stub, "createElection", "e", "2020-01-01", "2099-01-01")
+	mustInvoke(t, stub, "createCandidate", "Alice", "alice", electionID)
+	mustInvoke(t, stub, "openElection", electionID)
+	mustInvoke(t, stub, "createVoter", "user1")
+	mustInvoke(t, stub, "vote", "user1", "alice", electionID)
+
+	stub.Creator = mspAdmin
+	mustInvoke(t, stub, "setRoleChecks", "true")
+	stub.Creator = shared
+	if res := invoke(stub, "createVoter", "user2"); res.Status == shim.OK {
+		t.Error("expected the checks to be enforced again")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+type seatResult struct {
+	ElectionID string         `json:"electionID"`
+	Seats      int            `json:"seats"`
+	Winners    []string       `json:"winners"`
+	Tally      map[string]int `json:"tally"`
+	// TiedAtCutoff lists the candidates sharing the vote count of the last
+	// seat when not all of them fit, the winners among them are picked by ID
+	TiedAtCutoff []string `json:"tiedAtCutoff,omitempty"`
+}
+
+// vote with an approval ballot
+// args: voterID, JSON array of the approved candidate IDs, electionID
+func (t *VotingChaincode) voteApproval(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	var choices []string
+	if err := json.Unmarshal([]byte(args[1]), &choices); err != nil {
+		return shim.Error("Failed to unmarshal choices")
+	}
+	if len(choices) == 0 {
+		return shim.Error("at least one candidate must be chosen")
+	}
+
+	ElectionID := args[2]
+	if !strings.HasPrefix(ElectionID, "election.") {
+		ElectionID = "election." + ElectionID
+	}
+
+	choices, err := validateChoices(stub, ElectionID, choices)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return t.castBallot(stub, args[0], ElectionID, ballotApproval, choices)
+}
+
+// getSeatResult returns the candidates filling the seats of a plurality,
+// approval or encrypted election, the ones with the most votes winning
+func (t *VotingChaincode) getSeatResult(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	electionID := args[0]
+	if !strings.HasPrefix(electionID, "election.") {
+		electionID = "election." + electionID
+	}
+
+	electionAsBytes, err := getEntity(stub, electionObjectType, electionID)
+	if err != nil {
+		return shim.Error("Failed to get election: " + electionID)
+	}
+	if electionAsBytes == nil {
+		return shim.Error("election not found")
+	}
+	e := election{}
+	if err := json.Unmarshal(electionAsBytes, &e); err != nil {
+		return shim.Error("Failed to unmarshal the election")
+	}
+	if e.ballotType() == ballotRanked {
+		return shim.Error("ranked elections are counted with getRankedResult")
+	}
+	if err := resultsVisible(stub, e); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	candidates, err := getElectionCandidateIDs(stub, electionID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tally, err := electionTally(stub, electionID, e)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	delete(tally, "invalid")
+	// candidates nobody voted for still compete for the seats
+	for _, c := range candidates {
+		if _, ok := tally[c]; !ok {
+			tally[c] = 0
+		}
+	}
+
+	result := fillSeats(tally, e.seats())
+	result.ElectionID = electionID
+
+	response, err := json.Marshal(result)
+	if err != nil {
+		fmt.Println("failed to marshal response", err)
+		return shim.Error("failed to create response")
+	}
+	return shim.Success(response)
+}
+
+// fillSeats orders candidates by votes, breaking ties by ID, and hands out the seats
+func fillSeats(tally map[string]int, seats int) seatResult {
+	ranked := make([]string, 0, len(tally))
+	for c := range tally {
+		ranked = append(ranked, c)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if tally[ranked[i]] != tally[ranked[j]] {
+			return tally[ranked[i]] > tally[ranked[j]]
+		}
+		return ranked[i] < ranked[j]
+	})
+
+	result := seatResult{Seats: seats, Tally: tally, Winners: []string{}}
+	if len(ranked) <= seats {
+		result.Winners = append(result.Winners, ranked...)
+		return result
+	}
+	result.Winners = append(result.Winners, ranked[:seats]...)
+
+	cutoff := tally[ranked[seats-1]]
+	if tally[ranked[seats]] == cutoff {
+		for _, c := range ranked {
+			if tally[c] == cutoff {
+				result.TiedAtCutoff = append(result.TiedAtCutoff, c)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFillSeats(t *testing.T) {
+	for name, test := range map[string]struct {
+		tally   map[string]int
+		seats   int
+		winners []string
+		tied    []string
+	}{
+		"most votes win": {
+			tally:   map[string]int{"a": 5, "b": 3, "c": 4, "d": 1},
+			seats:   2,
+			winners: []string{"a", "c"},
+		},
+		"fewer candidates than seats": {
+			tally:   map[string]int{"a": 1, "b": 2},
+			seats:   3,
+			winners: []string{"b", "a"},
+		},
+		"ties above the cutoff are broken by ID": {
+			tally:   map[string]int{"b": 4, "a": 4, "c": 1},
+			seats:   2,
+			winners: []string{"a", "b"},
+		},
+		"tie at the cutoff": {
+			tally:   map[string]int{"a": 5, "d": 3, "c": 3, "b": 3, "e": 1},
+			seats:   2,
+			winners: []string{"a", "b"},
+			tied:    []string{"b", "c", "d"},
+		},
+		"tie for every seat": {
+			tally:   map[string]int{"c": 2, "a": 2, "b": 2},
+			seats:   2,
+			winners: []string{"a", "b"},
+			tied:    []string{"a", "b", "c"},
+		},
+		"tie fitting the seats": {
+			tally:   map[string]int{"a": 2, "b": 2, "c": 1},
+			seats:   2,
+			winners: []string{"a", "b"},
+		},
+		"no candidates": {
+			tally:   map[string]int{},
+			seats:   1,
+			winners: []string{},
+		},
+	} {
+		result := fillSeats(test.tally, test.seats)
+		if !reflect.DeepEqual(result.Winners, test.winners) || !reflect.DeepEqual(result.TiedAtCutoff, test.tied) {
+			t.Errorf("%s: expected %v tied %v, got %v tied %v", name, test.winners, test.tied, result.Winners, result.TiedAtCutoff)
+		}
+		if result.Seats != test.seats {
+			t.Errorf("%s: expected %d seats, got %d", name, test.seats, result.Seats)
+		}
+	}
+}
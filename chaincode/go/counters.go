@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// Votes are counted as they come in. Rather than a read-modify-write on one
+// counter per candidate, which makes concurrent votes for the same candidate
+// fail with MVCC_READ_CONFLICT, every vote writes a delta key of its own,
+// votedelta~<election>~<shard>~<candidate>~<txID>, and never reads a counter.
+// compactVoteCounts folds the deltas of a shard into one votecount key per
+// candidate and shard, so a count is read from O(candidates * shards) keys
+// plus whatever was voted since the last compaction. The shard comes from the
+// transaction ID, so compacting one shard only races with the votes landing in
+// it and a compaction that loses such a race can simply be retried.
+
+const (
+	voteDeltaObjectType = "votedelta"
+	voteCountObjectType = "votecount"
+	voteShards          = 16
+)
+
+// voteShard spreads votes over the shards by their transaction ID
+func voteShard(txID string) string {
+	sum := sha256.Sum256([]byte(txID))
+	return fmt.Sprintf("%02d", binary.BigEndian.Uint32(sum[:4])%voteShards)
+}
+
+// addVoteDeltas counts the current transaction once for every candidate
+func addVoteDeltas(stub shim.ChaincodeStubInterface, electionID string, candidates []string) error {
+	txID := stub.GetTxID()
+	for _, candidateID := range candidates {
+		key, err := stub.CreateCompositeKey(voteDeltaObjectType, []string{electionID, voteShard(txID), candidateID, txID})
+		if err != nil {
+			return err
+		}
+		if err := stub.PutState(key, []byte("1")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillVoteDeltas counts a ballot written before the vote counters existed,
+// which migrateKeys moves to its composite key. The delta is keyed by the
+// ballot rather than a transaction, so migrating it again counts it once.
+func backfillVoteDeltas(stub shim.ChaincodeStubInterface, electionID, ballotID string, value []byte) error {
+	electionAsBytes, err := getEntity(stub, electionObjectType, electionID)
+	if err != nil {
+		return err
+	}
+	if electionAsBytes == nil {
+		// the election may not be migrated yet, it is read as it was written
+		if electionAsBytes, err = stub.GetState(electionID); err != nil {
+			return err
+		}
+	}
+	if electionAsBytes == nil {
+		// a ballot of an election that is gone is never tallied
+		return nil
+	}
+	e := election{}
+	if err := json.Unmarshal(electionAsBytes, &e); err != nil {
+		return fmt.Errorf("failed to unmarshal election %s", electionID)
+	}
+	// encrypted ballots are only counted once decrypted
+	if e.ballotType() == ballotEncrypted || e.ballotType() == ballotHomomorphic {
+		return nil
+	}
+	ballot, err := decodeBallot(value)
+	if err != nil {
+		return fmt.Errorf("failed to decode ballot %s/%s: %w", electionID, ballotID, err)
+	}
+
+	deltaID := "migrated." + ballotID
+	for _, candidateID := range countedChoices(e.ballotType(), ballot) {
+		key, err := stub.CreateCompositeKey(voteDeltaObjectType, []string{electionID, voteShard(deltaID), candidateID, deltaID})
+		if err != nil {
+			return err
+		}
+		if err := stub.PutState(key, []byte("1")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getVoteCounts sums the compacted counts and the pending deltas of every
+// candidate of the election
+func getVoteCounts(stub shim.ChaincodeStubInterface, electionID string) (map[string]int, error) {
+	counts := make(map[string]int)
+	for _, objectType := range []string{voteCountObjectType, voteDeltaObjectType} {
+		err := scanCompositeKeys(stub, objectType, []string{electionID}, func(attributes []string, value []byte) error {
+			n, err := strconv.Atoi(string(value))
+			if err != nil || len(attributes) < 3 {
+				return fmt.Errorf("invalid vote counter %s", strings.Join(attributes, "/"))
+			}
+			counts[attributes[2]] += n
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+// compactVoteCounts folds the vote deltas of an election into the per-shard
+// counts and deletes them
+// args: electionID, optional shard (all shards when omitted)
+func (t *VotingChaincode) compactVoteCounts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+	electionID := args[0]
+	if !strings.HasPrefix(electionID, "election.") {
+		electionID = "election." + electionID
+	}
+
+	var shards []string
+	if len(args) == 2 && args[1] != "" {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 || n >= voteShards {
+			return shim.Error(fmt.Sprintf("Invalid shard, expecting 0 to %d", voteShards-1))
+		}
+		shards = []string{fmt.Sprintf("%02d", n)}
+	} else {
+		for n := 0; n < voteShards; n++ {
+			shards = append(shards, fmt.Sprintf("%02d", n))
+		}
+	}
+
+	compacted := 0
+	for _, shard := range shards {
+		n, err := compactShard(stub, electionID, shard)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		compacted += n
+	}
+
+	response, _ := json.Marshal(map[string]int{"compacted": compacted})
+	return shim.Success(response)
+}
+
+// compactShard adds the deltas of one shard to its counts and returns how
+// many deltas it removed
+func compactShard(stub shim.ChaincodeStubInterface, electionID, shard string) (int, error) {
+	pending := make(map[string]int)
+	var deltaKeys []string
+	err := scanCompositeKeys(stub, voteDeltaObjectType, []string{electionID, shard}, func(attributes []string, value []byte) error {
+		n, err := strconv.Atoi(string(value))
+		if err != nil || len(attributes) < 4 {
+			return fmt.Errorf("invalid vote delta %s", strings.Join(attributes, "/"))
+		}
+		pending[attributes[2]] += n
+		key, _ := stub.CreateCompositeKey(voteDeltaObjectType, attributes)
+		deltaKeys = append(deltaKeys, key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for candidateID, n := range pending {
+		key, err := stub.CreateCompositeKey(voteCountObjectType, []string{electionID, shard, candidateID})
+		if err != nil {
+			return 0, err
+		}
+		countAsBytes, err := stub.GetState(key)
+		if err != nil {
+			return 0, err
+		}
+		if countAsBytes != nil {
+			count, err := strconv.Atoi(string(countAsBytes))
+			if err != nil {
+				return 0, fmt.Errorf("invalid vote count %s", key)
+			}
+			n += count
+		}
+		if err := stub.PutState(key, []byte(strconv.Itoa(n))); err != nil {
+			return 0, err
+		}
+	}
+	for _, key := range deltaKeys {
+		if err := stub.DelState(key); err != nil {
+			return 0, err
+		}
+	}
+	return len(deltaKeys), nil
+}
+
+// resultsVisible rejects reading the results of a running election unless it
+// was created with live results
+func resultsVisible(stub shim.ChaincodeStubInterface, e election) error {
+	if e.LiveResults {
+		return nil
+	}
+	ended, err := e.ended(stub)
+	if err != nil {
+		return err
+	}
+	if !ended {
+		return fmt.Errorf("results are available once the election has ended")
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+)
+
+func TestCompactVoteCounts(t *testing.T) {
+	const electionID = "election.e"
+	for name, test := range map[string]struct {
+		// deltas as shard, candidate, txID and compacted counts as shard, candidate
+		deltas    [][3]string
+		counts    map[[2]string]int
+		shard     string
+		compacted int
+		// deltas left after compacting, by shard
+		left map[string]int
+	}{
+		"every shard": {
+			deltas:    [][3]string{{"00", "alice", "tx1"}, {"00", "alice", "tx2"}, {"03", "bob", "tx3"}},
+			compacted: 3,
+		},
+		"onto existing counts": {
+			deltas:    [][3]string{{"00", "alice", "tx1"}, {"00", "bob", "tx2"}},
+			counts:    map[[2]string]int{{"00", "alice"}: 4, {"05", "bob"}: 2},
+			compacted: 2,
+		},
+		"one shard": {
+			deltas:    [][3]string{{"01", "alice", "tx1"}, {"01", "bob", "tx2"}, {"02", "alice", "tx3"}},
+			shard:     "1",
+			compacted: 2,
+			left:      map[string]int{"02": 1},
+		},
+		"nothing to compact": {
+			counts: map[[2]string]int{{"00", "alice"}: 1},
+		},
+	} {
+		stub := shimtest.NewMockStub("voting", new(VotingChaincode))
+		stub.MockTransactionStart("setup")
+		for _, d := range test.deltas {
+			key, _ := stub.CreateCompositeKey(voteDeltaObjectType, []string{electionID, d[0], d[1], d[2]})
+			stub.PutState(key, []byte("1"))
+		}
+		for c, n := range test.counts {
+			key, _ := stub.CreateCompositeKey(voteCountObjectType, []string{electionID, c[0], c[1]})
+			stub.PutState(key, []byte(strconv.Itoa(n)))
+		}
+		stub.MockTransactionEnd("setup")
+
+		counts := func() map[string]int {
+			stub.MockTransactionStart("read")
+			defer stub.MockTransactionEnd("read")
+			counts, err := getVoteCounts(stub, electionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return counts
+		}
+		before := counts()
+
+		var response struct {
+			Compacted int `json:"compacted"`
+		}
+		stub.MockTransactionStart("compact")
+		res := new(VotingChaincode).compactVoteCounts(stub, []string{electionID, test.shard})
+		stub.MockTransactionEnd("compact")
+		if res.Status != shim.OK {
+			t.Fatalf("%s: %s", name, res.Message)
+		}
+		if err := json.Unmarshal(res.Payload, &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Compacted != test.compacted {
+			t.Errorf("%s: expected %d deltas compacted, got %d", name, test.compacted, response.Compacted)
+		}
+		if after := counts(); !reflect.DeepEqual(after, before) {
+			t.Errorf("%s: expected the counts %v to stay, got %v", name, before, after)
+		}
+
+		left := make(map[string]int)
+		stub.MockTransactionStart("read")
+		err := scanCompositeKeys(stub, voteDeltaObjectType, []string{electionID}, func(attributes []string, value []byte) error {
+			left[attributes[1]]++
+			return nil
+		})
+		stub.MockTransactionEnd("read")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.left == nil {
+			test.left = map[string]int{}
+		}
+		if !reflect.DeepEqual(left, test.left) {
+			t.Errorf("%s: expected deltas %v left, got %v", name, test.left, left)
+		}
+	}
+}
+
+func TestCompactVoteCountsShard(t *testing.T) {
+	stub := shimtest.NewMockStub("voting", new(VotingChaincode))
+	for _, shard := range []string{"-1", "16", "x"} {
+		if res := new(VotingChaincode).compactVoteCounts(stub, []string{"election.e", shard}); res.Status == shim.OK {
+			t.Errorf("expected shard %q to be refused", shard)
+		}
+	}
+}
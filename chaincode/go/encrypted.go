@@ -0,0 +1,558 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// Encrypted elections take ballots encrypted with exponential ElGamal to an
+// election public key, in the 2048-bit MODP group of RFC 3526 with generator 2.
+// A ballot holds one ciphertext (g^r, g^m * h^r) per candidate, in the order of
+// getEncryptionInfo, encrypting m = 1 for the chosen candidate and 0 for every
+// other one, with proofs that it does (see verifyBallot). Ballots are stored as
+// secret ballots, under random keys that do not lead to the voter (see
+// secret.go). The private key is Shamir-shared between trustees by whoever sets
+// up the election. Once the election ends the ballots are multiplied into one
+// ciphertext per candidate, encrypting its vote count, and each trustee
+// submits c1^x_i for those sums only; once the threshold is reached the shares
+// are combined and the tally stored under result~<election>. No single ballot
+// is ever decrypted, and the chaincode never holds a key share, so running
+// totals stay hidden until then.
+//
+// The election records the public key share g^x_i of every trustee and the user
+// submitting for them, named by the voterID attribute the REST server gives
+// every identity it enrolls. A trustee computes their shares on their own
+// machine and submits once, as that user, proving every share c1^x_i with a
+// Chaum-Pedersen proof against g^x_i (see proofs.go), so a wrong share cannot
+// make the result decrypt to anything else.
+
+var (
+	groupP, _ = new(big.Int).SetString(
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+			"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+			"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+			"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF05"+
+			"98DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB"+
+			"9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B"+
+			"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF695581718"+
+			"3995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF", 16)
+	// order of the subgroup generated by groupG
+	groupQ = new(big.Int).Rsh(groupP, 1)
+	groupG = big.NewInt(2)
+)
+
+type encryptionSettings struct {
+	// PublicKey is g^x in hex
+	PublicKey string `json:"publicKey"`
+	// Threshold is how many trustee shares decrypt the result
+	Threshold int `json:"threshold"`
+	Trustees  int `json:"trustees"`
+	// TrusteeKeys are the public key shares g^x_i in hex, TrusteeIDs the
+	// voter IDs of the users submitting the decryption shares, both by
+	// trustee index
+	TrusteeKeys []string `json:"trusteeKeys"`
+	TrusteeIDs  []string `json:"trusteeIDs"`
+}
+
+// decryptionShare is the share c1^x_i of a trustee for a sum of ballots, with
+// the proof that log_g(g^x_i) = log_c1(c1^x_i)
+type decryptionShare struct {
+	Share string    `json:"share"`
+	Proof dleqProof `json:"proof"`
+}
+
+type ciphertext struct {
+	C1 string `json:"c1"`
+	C2 string `json:"c2"`
+}
+
+// encryptedBallot is a ciphertext trustees decrypt, the sum of the votes of
+// the candidate Key
+type encryptedBallot struct {
+	Key string `json:"key"`
+	ciphertext
+}
+
+// provenBallot is a ballot of an encrypted or homomorphic election as the
+// voter submits it, the ciphertexts with the proofs of each one and of their sum
+type provenBallot struct {
+	Choices  []json.RawMessage `json:"choices"`
+	Proofs   []zeroOneProof    `json:"proofs"`
+	SumProof dleqProof         `json:"sumProof"`
+}
+
+type encryptionInfo struct {
+	encryptionSettings
+	// Candidates in the order of the ciphertexts of a ballot
+	Candidates []string `json:"candidates"`
+}
+
+// parseGroupElement reads a hex encoded element of the MODP group
+func parseGroupElement(value string) (*big.Int, error) {
+	n, ok := new(big.Int).SetString(value, 16)
+	if !ok || n.Cmp(big.NewInt(1)) <= 0 || n.Cmp(groupP) >= 0 {
+		return nil, fmt.Errorf("invalid group element")
+	}
+	// the subgroup generated by g holds the quadratic residues, proofs about
+	// elements outside it do not hold
+	if big.Jacobi(n, groupP) != 1 {
+		return nil, fmt.Errorf("invalid group element")
+	}
+	return n, nil
+}
+
+func parseCiphertext(value []byte) (*big.Int, *big.Int, error) {
+	var ct ciphertext
+	if err := json.Unmarshal(value, &ct); err != nil {
+		return nil, nil, err
+	}
+	c1, err := parseGroupElement(ct.C1)
+	if err != nil {
+		return nil, nil, err
+	}
+	c2, err := parseGroupElement(ct.C2)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c1, c2, nil
+}
+
+func (s *encryptionSettings) validate() error {
+	publicKey, err := parseGroupElement(s.PublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key")
+	}
+	if s.Threshold < 1 || s.Threshold > s.Trustees {
+		return fmt.Errorf("threshold must be between 1 and the number of trustees")
+	}
+	if len(s.TrusteeKeys) != s.Trustees || len(s.TrusteeIDs) != s.Trustees {
+		return fmt.Errorf("every trustee needs a public key share and a user ID")
+	}
+	seen := make(map[string]bool)
+	for _, id := range s.TrusteeIDs {
+		if id == "" || seen[id] {
+			return fmt.Errorf("trustee user IDs must be set and distinct")
+		}
+		seen[id] = true
+	}
+	keys := make([]*big.Int, s.Trustees)
+	for i, key := range s.TrusteeKeys {
+		if keys[i], err = parseGroupElement(key); err != nil {
+			return fmt.Errorf("invalid public key share of trustee %d", i+1)
+		}
+	}
+
+	// the shares lie on one polynomial of degree threshold-1 whose value at
+	// zero is the public key: the first threshold trustees interpolate the
+	// public key and every other trustee's share
+	quorum := make([]int, s.Threshold)
+	for j := range quorum {
+		quorum[j] = j + 1
+	}
+	interpolate := func(x int) *big.Int {
+		y := big.NewInt(1)
+		for j, lambda := range lagrangeAt(quorum, x) {
+			y.Mul(y, new(big.Int).Exp(keys[j], lambda, groupP)).Mod(y, groupP)
+		}
+		return y
+	}
+	if interpolate(0).Cmp(publicKey) != 0 {
+		return fmt.Errorf("public key shares do not match the public key")
+	}
+	for i := s.Threshold + 1; i <= s.Trustees; i++ {
+		if interpolate(i).Cmp(keys[i-1]) != 0 {
+			return fmt.Errorf("public key share of trustee %d does not match the others", i)
+		}
+	}
+	return nil
+}
+
+// vote with an encrypted ballot
+// args: voterID, JSON ballot {"choices":[{"c1","c2"}],"proofs":[{"e0","f0","e1","f1"}],"sumProof":{"e","f"}}
+// with a ciphertext and proof per candidate, electionID
+func (t *VotingChaincode) voteEncrypted(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	e, err := getEncryptedElection(stub, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	vector, _, err := verifyBallot(stub, e, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ballot, _ := json.Marshal(vector)
+
+	return t.castBallot(stub, args[0], e.ElectionID, ballotEncrypted, []string{string(ballot)})
+}
+
+// verifyBallot checks a ballot holds a ciphertext per candidate, each proven
+// to encrypt 0 or 1, and with a Chaum-Pedersen proof that their product
+// encrypts g^1, that it chooses exactly one candidate. It returns the
+// ciphertexts in one canonical form with the sorted candidates they are for.
+func verifyBallot(stub shim.ChaincodeStubInterface, e election, value string) ([]ciphertext, []string, error) {
+	electionID := e.ElectionID
+	var submitted provenBallot
+	if err := json.Unmarshal([]byte(value), &submitted); err != nil {
+		return nil, nil, fmt.Errorf("Invalid encrypted ballot")
+	}
+	candidates, err := getElectionCandidateIDs(stub, electionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(candidates)
+	if len(submitted.Choices) != len(candidates) || len(submitted.Proofs) != len(candidates) {
+		return nil, nil, fmt.Errorf("ballot must hold %d ciphertexts and proofs, one per candidate", len(candidates))
+	}
+	h, err := parseGroupElement(e.Encryption.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid election public key")
+	}
+
+	vector := make([]ciphertext, len(candidates))
+	product := [2]*big.Int{big.NewInt(1), big.NewInt(1)}
+	for i, r := range submitted.Choices {
+		c1, c2, err := parseCiphertext(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid encrypted ballot")
+		}
+		if !verifyZeroOne(electionID, h, c1, c2, submitted.Proofs[i]) {
+			return nil, nil, fmt.Errorf("invalid proof that ciphertext %d encrypts 0 or 1", i+1)
+		}
+		product[0].Mul(product[0], c1).Mod(product[0], groupP)
+		product[1].Mul(product[1], c2).Mod(product[1], groupP)
+		vector[i] = ciphertext{C1: c1.Text(16), C2: c2.Text(16)}
+	}
+	// the product encrypts g^1: (g^R, g * h^R)
+	y := product[1].Mul(product[1], new(big.Int).ModInverse(groupG, groupP))
+	if !verifyDLEQ(electionID, groupG, product[0], h, y.Mod(y, groupP), submitted.SumProof) {
+		return nil, nil, fmt.Errorf("invalid proof that the ballot chooses one candidate")
+	}
+	return vector, candidates, nil
+}
+
+// getEncryptionInfo returns what a client needs to encrypt a ballot
+func (t *VotingChaincode) getEncryptionInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	e, err := getEncryptedElection(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	candidates, err := getElectionCandidateIDs(stub, e.ElectionID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	sort.Strings(candidates)
+
+	response, _ := json.Marshal(encryptionInfo{*e.Encryption, candidates})
+	return shim.Success(response)
+}
+
+// getEncryptedBallots lists the ciphertexts trustees compute their shares for,
+// the sum of the ballots of every candidate keyed by candidate ID
+func (t *VotingChaincode) getEncryptedBallots(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	e, err := getEncryptedElection(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	sums, _, err := decryptionTargets(stub, e)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	response, _ := json.Marshal(sums)
+	return shim.Success(response)
+}
+
+// submitDecryptionShare records the decryption shares of one trustee, a JSON
+// object mapping the candidate of every sum of getEncryptedBallots to c1^x_i
+// in hex and its proof. Only the user recorded for the trustee submits, once.
+// The share completing the threshold decrypts the sums and publishes the result.
+// args: electionID, trustee index (1-based), shares
+func (t *VotingChaincode) submitDecryptionShare(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	e, err := getEncryptedElection(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	electionID := e.ElectionID
+
+	// shares are only accepted once no more ballots can come in
+	ended, err := e.ended(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !ended {
+		return shim.Error("Election has not ended")
+	}
+
+	trustee, err := strconv.Atoi(args[1])
+	if err != nil || trustee < 1 || trustee > e.Encryption.Trustees {
+		return shim.Error("Invalid trustee index: " + args[1])
+	}
+	if len(e.Encryption.TrusteeKeys) != e.Encryption.Trustees || len(e.Encryption.TrusteeIDs) != e.Encryption.Trustees {
+		return shim.Error("election has no trustee keys to check shares against")
+	}
+	if err := requireTrustee(stub, e.Encryption.TrusteeIDs[trustee-1]); err != nil {
+		return shim.Error(err.Error())
+	}
+	trusteeKey, err := parseGroupElement(e.Encryption.TrusteeKeys[trustee-1])
+	if err != nil {
+		return shim.Error("invalid public key share of trustee " + args[1])
+	}
+
+	publishedAsBytes, err := getEntity(stub, resultObjectType, electionID)
+	if err != nil {
+		return shim.Error("Failed to get result")
+	}
+	if publishedAsBytes != nil {
+		return shim.Error("result has already been published")
+	}
+
+	existing, err := getDecryptionShares(stub, electionID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if _, ok := existing[trustee]; ok {
+		return shim.Error("trustee has already submitted a share")
+	}
+
+	sums, ballots, err := decryptionTargets(stub, e)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var submitted map[string]decryptionShare
+	if err := json.Unmarshal([]byte(args[2]), &submitted); err != nil {
+		return shim.Error("Failed to unmarshal shares")
+	}
+	shares := make(map[string]string, len(sums))
+	for _, b := range sums {
+		c1, err := parseGroupElement(b.C1)
+		if err != nil {
+			return shim.Error("invalid encrypted tally " + b.Key)
+		}
+		share, err := parseGroupElement(submitted[b.Key].Share)
+		if err != nil {
+			return shim.Error("missing or invalid share for " + b.Key)
+		}
+		if !verifyDLEQ(electionID, groupG, trusteeKey, c1, share, submitted[b.Key].Proof) {
+			return shim.Error("invalid proof of the share for " + b.Key)
+		}
+		shares[b.Key] = share.Text(16)
+	}
+
+	sharesAsBytes, _ := json.Marshal(shares)
+	shareKey, err := stub.CreateCompositeKey(shareObjectType, []string{electionID, strconv.Itoa(trustee)})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutState(shareKey, sharesAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	existing[trustee] = shares
+
+	if len(existing) < e.Encryption.Threshold {
+		return shim.Success([]byte(fmt.Sprintf(`{"shares":%d,"threshold":%d,"published":false}`, len(existing), e.Encryption.Threshold)))
+	}
+
+	candidates, err := getElectionCandidateIDs(stub, electionID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	sort.Strings(candidates)
+
+	result, err := decryptSums(sums, ballots, existing, e.Encryption.Threshold, candidates)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	resultAsBytes, _ := json.Marshal(result)
+	if err := putEntity(stub, resultObjectType, electionID, resultAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(fmt.Sprintf(`{"shares":%d,"threshold":%d,"published":true}`, len(existing), e.Encryption.Threshold)))
+}
+
+// decryptSums decrypts the sum of every candidate with the shares of the first
+// threshold trustees (by index). A sum holds at most one vote per ballot,
+// which bounds the search for its count.
+func decryptSums(sums []encryptedBallot, ballots int, shares map[int]map[string]string, threshold int, candidates []string) (map[string]int, error) {
+	trustees, lambdas := quorum(shares, threshold)
+
+	result := make(map[string]int)
+	for _, c := range candidates {
+		result[c] = 0
+	}
+	for _, sum := range sums {
+		m, err := combineShares(sum, shares, trustees, lambdas)
+		if err != nil {
+			return nil, err
+		}
+		count, ok := discreteLog(m, ballots)
+		if !ok {
+			return nil, fmt.Errorf("encrypted tally %s does not decrypt to a vote count", sum.Key)
+		}
+		result[sum.Key] = count
+	}
+	return result, nil
+}
+
+// quorum picks the first threshold trustees by index that submitted shares
+// and returns them with their Lagrange coefficients
+func quorum(shares map[int]map[string]string, threshold int) ([]int, []*big.Int) {
+	var trustees []int
+	for i := range shares {
+		trustees = append(trustees, i)
+	}
+	sort.Ints(trustees)
+	trustees = trustees[:threshold]
+	return trustees, lagrangeAtZero(trustees)
+}
+
+// combineShares decrypts a ciphertext to g^m from the quorum's shares, using
+// c1^x = prod d_i^lambda_i
+func combineShares(b encryptedBallot, shares map[int]map[string]string, trustees []int, lambdas []*big.Int) (*big.Int, error) {
+	c2, err := parseGroupElement(b.C2)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ballot %s", b.Key)
+	}
+	cx := big.NewInt(1)
+	for j, i := range trustees {
+		d, err := parseGroupElement(shares[i][b.Key])
+		if err != nil {
+			return nil, fmt.Errorf("invalid share of trustee %d for %s", i, b.Key)
+		}
+		cx.Mod(cx.Mul(cx, new(big.Int).Exp(d, lambdas[j], groupP)), groupP)
+	}
+	m := new(big.Int).Mul(c2, new(big.Int).ModInverse(cx, groupP))
+	return m.Mod(m, groupP), nil
+}
+
+// lagrangeAtZero returns the Lagrange coefficients, mod q, that interpolate
+// the shared secret at zero from the shares of the given trustees
+func lagrangeAtZero(trustees []int) []*big.Int {
+	return lagrangeAt(trustees, 0)
+}
+
+// lagrangeAt returns the Lagrange coefficients, mod q, that interpolate the
+// sharing polynomial at x from the shares of the given trustees
+func lagrangeAt(trustees []int, x int) []*big.Int {
+	lambdas := make([]*big.Int, len(trustees))
+	for j, i := range trustees {
+		num, den := big.NewInt(1), big.NewInt(1)
+		for _, k := range trustees {
+			if k == i {
+				continue
+			}
+			num.Mul(num, big.NewInt(int64(k-x)))
+			den.Mul(den, big.NewInt(int64(k-i)))
+		}
+		num.Mod(num, groupQ)
+		den.Mod(den, groupQ)
+		lambdas[j] = num.Mul(num, den.ModInverse(den, groupQ)).Mod(num, groupQ)
+	}
+	return lambdas
+}
+
+// getEncryptedElection loads an election and checks it takes encrypted ballots
+func getEncryptedElection(stub shim.ChaincodeStubInterface, electionID string) (election, error) {
+	if !strings.HasPrefix(electionID, "election.") {
+		electionID = "election." + electionID
+	}
+	e := election{}
+	electionAsBytes, err := getEntity(stub, electionObjectType, electionID)
+	if err != nil {
+		return e, fmt.Errorf("Failed to get election: %s", electionID)
+	}
+	if electionAsBytes == nil {
+		return e, fmt.Errorf("election not found")
+	}
+	if err := json.Unmarshal(electionAsBytes, &e); err != nil {
+		return e, fmt.Errorf("Failed to unmarshal the election")
+	}
+	if (e.ballotType() != ballotEncrypted && e.ballotType() != ballotHomomorphic) || e.Encryption == nil {
+		return e, fmt.Errorf("election does not take encrypted ballots")
+	}
+	e.ElectionID = electionID
+	return e, nil
+}
+
+// decryptionTargets returns the sum of every candidate's votes, keyed by
+// candidate ID, with the number of ballots they hold
+func decryptionTargets(stub shim.ChaincodeStubInterface, e election) ([]encryptedBallot, int, error) {
+	if e.ballotType() == ballotHomomorphic {
+		return getEncryptedSums(stub, e.ElectionID)
+	}
+	return getBallotSums(stub, e.ElectionID)
+}
+
+// getBallotSums multiplies the ballots of an encrypted election into the sum
+// of every candidate's votes
+func getBallotSums(stub shim.ChaincodeStubInterface, electionID string) ([]encryptedBallot, int, error) {
+	candidates, err := getElectionCandidateIDs(stub, electionID)
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Strings(candidates)
+
+	var sums []ciphertext
+	ballots := 0
+	err = scanCompositeKeys(stub, ballotObjectType, []string{electionID}, func(attributes []string, value []byte) error {
+		var vector []ciphertext
+		if err := json.Unmarshal(value, &vector); err != nil || len(vector) != len(candidates) {
+			return fmt.Errorf("failed to decode ballot %s", strings.Join(attributes, "/"))
+		}
+		if sums == nil {
+			sums = vector
+		} else {
+			for i := range sums {
+				sums[i] = multiplyCiphertexts(sums[i], vector[i])
+			}
+		}
+		ballots++
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	result := make([]encryptedBallot, len(sums))
+	for i, sum := range sums {
+		result[i] = encryptedBallot{Key: candidates[i], ciphertext: sum}
+	}
+	return result, ballots, nil
+}
+
+// getDecryptionShares returns the shares submitted so far by trustee index
+func getDecryptionShares(stub shim.ChaincodeStubInterface, electionID string) (map[int]map[string]string, error) {
+	shares := make(map[int]map[string]string)
+	err := scanCompositeKeys(stub, shareObjectType, []string{electionID}, func(attributes []string, value []byte) error {
+		trustee, err := strconv.Atoi(attributes[1])
+		if err != nil {
+			return nil
+		}
+		var s map[string]string
+		if err := json.Unmarshal(value, &s); err != nil {
+			return fmt.Errorf("failed to decode shares of trustee %d: %w", trustee, err)
+		}
+		shares[trustee] = s
+		return nil
+	})
+	return shares, err
+}
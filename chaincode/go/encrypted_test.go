@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// proveDLEQ proves log_g1(y1) = log_g2(y2) = x the way the ballot package of
+// the REST server does
+func proveDLEQ(t *testing.T, context string, x, g1, y1, g2, y2 *big.Int) dleqProof {
+	t.Helper()
+	w, err := rand.Int(rand.Reader, groupQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := new(big.Int).Exp(g1, w, groupP)
+	b := new(big.Int).Exp(g2, w, groupP)
+	e := challenge("dleq", context, g1, y1, g2, y2, a, b)
+	f := new(big.Int).Mul(e, x)
+	f.Add(f, w).Mod(f, groupQ)
+	return dleqProof{E: e.Text(16), F: f.Text(16)}
+}
+
+// shareKey splits a random election key between trustees, returning the
+// encryption settings and the secret share of every trustee by index
+func shareKey(t *testing.T, threshold int, trusteeIDs ...string) (encryptionSettings, map[int]*big.Int) {
+	t.Helper()
+	coefficients := make([]*big.Int, threshold)
+	for i := range coefficients {
+		c, err := rand.Int(rand.Reader, groupQ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		coefficients[i] = c
+	}
+	settings := encryptionSettings{
+		PublicKey:  new(big.Int).Exp(groupG, coefficients[0], groupP).Text(16),
+		Threshold:  threshold,
+		Trustees:   len(trusteeIDs),
+		TrusteeIDs: trusteeIDs,
+	}
+	secrets := make(map[int]*big.Int)
+	for i := 1; i <= len(trusteeIDs); i++ {
+		y := new(big.Int)
+		for j := len(coefficients) - 1; j >= 0; j-- {
+			y.Mul(y, big.NewInt(int64(i))).Add(y, coefficients[j]).Mod(y, groupQ)
+		}
+		secrets[i] = y
+		settings.TrusteeKeys = append(settings.TrusteeKeys, new(big.Int).Exp(groupG, y, groupP).Text(16))
+	}
+	return settings, secrets
+}
+
+// encryptVote returns (g^r, g^m * h^r) and r
+func encryptVote(t *testing.T, publicKey string, m int) (ciphertext, *big.Int) {
+	t.Helper()
+	h, err := parseGroupElement(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := rand.Int(rand.Reader, groupQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := new(big.Int).Exp(groupG, big.NewInt(int64(m)), groupP)
+	c2.Mul(c2, new(big.Int).Exp(h, r, groupP)).Mod(c2, groupP)
+	return ciphertext{C1: new(big.Int).Exp(groupG, r, groupP).Text(16), C2: c2.Text(16)}, r
+}
+
+// decryptionShares computes a trustee's proven shares for the ciphertexts
+func decryptionShares(t *testing.T, electionID string, x *big.Int, ballots []encryptedBallot) map[string]decryptionShare {
+	t.Helper()
+	shares := make(map[string]decryptionShare)
+	for _, b := range ballots {
+		c1, _ := parseGroupElement(b.C1)
+		d := new(big.Int).Exp(c1, x, groupP)
+		proof := proveDLEQ(t, electionID, x, groupG, new(big.Int).Exp(groupG, x, groupP), c1, d)
+		shares[b.Key] = decryptionShare{Share: d.Text(16), Proof: proof}
+	}
+	return shares
+}
+
+func TestLagrangeAt(t *testing.T) {
+	// f(x) = 7 + 3x + 5x^2
+	f := func(x int) *big.Int { return big.NewInt(int64(7 + 3*x + 5*x*x)) }
+	for _, test := range []struct {
+		trustees []int
+		x        int
+	}{
+		{[]int{1, 2, 3}, 0},
+		{[]int{1, 3, 5}, 0},
+		{[]int{2, 4, 5}, 0},
+		{[]int{1, 2, 3}, 4},
+		{[]int{3, 4, 5}, 1},
+	} {
+		y := new(big.Int)
+		for j, lambda := range lagrangeAt(test.trustees, test.x) {
+			y.Add(y, new(big.Int).Mul(lambda, f(test.trustees[j])))
+		}
+		if y.Mod(y, groupQ).Cmp(f(test.x)) != 0 {
+			t.Errorf("trustees %v at %d: expected %v, got %v", test.trustees, test.x, f(test.x), y)
+		}
+	}
+	if lambdas := lagrangeAtZero([]int{4}); lambdas[0].Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("expected a single trustee to interpolate with 1, got %v", lambdas[0])
+	}
+}
+
+func TestCombineShares(t *testing.T) {
+	settings, secrets := shareKey(t, 2, "a", "b", "c")
+	c, _ := encryptVote(t, settings.PublicKey, 3)
+	b := encryptedBallot{Key: "k", ciphertext: c}
+	c1, _ := parseGroupElement(c.C1)
+	shares := make(map[int]map[string]string)
+	for i, x := range secrets {
+		shares[i] = map[string]string{"k": new(big.Int).Exp(c1, x, groupP).Text(16)}
+	}
+	g3 := big.NewInt(8)
+
+	for _, test := range []struct {
+		trustees []int
+		decrypts bool
+	}{
+		{[]int{1, 2}, true},
+		{[]int{1, 3}, true},
+		{[]int{2, 3}, true},
+		{[]int{1, 2, 3}, true},
+		{[]int{2}, false},
+	} {
+		m, err := combineShares(b, shares, test.trustees, lagrangeAtZero(test.trustees))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (m.Cmp(g3) == 0) != test.decrypts {
+			t.Errorf("trustees %v: expected decryption %v, got g^m = %v", test.trustees, test.decrypts, m)
+		}
+	}
+
+	shares[1]["k"] = "1"
+	if _, err := combineShares(b, shares, []int{1, 2}, lagrangeAtZero([]int{1, 2})); err == nil {
+		t.Error("expected an invalid share to be refused")
+	}
+}
+
+func TestEncryptionSettings(t *testing.T) {
+	settings, _ := shareKey(t, 2, "a", "b", "c")
+	other, _ := shareKey(t, 2, "a", "b", "c")
+	for name, test := range map[string]struct {
+		change func(s *encryptionSettings)
+		valid  bool
+	}{
+		"valid":            {func(s *encryptionSettings) {}, true},
+		"missing keys":     {func(s *encryptionSettings) { s.TrusteeKeys = nil }, false},
+		"missing IDs":      {func(s *encryptionSettings) { s.TrusteeIDs = s.TrusteeIDs[:2] }, false},
+		"duplicate IDs":    {func(s *encryptionSettings) { s.TrusteeIDs = []string{"a", "b", "a"} }, false},
+		"empty ID":         {func(s *encryptionSettings) { s.TrusteeIDs = []string{"a", "", "c"} }, false},
+		"other public key": {func(s *encryptionSettings) { s.PublicKey = other.PublicKey }, false},
+		"other trustee key": {func(s *encryptionSettings) {
+			s.TrusteeKeys = []string{s.TrusteeKeys[0], s.TrusteeKeys[1], other.TrusteeKeys[2]}
+		}, false},
+		// p-1 has order 2, outside the subgroup of g
+		"outside subgroup": {func(s *encryptionSettings) { s.PublicKey = new(big.Int).Sub(groupP, big.NewInt(1)).Text(16) }, false},
+		"threshold":        {func(s *encryptionSettings) { s.Threshold = 4 }, false},
+	} {
+		s := settings
+		s.TrusteeKeys = append([]string{}, settings.TrusteeKeys...)
+		s.TrusteeIDs = append([]string{}, settings.TrusteeIDs...)
+		test.change(&s)
+		if err := s.validate(); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", name, test.valid, err)
+		}
+	}
+}
+
+func TestSubmitDecryptionShare(t *testing.T) {
+	stub := newStub(t)
+	admin := stub.Creator
+	settings, secrets := shareKey(t, 2, "voter.t1", "voter.t2", "voter.t3")
+	settingsJSON, _ := json.Marshal(settings)
+	electionID := mustInvoke(t, stub, "createElection", "e", "2020-01-01", "2099-01-01", ballotEncrypted, "", "", "", string(settingsJSON))
+	mustInvoke(t, stub, "createCandidate", "Alice", "alice", electionID)
+	mustInvoke(t, stub, "createCandidate", "Bob", "bob", electionID)
+	mustInvoke(t, stub, "openElection", electionID)
+	// candidate.alice sorts first, candidate.bob second
+	for i, plaintexts := range [][]int{{1, 0}, {0, 1}, {0, 1}} {
+		voterID := "voter." + strconv.Itoa(i)
+		stub.Creator = admin
+		mustInvoke(t, stub, "createVoter", strconv.Itoa(i))
+		ballot, _ := json.Marshal(encryptChoices(t, electionID, settings.PublicKey, plaintexts...))
+		stub.Creator = identity(t, map[string]string{roleAttribute: roleVoter, voterIDAttribute: voterID})
+		mustInvoke(t, stub, "voteEncrypted", voterID, string(ballot), electionID)
+	}
+	stub.Creator = admin
+	// a ballot choosing no one is refused like on homomorphic elections
+	mustInvoke(t, stub, "createVoter", "3")
+	ballot, _ := json.Marshal(encryptChoices(t, electionID, settings.PublicKey, 0, 0))
+	stub.Creator = identity(t, map[string]string{roleAttribute: roleVoter, voterIDAttribute: "voter.3"})
+	if res := invoke(stub, "voteEncrypted", "voter.3", string(ballot), electionID); res.Message != "invalid proof that the ballot chooses one candidate" {
+		t.Errorf("expected a ballot without choice to be refused, got %q", res.Message)
+	}
+	stub.Creator = admin
+	mustInvoke(t, stub, "closeElection", electionID)
+
+	// no ballot is stored under its voter
+	for key := range stub.State {
+		if strings.HasPrefix(key, "\x00"+recordObjectType+"\x00"+electionID) {
+			t.Errorf("expected no ballot keyed by voter, got %q", key)
+		}
+	}
+
+	// the ciphertexts are not for voters to collect
+	stub.Creator = identity(t, map[string]string{roleAttribute: roleVoter, voterIDAttribute: "voter.0"})
+	if res := invoke(stub, "getEncryptedBallots", electionID); res.Status == shim.OK {
+		t.Error("expected a voter to be refused the ciphertexts")
+	}
+	stub.Creator = admin
+	// trustees decrypt the sum of every candidate only
+	var ballots []encryptedBallot
+	if err := json.Unmarshal([]byte(mustInvoke(t, stub, "getEncryptedBallots", electionID)), &ballots); err != nil {
+		t.Fatal(err)
+	}
+	if len(ballots) != 2 || ballots[0].Key != "candidate.alice" || ballots[1].Key != "candidate.bob" {
+		t.Fatalf("expected a sum per candidate, got %+v", ballots)
+	}
+	submit := func(trustee int, shares map[string]decryptionShare) (string, string) {
+		sharesJSON, _ := json.Marshal(shares)
+		stub.Creator = identity(t, map[string]string{roleAttribute: roleOfficer, voterIDAttribute: "t" + strconv.Itoa(trustee), electionsAttribute: electionID})
+		defer func() { stub.Creator = admin }()
+		res := invoke(stub, "submitDecryptionShare", electionID, strconv.Itoa(trustee), string(sharesJSON))
+		if res.Status != shim.OK {
+			return "", res.Message
+		}
+		return string(res.Payload), ""
+	}
+
+	// only the user recorded for a trustee submits their shares
+	sharesJSON, _ := json.Marshal(decryptionShares(t, electionID, secrets[1], ballots))
+	for _, creator := range [][]byte{
+		admin,
+		identity(t, map[string]string{roleAttribute: roleOfficer, voterIDAttribute: "t2", electionsAttribute: electionID}),
+	} {
+		stub.Creator = creator
+		if res := invoke(stub, "submitDecryptionShare", electionID, "1", string(sharesJSON)); !strings.HasPrefix(res.Message, "submitter is not the trustee") {
+			t.Errorf("expected a submitter who is not the trustee to be refused, got %q", res.Message)
+		}
+	}
+	stub.Creator = admin
+
+	// shares computed with another key, or proven for another election, are refused
+	if _, message := submit(1, decryptionShares(t, electionID, secrets[2], ballots)); !strings.HasPrefix(message, "invalid proof") {
+		t.Error("expected shares of another trustee's key to be refused")
+	}
+	if _, message := submit(1, decryptionShares(t, "election.other", secrets[1], ballots)); !strings.HasPrefix(message, "invalid proof") {
+		t.Error("expected proofs for another election to be refused")
+	}
+	forged := decryptionShares(t, electionID, secrets[1], ballots)
+	for key, share := range forged {
+		d, _ := parseGroupElement(share.Share)
+		share.Share = d.Mul(d, big.NewInt(4)).Mod(d, groupP).Text(16)
+		forged[key] = share
+		break
+	}
+	if _, message := submit(1, forged); !strings.HasPrefix(message, "invalid proof") {
+		t.Error("expected a share that does not match its proof to be refused")
+	}
+
+	if payload, message := submit(1, decryptionShares(t, electionID, secrets[1], ballots)); message != "" || payload != `{"shares":1,"threshold":2,"published":false}` {
+		t.Fatalf("unexpected first share %s %s", payload, message)
+	}
+	// a trustee submits once
+	if _, message := submit(1, decryptionShares(t, electionID, secrets[1], ballots)); message != "trustee has already submitted a share" {
+		t.Errorf("expected a second submission to be refused, got %q", message)
+	}
+	if payload, message := submit(3, decryptionShares(t, electionID, secrets[3], ballots)); message != "" || payload != `{"shares":2,"threshold":2,"published":true}` {
+		t.Fatalf("unexpected second share %s %s", payload, message)
+	}
+
+	var result map[string]int
+	if err := json.Unmarshal([]byte(mustInvoke(t, stub, "getFinalResult", electionID)), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || result["candidate.alice"] != 1 || result["candidate.bob"] != 2 {
+		t.Errorf("unexpected result %v", result)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// Homomorphic elections use the keys, trustees and ballots of encrypted
+// elections (see encrypted.go), but rather than multiplying the ballots once the
+// election ends each vote multiplies its ciphertexts into a running sum per
+// candidate as it is cast. Like the vote counters in counters.go the sums are
+// split over shards, enctally~<election>~<shard>~<candidate>, so only votes
+// landing in the same shard contend for the same keys. The shards are
+// multiplied together when read, and closing the election needs one
+// decryption per candidate, recovering the count from g^count with a
+// baby-step giant-step search.
+//
+// The proofs of a ballot bound the sums by the number of ballots, which bounds
+// the discrete logarithm search. Every vote rewrites the sums of its shard, so
+// votes of the same shard committed in one block still conflict with each other.
+
+// encryptedSum is the running product of the ciphertexts cast for a candidate
+type encryptedSum struct {
+	ciphertext
+	Ballots int `json:"ballots"`
+}
+
+// vote with a homomorphic ballot
+// args: voterID, JSON ballot {"choices":[{"c1","c2"}],"proofs":[{"e0","f0","e1","f1"}],"sumProof":{"e","f"}}
+// with a ciphertext and proof per candidate, electionID
+func (t *VotingChaincode) voteHomomorphic(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	e, err := getEncryptedElection(stub, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	electionID := e.ElectionID
+	vector, candidates, err := verifyBallot(stub, e, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ballot, _ := json.Marshal(vector)
+
+	res := t.castBallot(stub, args[0], electionID, ballotHomomorphic, []string{string(ballot)})
+	if res.Status != shim.OK {
+		return res
+	}
+
+	shard := voteShard(stub.GetTxID())
+	for i, candidateID := range candidates {
+		key, err := stub.CreateCompositeKey(encryptedSumObjectType, []string{electionID, shard, candidateID})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		sumAsBytes, err := stub.GetState(key)
+		if err != nil {
+			return shim.Error("Failed to get encrypted tally")
+		}
+		sum := encryptedSum{ciphertext: ciphertext{C1: "1", C2: "1"}}
+		if sumAsBytes != nil {
+			if err := json.Unmarshal(sumAsBytes, &sum); err != nil {
+				return shim.Error("Failed to unmarshal encrypted tally")
+			}
+		}
+
+		sum.ciphertext = multiplyCiphertexts(sum.ciphertext, vector[i])
+		sum.Ballots++
+		sumAsBytes, _ = json.Marshal(sum)
+		if err := stub.PutState(key, sumAsBytes); err != nil {
+			fmt.Println("failed to put encrypted tally", err.Error())
+			return shim.Error("failed to commit to network")
+		}
+	}
+
+	return res
+}
+
+const encryptedSumObjectType = "enctally"
+
+// multiplyCiphertexts returns a ciphertext of the sum of both plaintexts
+func multiplyCiphertexts(a, b ciphertext) ciphertext {
+	product := func(x, y string) string {
+		n, _ := new(big.Int).SetString(x, 16)
+		m, _ := new(big.Int).SetString(y, 16)
+		return n.Mul(n, m).Mod(n, groupP).Text(16)
+	}
+	return ciphertext{C1: product(a.C1, b.C1), C2: product(a.C2, b.C2)}
+}
+
+// getEncryptedSums multiplies the shards of every candidate into its running
+// sum, keyed by candidate ID, and returns them with the number of ballots they hold
+func getEncryptedSums(stub shim.ChaincodeStubInterface, electionID string) ([]encryptedBallot, int, error) {
+	sums := make(map[string]encryptedSum)
+	err := scanCompositeKeys(stub, encryptedSumObjectType, []string{electionID}, func(attributes []string, value []byte) error {
+		var shard encryptedSum
+		if err := json.Unmarshal(value, &shard); err != nil || len(attributes) < 3 {
+			return fmt.Errorf("failed to decode encrypted tally %s", strings.Join(attributes, "/"))
+		}
+		candidateID := attributes[2]
+		if sum, ok := sums[candidateID]; ok {
+			shard.ciphertext = multiplyCiphertexts(sum.ciphertext, shard.ciphertext)
+			shard.Ballots += sum.Ballots
+		}
+		sums[candidateID] = shard
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	candidates := make([]string, 0, len(sums))
+	for c := range sums {
+		candidates = append(candidates, c)
+	}
+	sort.Strings(candidates)
+
+	result := make([]encryptedBallot, len(candidates))
+	ballots := 0
+	for i, c := range candidates {
+		result[i] = encryptedBallot{Key: c, ciphertext: sums[c].ciphertext}
+		if sums[c].Ballots > ballots {
+			ballots = sums[c].Ballots
+		}
+	}
+	return result, ballots, nil
+}
+
+// discreteLog finds k in [0, max] with g^k = m using baby-step giant-step
+func discreteLog(m *big.Int, max int) (int, bool) {
+	steps := 1
+	for steps*steps <= max {
+		steps++
+	}
+
+	// baby steps g^j
+	table := make(map[string]int, steps)
+	acc := big.NewInt(1)
+	for j := 0; j < steps; j++ {
+		table[acc.Text(16)] = j
+		acc = new(big.Int).Mod(new(big.Int).Mul(acc, groupG), groupP)
+	}
+
+	// giant steps m * g^(-steps*i)
+	factor := new(big.Int).ModInverse(new(big.Int).Exp(groupG, big.NewInt(int64(steps)), groupP), groupP)
+	gamma := new(big.Int).Set(m)
+	for i := 0; i <= steps; i++ {
+		if j, ok := table[gamma.Text(16)]; ok {
+			if k := i*steps + j; k <= max {
+				return k, true
+			}
+			return 0, false
+		}
+		gamma.Mul(gamma, factor).Mod(gamma, groupP)
+	}
+	return 0, false
+}
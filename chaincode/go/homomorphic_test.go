@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// proveZeroOne proves (c1, c2) = (g^r, g^m * h^r) encrypts m, 0 or 1, the way
+// the ballot package of the REST server does
+func proveZeroOne(t *testing.T, context string, h, c1, c2, r *big.Int, m int) zeroOneProof {
+	t.Helper()
+	random := func() *big.Int {
+		n, err := rand.Int(rand.Reader, groupQ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	ys := make([]*big.Int, 2)
+	for k := range ys {
+		gk := new(big.Int).Exp(groupG, big.NewInt(int64(k)), groupP)
+		ys[k] = gk.Mul(c2, gk.ModInverse(gk, groupP)).Mod(gk, groupP)
+	}
+	es, fs := make([]*big.Int, 2), make([]*big.Int, 2)
+	commitments := make([]*big.Int, 4)
+	other := 1 - m
+	es[other], fs[other] = random(), random()
+	commitments[2*other] = commitment(groupG, c1, es[other], fs[other])
+	commitments[2*other+1] = commitment(h, ys[other], es[other], fs[other])
+	w := random()
+	commitments[2*m] = new(big.Int).Exp(groupG, w, groupP)
+	commitments[2*m+1] = new(big.Int).Exp(h, w, groupP)
+
+	e := challenge("zero-one", context, append([]*big.Int{h, c1, c2}, commitments...)...)
+	es[m] = e.Sub(e, es[other]).Mod(e, groupQ)
+	fs[m] = new(big.Int).Mul(es[m], r)
+	fs[m].Add(fs[m], w).Mod(fs[m], groupQ)
+	return zeroOneProof{E0: es[0].Text(16), F0: fs[0].Text(16), E1: es[1].Text(16), F1: fs[1].Text(16)}
+}
+
+// ballotArgument is the JSON ballot submitted to voteHomomorphic
+type ballotArgument struct {
+	Choices  []ciphertext   `json:"choices"`
+	Proofs   []zeroOneProof `json:"proofs"`
+	SumProof dleqProof      `json:"sumProof"`
+}
+
+// encryptChoices builds a proven ballot encrypting the plaintexts, which a
+// voter would choose as one 1 and 0 for the others
+func encryptChoices(t *testing.T, electionID, publicKey string, plaintexts ...int) ballotArgument {
+	t.Helper()
+	h, _ := parseGroupElement(publicKey)
+	var ballot ballotArgument
+	product := [2]*big.Int{big.NewInt(1), big.NewInt(1)}
+	randomness := new(big.Int)
+	for _, m := range plaintexts {
+		c, r := encryptVote(t, publicKey, m)
+		c1, _ := parseGroupElement(c.C1)
+		c2, _ := parseGroupElement(c.C2)
+		ballot.Choices = append(ballot.Choices, c)
+		// only 0 and 1 can be proven, others get the proof of 1 to be refused
+		ballot.Proofs = append(ballot.Proofs, proveZeroOne(t, electionID, h, c1, c2, r, m&1))
+		product[0].Mul(product[0], c1).Mod(product[0], groupP)
+		product[1].Mul(product[1], c2).Mod(product[1], groupP)
+		randomness.Add(randomness, r).Mod(randomness, groupQ)
+	}
+	y := product[1].Mul(product[1], new(big.Int).ModInverse(groupG, groupP))
+	ballot.SumProof = proveDLEQ(t, electionID, randomness, groupG, product[0], h, y.Mod(y, groupP))
+	return ballot
+}
+
+func TestDiscreteLog(t *testing.T) {
+	for _, test := range []struct {
+		k, max int
+		found  bool
+	}{
+		{0, 0, true},
+		{0, 10, true},
+		{1, 1, true},
+		{7, 10, true},
+		{10, 10, true},
+		{99, 100, true},
+		{100, 100, true},
+		{11, 10, false},
+		{101, 100, false},
+		{1000, 100, false},
+	} {
+		m := new(big.Int).Exp(groupG, big.NewInt(int64(test.k)), groupP)
+		k, found := discreteLog(m, test.max)
+		if found != test.found || (found && k != test.k) {
+			t.Errorf("g^%d up to %d: expected %v, got %d %v", test.k, test.max, test.found, k, found)
+		}
+	}
+}
+
+func TestVoteHomomorphic(t *testing.T) {
+	stub := newStub(t)
+	admin := stub.Creator
+	settings, secrets := shareKey(t, 1, "voter.t1")
+	settingsJSON, _ := json.Marshal(settings)
+	electionID := mustInvoke(t, stub, "createElection", "e", "2020-01-01", "2099-01-01", ballotHomomorphic, "", "", "", string(settingsJSON))
+	for _, name := range []string{"alice", "bob", "carol"} {
+		mustInvoke(t, stub, "createCandidate", name, name, electionID)
+	}
+	mustInvoke(t, stub, "openElection", electionID)
+
+	voter := 0
+	vote := func(ballot ballotArgument) string {
+		t.Helper()
+		voter++
+		voterID := "voter." + strconv.Itoa(voter)
+		stub.Creator = admin
+		mustInvoke(t, stub, "createVoter", strconv.Itoa(voter))
+		stub.Creator = identity(t, map[string]string{roleAttribute: roleVoter, voterIDAttribute: voterID})
+		defer func() { stub.Creator = admin }()
+		ballotJSON, _ := json.Marshal(ballot)
+		return invoke(stub, "voteHomomorphic", voterID, string(ballotJSON), electionID).Message
+	}
+
+	for name, test := range map[string]struct {
+		ballot ballotArgument
+		err    string
+	}{
+		"two votes for one candidate": {encryptChoices(t, electionID, settings.PublicKey, 2, 0, 0), "invalid proof that ciphertext 1"},
+		"votes for two candidates":    {encryptChoices(t, electionID, settings.PublicKey, 1, 1, 0), "invalid proof that the ballot chooses one candidate"},
+		"no vote":                     {encryptChoices(t, electionID, settings.PublicKey, 0, 0, 0), "invalid proof that the ballot chooses one candidate"},
+		"another election":            {encryptChoices(t, "election.other", settings.PublicKey, 0, 1, 0), "invalid proof that ciphertext 1"},
+		"missing candidate":           {encryptChoices(t, electionID, settings.PublicKey, 0, 1), "ballot must hold 3 ciphertexts"},
+	} {
+		if message := vote(test.ballot); !strings.HasPrefix(message, test.err) {
+			t.Errorf("%s: expected %q, got %q", name, test.err, message)
+		}
+	}
+
+	for _, plaintexts := range [][]int{{1, 0, 0}, {0, 0, 1}, {0, 0, 1}} {
+		if message := vote(encryptChoices(t, electionID, settings.PublicKey, plaintexts...)); message != "" {
+			t.Fatalf("expected the ballot %v to be cast, got %q", plaintexts, message)
+		}
+	}
+	mustInvoke(t, stub, "closeElection", electionID)
+
+	var sums []encryptedBallot
+	if err := json.Unmarshal([]byte(mustInvoke(t, stub, "getEncryptedBallots", electionID)), &sums); err != nil {
+		t.Fatal(err)
+	}
+	sharesJSON, _ := json.Marshal(decryptionShares(t, electionID, secrets[1], sums))
+	stub.Creator = identity(t, map[string]string{roleAttribute: roleOfficer, voterIDAttribute: "voter.t1", electionsAttribute: electionID})
+	mustInvoke(t, stub, "submitDecryptionShare", electionID, "1", string(sharesJSON))
+	stub.Creator = admin
+
+	var result map[string]int
+	if err := json.Unmarshal([]byte(mustInvoke(t, stub, "getFinalResult", electionID)), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result["candidate.alice"] != 1 || result["candidate.bob"] != 0 || result["candidate.carol"] != 2 {
+		t.Errorf("unexpected result %v", result)
+	}
+}
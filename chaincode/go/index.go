@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,10 +33,31 @@ type voterV2 struct {
 }
 
 type ElectionHistory struct {
-	ElectionID string `json:"electionID"`
-	VotedTo    string `json:"votedTo"`
+	ElectionID string   `json:"electionID"`
+	VotedTo    string   `json:"votedTo"`
+	Ranking    []string `json:"ranking,omitempty"`
+	Choices    []string `json:"choices,omitempty"`
+	Voted      bool     `json:"voted"`
+	// Nullifier proves participation in a secret ballot election, see secret.go
+	Nullifier string `json:"nullifier,omitempty"`
+}
+
+// entries written before Voted existed only carry the candidate
+func (h ElectionHistory) voted() bool {
+	return h.Voted || h.VotedTo != ""
 }
 
+// ballot types an election can be created with
+const (
+	ballotPlurality = "plurality"
+	ballotRanked    = "ranked"
+	ballotApproval  = "approval"
+	// single choice ballots encrypted to the election key, see encrypted.go
+	ballotEncrypted = "encrypted"
+	// one encrypted 0/1 per candidate, summed as votes come in, see homomorphic.go
+	ballotHomomorphic = "homomorphic"
+)
+
 type election struct {
 	ElectionID   string  `json:"electionID"`
 	ElectionName string  `json:"electionName"`
@@ -43,6 +65,42 @@ type election struct {
 	EndDate      string  `json:"endDate"`
 	CreatedAt    string  `json:"createdAt"`
 	UpdatedAt    *string `json:"updatedAt"`
+	BallotType   string  `json:"ballotType"`
+	// MaxChoices is how many candidates an approval ballot may pick
+	MaxChoices int `json:"maxChoices"`
+	// Seats is how many of the top candidates win the election
+	Seats int `json:"seats"`
+	// Status is the lifecycle state, see lifecycle.go
+	Status string `json:"status"`
+	// SecretBallot keeps the voter's choice out of their record and stores
+	// the ballot under a random key, see secret.go
+	SecretBallot bool `json:"secretBallot"`
+	// Encryption holds the election key of encrypted elections
+	Encryption *encryptionSettings `json:"encryption,omitempty"`
+	// LiveResults lets results be read while the election is still running
+	LiveResults bool `json:"liveResults"`
+}
+
+// elections stored before ballot types existed are plurality elections
+func (e election) ballotType() string {
+	if e.BallotType == "" {
+		return ballotPlurality
+	}
+	return e.BallotType
+}
+
+func (e election) maxChoices() int {
+	if e.MaxChoices < 1 {
+		return 1
+	}
+	return e.MaxChoices
+}
+
+func (e election) seats() int {
+	if e.Seats < 1 {
+		return 1
+	}
+	return e.Seats
 }
 
 func main() {
@@ -62,13 +120,51 @@ func (t *VotingChaincode) Init(_ shim.ChaincodeStubInterface) pb.Response {
 func (t *VotingChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
 
+	if roles, ok := functionRoles[function]; ok {
+		if err := requireRole(stub, roles...); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	// a missing argument is reported by the function itself
+	if i, ok := electionArgs[function]; ok && i < len(args) {
+		if err := requireElectionScope(stub, args[i]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
 	switch function {
 	case "initLedger":
 		return t.Init(stub)
+	case "ping":
+		return t.ping(stub)
 	case "getFinalResult":
 		return t.GetFinalResult(stub, args)
 	case "vote":
 		return t.voteV2(stub, args)
+	case "voteRanked":
+		return t.voteRanked(stub, args)
+	case "getRankedResult":
+		return t.getRankedResult(stub, args)
+	case "voteApproval":
+		return t.voteApproval(stub, args)
+	case "getSeatResult":
+		return t.getSeatResult(stub, args)
+	case "voteEncrypted":
+		return t.voteEncrypted(stub, args)
+	case "voteHomomorphic":
+		return t.voteHomomorphic(stub, args)
+	case "compactVoteCounts":
+		return t.compactVoteCounts(stub, args)
+	case "verifyReceipt":
+		return t.verifyReceipt(stub, args)
+	case "getEncryptionInfo":
+		return t.getEncryptionInfo(stub, args)
+	case "getEncryptedBallots":
+		return t.getEncryptedBallots(stub, args)
+	case "submitDecryptionShare":
+		return t.submitDecryptionShare(stub, args)
+	case "openElection", "closeElection", "tallyElection", "archiveElection":
+		return t.transitionElection(stub, function, args)
 	case "createElection":
 		return t.createElection(stub, args)
 	case "createVoter":
@@ -78,21 +174,35 @@ func (t *VotingChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	case "getElectionById":
 		return t.getElectionById(stub, args)
 	case "getAllElections":
-		return t.getAllElections(stub)
+		return t.getAllElections(stub, args)
 	case "updateElection":
 		return t.updateElection(stub, args)
+	case "queryVoters":
+		return t.queryVoters(stub, args)
+	case "queryCandidates":
+		return t.queryCandidates(stub, args)
 	case "getCandidatesById":
 		return t.getCandidatesById(stub, args)
 	case "getVoter":
 		return t.getVoter(stub, args)
-	case "queryByRange":
-		return t.queryByRange(stub, args)
+	case "migrateKeys":
+		return t.migrateKeys(stub, args)
+	case "getBallotRecords":
+		return t.getBallotRecords(stub, args)
+	case "setRoleChecks":
+		return t.setRoleChecks(stub, args)
 	default:
 		fmt.Println("invoke did not find func: " + function) //error
 		return shim.Error("Received unknown function invocation")
 	}
 }
 
+// ping answers without touching the ledger, so clients can check the
+// chaincode is reachable through a peer
+func (t *VotingChaincode) ping(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success([]byte("pong"))
+}
+
 // create voter function
 func (t *VotingChaincode) createVoter(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
@@ -106,7 +216,7 @@ func (t *VotingChaincode) createVoter(stub shim.ChaincodeStubInterface, args []s
 	var newVoter = voterV2{ID: voterID, ElectionHistory: nil}
 
 	// find voter in ledger
-	dupeVoterAsBytes, err := stub.GetState(voterID)
+	dupeVoterAsBytes, err := getEntity(stub, voterObjectType, voterID)
 	if err != nil {
 		return shim.Error("Failed to get voter: " + voterID)
 	}
@@ -120,7 +230,7 @@ func (t *VotingChaincode) createVoter(stub shim.ChaincodeStubInterface, args []s
 	}
 
 	newVoterAsBytes, _ := json.Marshal(newVoter)
-	err = stub.PutState(voterID, newVoterAsBytes)
+	err = putEntity(stub, voterObjectType, voterID, newVoterAsBytes)
 
 	if err != nil {
 		fmt.Println("Error creating voter")
@@ -141,16 +251,24 @@ func (t *VotingChaincode) getVoter(stub shim.ChaincodeStubInterface, args []stri
 		voterID = "voter." + args[0]
 	}
 	// find voter in ledger
-	dupeVoterAsBytes, err := stub.GetState(voterID)
+	dupeVoterAsBytes, err := getEntity(stub, voterObjectType, voterID)
 	if err != nil {
 		return shim.Error("Failed to get voter: " + voterID)
 	}
 
-	if dupeVoterAsBytes != nil {
-		return shim.Success(dupeVoterAsBytes)
+	if dupeVoterAsBytes == nil {
+		return shim.Error("not found")
 	}
 
-	return shim.Error("not found")
+	if !canSeeChoices(stub, voterID) {
+		v := voterV2{}
+		if err := json.Unmarshal(dupeVoterAsBytes, &v); err != nil {
+			return shim.Error("Failed to unmarshal voter")
+		}
+		redactChoices(&v)
+		dupeVoterAsBytes, _ = json.Marshal(v)
+	}
+	return shim.Success(dupeVoterAsBytes)
 }
 
 // when vote is casted, the generated id is stored in the ledger
@@ -160,26 +278,35 @@ func (t *VotingChaincode) getVoter(stub shim.ChaincodeStubInterface, args []stri
 // this means we need a new voter model, the current can only store one election id
 // and its checked using hasVoted flag.
 func (t *VotingChaincode) voteV2(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	VoterID := args[0]
-
-	if !strings.HasPrefix(VoterID, "voter.") {
-		VoterID = "voter." + args[0]
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
 	}
+
 	CandidateID := args[1]
 	if !strings.HasPrefix(CandidateID, "candidate.") {
 		CandidateID = "candidate." + args[1]
 	}
 
-	ElectionID := args[2]
+	return t.castBallot(stub, args[0], args[2], ballotPlurality, []string{CandidateID})
+}
+
+// castBallot runs the checks shared by every vote path and stores the ballot.
+// ballot holds the chosen candidate IDs in order of preference, a plurality
+// ballot being a single candidate. The payload is the voter's receipt, see receipt.go.
+func (t *VotingChaincode) castBallot(stub shim.ChaincodeStubInterface, VoterID, ElectionID, ballotType string, ballot []string) pb.Response {
+	if !strings.HasPrefix(VoterID, "voter.") {
+		VoterID = "voter." + VoterID
+	}
 	if !strings.HasPrefix(ElectionID, "election.") {
-		ElectionID = "election." + args[2]
+		ElectionID = "election." + ElectionID
 	}
-
-	if len(args) != 3 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
+	// the submitter must be the voter the ballot is recorded for
+	if err := requireVoter(stub, VoterID); err != nil {
+		return shim.Error(err.Error())
 	}
+
 	// find voter in ledger
-	voterAsBytes, err := stub.GetState(VoterID)
+	voterAsBytes, err := getEntity(stub, voterObjectType, VoterID)
 	if err != nil {
 		return shim.Error("Failed to get voter: " + VoterID)
 	}
@@ -198,63 +325,144 @@ func (t *VotingChaincode) voteV2(stub shim.ChaincodeStubInterface, args []string
 
 	// if election id exist, return error
 	for i := 0; i < len(voterInfo.ElectionHistory); i++ {
-		if voterInfo.ElectionHistory[i].ElectionID == ElectionID && voterInfo.ElectionHistory[i].VotedTo != "" {
+		if voterInfo.ElectionHistory[i].ElectionID == ElectionID && voterInfo.ElectionHistory[i].voted() {
 			fmt.Printf("Voter has already voted for this election")
 			return shim.Error("Voter has already voted")
 		}
 	}
 
 	// get election
-	electionAsBytes, err := stub.GetState(ElectionID)
+	electionAsBytes, err := getEntity(stub, electionObjectType, ElectionID)
 	election := election{}
 	err = json.Unmarshal(electionAsBytes, &election)
 	if err != nil {
 		return shim.Error("Failed to get election: " + ElectionID)
 	}
 
-	// parse election end date to datetime
-	electionEndDate, err := time.Parse(time.DateTime, strings.TrimSpace(election.EndDate))
+	if election.ballotType() != ballotType {
+		return shim.Error("election expects ballot type " + election.ballotType())
+	}
+	if election.status() != statusOpen {
+		return shim.Error("Election is " + election.status())
+	}
+	if ballotType == ballotApproval && len(ballot) > election.maxChoices() {
+		return shim.Error(fmt.Sprintf("at most %d candidates can be chosen in this election", election.maxChoices()))
+	}
+
+	// parse election dates to datetime
+	electionStartDate, err := parseDate(election.StartDate)
+	if err != nil {
+		return shim.Error("Failed to parse election start date: " + election.StartDate)
+	}
+	electionEndDate, err := parseDate(election.EndDate)
 	if err != nil {
 		return shim.Error("Failed to parse election end date: " + election.EndDate)
 	}
-	// check if election has ended
-	if time.Now().After(electionEndDate) {
+	// check if election has started and not ended yet, using the transaction
+	// timestamp so every endorsing peer reaches the same decision
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now.Before(electionStartDate) {
+		return shim.Error("Election has not started")
+	}
+	if now.After(electionEndDate) {
 		return shim.Error("Election has ended")
 	}
 
-	// update candidate votes
-	candidateAsBytes, err := stub.GetState(CandidateID)
-	if err != nil {
-		return shim.Error("Failed to get candidate: " + CandidateID)
+	// every chosen candidate has to exist, encrypted ballots are checked when decrypted
+	for _, CandidateID := range ballot {
+		if ballotType == ballotEncrypted || ballotType == ballotHomomorphic {
+			break
+		}
+		candidateAsBytes, err := getEntity(stub, candidateObjectType, CandidateID)
+		if err != nil {
+			return shim.Error("Failed to get candidate: " + CandidateID)
+		}
+		if candidateAsBytes == nil {
+			return shim.Error("invalid candidate")
+		}
 	}
-	if candidateAsBytes == nil {
-		return shim.Error("invalid candidate")
+
+	// plurality records keep the bare candidate ID so existing ledgers stay readable
+	recordAsBytes := []byte(ballot[0])
+	electionEligibility := ElectionHistory{ElectionID: ElectionID, VotedTo: ballot[0], Voted: true}
+	switch ballotType {
+	case ballotRanked:
+		recordAsBytes, _ = json.Marshal(ballot)
+		electionEligibility.Ranking = ballot
+	case ballotApproval:
+		recordAsBytes, _ = json.Marshal(ballot)
+		electionEligibility.Choices = ballot
+	case ballotEncrypted, ballotHomomorphic:
+		electionEligibility.VotedTo = ""
 	}
 
-	// candidate votes ledger updated when
+	recordKey, err := stub.CreateCompositeKey(recordObjectType, []string{ElectionID, VoterID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if election.SecretBallot {
+		// only participation is kept on the voter, the ballot goes under a key that does not name them
+		nullifier := ballotNullifier(ElectionID, VoterID)
+		nullifierKey, err := stub.CreateCompositeKey(nullifierObjectType, []string{ElectionID, nullifier})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		nullifierAsBytes, err := stub.GetState(nullifierKey)
+		if err != nil {
+			return shim.Error("Failed to get nullifier")
+		}
+		if nullifierAsBytes != nil {
+			return shim.Error("Voter has already voted")
+		}
+		err = stub.PutState(nullifierKey, []byte(ElectionID))
+		if err != nil {
+			fmt.Println("failed to put nullifier", err.Error())
+			return shim.Error("failed to commit to network")
+		}
+		electionEligibility = ElectionHistory{ElectionID: ElectionID, Voted: true, Nullifier: nullifier}
+		recordKey, err = secretBallotKey(stub, ElectionID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
 
-	electionEligibility := ElectionHistory{ElectionID: ElectionID, VotedTo: CandidateID}
 	// update voter ledger
-	// if voter does not exist, create new voter
-
-	// if voter exist, update voter
-	voter := voterV2{}
-	json.Unmarshal(voterAsBytes, &voter)
-	voter.ElectionHistory = append(voter.ElectionHistory, electionEligibility)
-	voterAsBytes, _ = json.Marshal(voter)
-	err = stub.PutState(VoterID, voterAsBytes)
+	voterInfo.ElectionHistory = append(voterInfo.ElectionHistory, electionEligibility)
+	voterAsBytes, _ = json.Marshal(voterInfo)
+	err = putEntity(stub, voterObjectType, VoterID, voterAsBytes)
 	if err != nil {
 		fmt.Println("failed to put voter", err.Error())
 		return shim.Error("failed to commit to network")
 	}
+	if err := indexVote(stub, ElectionID, VoterID); err != nil {
+		fmt.Println("failed to index voter", err.Error())
+		return shim.Error("failed to commit to network")
+	}
 
-	err = stub.PutState("record_"+ElectionID+"_"+VoterID, []byte(CandidateID))
+	err = stub.PutState(recordKey, recordAsBytes)
 	if err != nil {
 		fmt.Println("failed to put history of election voting", err.Error())
 		return shim.Error("failed to commit to network")
 	}
 
-	return shim.Success(nil)
+	// encrypted ballots are only counted once decrypted
+	if ballotType != ballotEncrypted && ballotType != ballotHomomorphic {
+		if err := addVoteDeltas(stub, ElectionID, countedChoices(ballotType, ballot)); err != nil {
+			fmt.Println("failed to put vote counters", err.Error())
+			return shim.Error("failed to commit to network")
+		}
+	}
+
+	receiptAsBytes, err := putReceipt(stub, ElectionID, recordKey, recordAsBytes)
+	if err != nil {
+		fmt.Println("failed to put receipt", err.Error())
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(receiptAsBytes)
 }
 
 // get election by id function
@@ -263,22 +471,38 @@ func (t *VotingChaincode) getElectionById(stub shim.ChaincodeStubInterface, args
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 	electionId := args[0]
-	electionAsBytes, err := stub.GetState(electionId)
+	electionAsBytes, err := getEntity(stub, electionObjectType, electionId)
 	if err != nil {
 		return shim.Error("Failed to get election: " + electionId)
 	}
 	return shim.Success(electionAsBytes)
 }
 
+// electionPage is one page of getAllElections, Bookmark is empty on the last page
+type electionPage struct {
+	Elections []election `json:"elections"`
+	Bookmark  string     `json:"bookmark"`
+	Count     int32      `json:"count"`
+}
+
 // get all created elections function
-func (t *VotingChaincode) getAllElections(stub shim.ChaincodeStubInterface) pb.Response {
-	resultsIterator, err := stub.GetStateByRange("elections", "elections.z")
+// args: optional pageSize, bookmark
+func (t *VotingChaincode) getAllElections(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting at most 2")
+	}
+	pageSize, bookmark, err := parsePage(args, 0)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(electionObjectType, []string{}, pageSize, bookmark)
 	if err != nil {
 		return shim.Error("Failed to get elections")
 	}
 	defer resultsIterator.Close()
-	// buffer is a JSON array containing QueryResults
-	elections := []election{}
+
+	page := electionPage{Elections: []election{}}
 	for resultsIterator.HasNext() {
 		queryResponse, err := resultsIterator.Next()
 		if err != nil {
@@ -288,55 +512,126 @@ func (t *VotingChaincode) getAllElections(stub shim.ChaincodeStubInterface) pb.R
 		if err := json.Unmarshal(queryResponse.Value, &e); err != nil {
 			return shim.Error("Failed to unmarshal the election")
 		}
-		elections = append(elections, e)
+		page.Elections = append(page.Elections, e)
+	}
+	page.Count = metadata.FetchedRecordsCount
+	if page.Count == pageSize {
+		page.Bookmark = metadata.Bookmark
 	}
-	res, _ := json.Marshal(elections)
+	res, _ := json.Marshal(page)
 	return shim.Success(res)
-
 }
 
 // create election function
 func (t *VotingChaincode) createElection(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 5 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
+	if len(args) < 3 || len(args) > 9 {
+		return shim.Error("Incorrect number of arguments. Expecting between 3 and 9")
 	}
 	electionName := args[0]
-	startDate := args[1]
-	endDate := args[2]
-	// electionID is pecified in the REST API server
-	// hence all peers will have the same electionID
-
-	electionID := args[3]
-	if !strings.HasPrefix(electionID, "election.") {
-		electionID = "election." + electionID
-	}
-	createdAt := args[4]
-
-	// check if election name is provided
 
 	// creating Id using current time broke the block
 	// when smart contract is issued by REST API not all peers run the contract at the same time
 	// this means peer01 will have a different electionID than peer02
 	// hence endorsement will fail becase of key and value mismatch between peers
-	// to circumvent this issue we need to specify the electionID in the REST API call
-	// electionID := "election." + strconv.Itoa(time.Now().Nanosecond())
-	// createdAt := time.Now().String()
+	// the transaction ID and timestamp are part of the proposal, so every peer derives the same values from them
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	electionID := "election." + stub.GetTxID()
+	createdAt := formatDate(now)
 
-	if startDate > endDate {
+	start, err := parseDate(args[1])
+	if err != nil {
+		return shim.Error("Invalid election start date: " + args[1])
+	}
+	end, err := parseDate(args[2])
+	if err != nil {
+		return shim.Error("Invalid election end date: " + args[2])
+	}
+	if start.After(end) {
 		return shim.Error("Invalid election dates")
 	}
+	startDate, endDate := formatDate(start), formatDate(end)
+
+	ballotType := ballotPlurality
+	if len(args) > 3 && args[3] != "" {
+		ballotType = args[3]
+	}
+	if ballotType != ballotPlurality && ballotType != ballotRanked && ballotType != ballotApproval &&
+		ballotType != ballotEncrypted && ballotType != ballotHomomorphic {
+		return shim.Error("Invalid ballot type: " + ballotType)
+	}
+
+	// optional maxChoices and seats, both default to 1
+	limits := []int{1, 1}
+	for i := range limits {
+		if len(args) > 4+i && args[4+i] != "" {
+			n, err := strconv.Atoi(args[4+i])
+			if err != nil || n < 1 {
+				return shim.Error("Invalid election limit: " + args[4+i])
+			}
+			limits[i] = n
+		}
+	}
+	maxChoices, seats := limits[0], limits[1]
+	if maxChoices > 1 && ballotType != ballotApproval {
+		return shim.Error("only approval elections accept more than one choice")
+	}
+	if seats > 1 && ballotType == ballotRanked {
+		return shim.Error("ranked elections elect a single seat")
+	}
+
+	secretBallot := false
+	if len(args) > 6 && args[6] != "" {
+		secretBallot, err = strconv.ParseBool(args[6])
+		if err != nil {
+			return shim.Error("Invalid secret ballot flag: " + args[6])
+		}
+	}
+
+	// encrypted elections need the election key, as JSON encryption settings
+	var encryption *encryptionSettings
+	if ballotType == ballotEncrypted || ballotType == ballotHomomorphic {
+		if len(args) < 8 || args[7] == "" {
+			return shim.Error("encrypted elections need encryption settings")
+		}
+		encryption = &encryptionSettings{}
+		if err := json.Unmarshal([]byte(args[7]), encryption); err != nil {
+			return shim.Error("Failed to unmarshal encryption settings")
+		}
+		if err := encryption.validate(); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	liveResults := false
+	if len(args) > 8 && args[8] != "" {
+		liveResults, err = strconv.ParseBool(args[8])
+		if err != nil {
+			return shim.Error("Invalid live results flag: " + args[8])
+		}
+	}
+	if liveResults && encryption != nil {
+		return shim.Error("encrypted elections have no live results")
+	}
+	// encrypted ballots are never stored under the voter, see encrypted.go
+	if encryption != nil {
+		secretBallot = true
+	}
 
 	// generate unique election id
-	var election = &election{electionID, electionName, startDate, endDate, createdAt, nil}
+	// new elections start as drafts and are opened once their candidates are in
+	var election = &election{electionID, electionName, startDate, endDate, createdAt, nil, ballotType, maxChoices, seats, statusDraft, secretBallot, encryption, liveResults}
 	electionAsBytes, _ := json.Marshal(election)
-	err := stub.PutState(electionID, electionAsBytes)
+	err = putEntity(stub, electionObjectType, electionID, electionAsBytes)
 	if err != nil {
 		fmt.Println("Error creating election")
 		return shim.Error(err.Error())
 	}
 
-	fmt.Println("election creation successful %s", electionID)
-	return shim.Success(nil)
+	fmt.Printf("election creation successful %s\n", electionID)
+	return shim.Success([]byte(electionID))
 }
 
 // TODO: if cadidate exists, update candidate and append electionId to candidate.Elections
@@ -356,18 +651,23 @@ func (t *VotingChaincode) createCandidate(stub shim.ChaincodeStubInterface, args
 	electionId := args[2]
 
 	// check if cadidate exist
-	candidateAsBytes, err := stub.GetState(candidID)
+	candidateAsBytes, err := getEntity(stub, candidateObjectType, candidID)
 	if err != nil {
 		return shim.Error("Failed to get candidate: " + candidID)
 	}
 
-	electoinInfo, err := stub.GetState(electionId)
+	electoinInfo, err := getEntity(stub, electionObjectType, electionId)
 	if err != nil {
 		return shim.Error("Failed to get election: " + electionId)
 	}
 	if electoinInfo == nil {
 		return shim.Error("election not found ")
 	}
+	targetElection := election{}
+	json.Unmarshal(electoinInfo, &targetElection)
+	if targetElection.status() != statusDraft {
+		return shim.Error("candidates can only be added to a draft election")
+	}
 
 	if candidateAsBytes != nil {
 		// if candidate exists, update candidate and append electionId to candidate.Elections
@@ -385,12 +685,12 @@ func (t *VotingChaincode) createCandidate(stub shim.ChaincodeStubInterface, args
 		info := electionInfo{ElectionID: electionId}
 		candidateInfo.Elections = append(candidateInfo.Elections, info)
 		candidateAsBytes, _ := json.Marshal(candidateInfo)
-		err := stub.PutState(candidID, candidateAsBytes)
+		err := putEntity(stub, candidateObjectType, candidID, candidateAsBytes)
 		if err != nil {
 			fmt.Println("Error updating candidate")
 			return shim.Error(err.Error())
 		}
-		fmt.Println("candidate update successful %s", candidID)
+		fmt.Printf("candidate update successful %s\n", candidID)
 		return shim.Success(nil)
 	} else {
 		// else create candidate
@@ -399,42 +699,72 @@ func (t *VotingChaincode) createCandidate(stub shim.ChaincodeStubInterface, args
 			Name:      candidateName,
 			Elections: []electionInfo{info}}
 		candidateAsBytes, _ := json.Marshal(candidateInfo)
-		err := stub.PutState(candidID, candidateAsBytes)
+		err := putEntity(stub, candidateObjectType, candidID, candidateAsBytes)
 		if err != nil {
 			fmt.Println("Error creating candidate")
 			return shim.Error(err.Error())
 		}
-		fmt.Println("candidate creation successful %s", candidID)
+		fmt.Printf("candidate creation successful %s\n", candidID)
 		return shim.Success(nil)
 	}
 
 }
 
 func (t *VotingChaincode) updateElection(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
 	electionId := args[0]
 	target := args[1]
 	value := args[2]
 
-	electionAsBytes, err := stub.GetState(electionId)
+	electionAsBytes, err := getEntity(stub, electionObjectType, electionId)
 	if err != nil {
 		return shim.Error("Failed to get election: " + electionId)
 	}
 
+	if electionAsBytes == nil {
+		return shim.Error("election not found")
+	}
+
 	election := election{}
 	json.Unmarshal(electionAsBytes, &election)
 
+	// dates and names are fixed once voting may have started
+	if election.status() != statusDraft {
+		return shim.Error("only draft elections can be updated")
+	}
+
 	if target == "name" {
 		election.ElectionName = value
-	} else if target == "startDate" {
-		election.StartDate = value
-	} else if target == "endDate" {
-		election.EndDate = value
+	} else if target == "startDate" || target == "endDate" {
+		date, err := parseDate(value)
+		if err != nil {
+			return shim.Error("Invalid date: " + value)
+		}
+		if target == "startDate" {
+			election.StartDate = formatDate(date)
+		} else {
+			election.EndDate = formatDate(date)
+		}
+		start, _ := parseDate(election.StartDate)
+		end, _ := parseDate(election.EndDate)
+		if start.After(end) {
+			return shim.Error("Invalid election dates")
+		}
 	} else {
 		return shim.Error("Invalid target")
 	}
 
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	updatedAt := formatDate(now)
+	election.UpdatedAt = &updatedAt
+
 	electionAsBytes, _ = json.Marshal(election)
-	err = stub.PutState(electionId, electionAsBytes)
+	err = putEntity(stub, electionObjectType, electionId, electionAsBytes)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -453,24 +783,10 @@ func (t *VotingChaincode) getCandidatesById(stub shim.ChaincodeStubInterface, ar
 	// electionid is stored in the candidate object
 	// so you need to get all candidateId keys and get the candidate object
 	// that match the electionId
-	userIDsAsBytes, err := stub.GetStateByRange("candidate.", "candidate.z")
-	if err != nil {
-		return shim.Error("Failed to get candidate: " + electionId)
-	}
-	defer userIDsAsBytes.Close()
-	// buffer is a JSON array containing QueryResults
 	var buffer bytes.Buffer
 	buffer.WriteString("[")
 	bArrayMemberAlreadyWritten := false
-	for userIDsAsBytes.HasNext() {
-		queryResponse, err := userIDsAsBytes.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		candidateAsBytes, err := stub.GetState(queryResponse.Key)
-		if err != nil {
-			return shim.Error(err.Error())
-		}
+	err := scanCompositeKeys(stub, candidateObjectType, []string{}, func(attributes []string, candidateAsBytes []byte) error {
 		candidate := candidate{}
 		json.Unmarshal(candidateAsBytes, &candidate)
 		for _, election := range candidate.Elections {
@@ -480,7 +796,7 @@ func (t *VotingChaincode) getCandidatesById(stub shim.ChaincodeStubInterface, ar
 				}
 				buffer.WriteString("{\"Key\":")
 				buffer.WriteString("\"")
-				buffer.WriteString(queryResponse.Key)
+				buffer.WriteString(attributes[0])
 				buffer.WriteString("\"")
 
 				buffer.WriteString(", \"Record\":")
@@ -490,6 +806,10 @@ func (t *VotingChaincode) getCandidatesById(stub shim.ChaincodeStubInterface, ar
 				bArrayMemberAlreadyWritten = true
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		return shim.Error("Failed to get candidate: " + electionId)
 	}
 	buffer.WriteString("]")
 	return shim.Success(buffer.Bytes())
@@ -501,90 +821,187 @@ func (t *VotingChaincode) GetFinalResult(stub shim.ChaincodeStubInterface, args
 	}
 	electionID := args[0]
 
-	finalResult := make(map[string]int)
+	electionAsBytes, err := getEntity(stub, electionObjectType, electionID)
+	if err != nil {
+		return shim.Error("Failed to get election: " + electionID)
+	}
+	if electionAsBytes == nil {
+		return shim.Error("election not found")
+	}
+	e := election{}
+	if err := json.Unmarshal(electionAsBytes, &e); err != nil {
+		return shim.Error("Failed to unmarshal the election")
+	}
+	if err := resultsVisible(stub, e); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	finalResult, err := electionTally(stub, electionID, e)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	startFrom := "record_" + electionID
-	EndAt := "record_" + electionID + "_z"
+	response, err := json.Marshal(finalResult)
+	if err != nil {
+		fmt.Println("failed to marshal response", err)
+		return shim.Error("failed to create response")
+	}
 
-iterateTillEnd:
-	for {
-		resultsIterator, err := stub.GetStateByRange(startFrom, EndAt)
+	return shim.Success(response)
+}
+
+// electionTally counts the votes of every candidate from the vote counters.
+// Encrypted and homomorphic elections return the tally published once their
+// ballots were decrypted.
+func electionTally(stub shim.ChaincodeStubInterface, electionID string, e election) (map[string]int, error) {
+	if e.ballotType() == ballotEncrypted || e.ballotType() == ballotHomomorphic {
+		resultAsBytes, err := getEntity(stub, resultObjectType, electionID)
 		if err != nil {
-			return shim.Error(err.Error())
+			return nil, err
 		}
-		defer resultsIterator.Close()
-
-		if !resultsIterator.HasNext() {
-			break
+		if resultAsBytes == nil {
+			return nil, fmt.Errorf("result has not been decrypted yet")
+		}
+		var result map[string]int
+		if err := json.Unmarshal(resultAsBytes, &result); err != nil {
+			return nil, fmt.Errorf("failed to decode result: %w", err)
 		}
+		return result, nil
+	}
 
-		for resultsIterator.HasNext() {
+	// every ballot is in the counters, those cast before they existed are
+	// added by migrateKeys
+	return getVoteCounts(stub, electionID)
+}
 
-			queryResponse, err := resultsIterator.Next()
-			if err != nil {
-				return shim.Error(err.Error())
-			}
-			fmt.Println("finalResualt query ", queryResponse.Key, string(queryResponse.Value))
+// getBallots returns every ballot recorded for the election
+func getBallots(stub shim.ChaincodeStubInterface, electionID string) ([][]string, error) {
+	var ballots [][]string
+	collect := func(attributes []string, value []byte) error {
+		ballot, err := decodeBallot(value)
+		if err != nil {
+			return fmt.Errorf("failed to decode ballot %s: %w", strings.Join(attributes, "/"), err)
+		}
+		ballots = append(ballots, ballot)
+		return nil
+	}
+	// secret ballots are stored under keys that do not name the voter
+	for _, objectType := range []string{recordObjectType, ballotObjectType} {
+		if err := scanCompositeKeys(stub, objectType, []string{electionID}, collect); err != nil {
+			return nil, err
+		}
+	}
+	return ballots, nil
+}
 
-			if queryResponse.Key == startFrom {
-				if resultsIterator.HasNext() {
-					continue
-				} else {
-					break iterateTillEnd
-				}
-			}
-			startFrom = queryResponse.Key
+// countedChoices returns the candidates a ballot counts for
+func countedChoices(ballotType string, ballot []string) []string {
+	if ballotType != ballotApproval {
+		return ballot[:1]
+	}
+	return ballot
+}
 
-			votedTo := string(queryResponse.Value)
-			finalResult[votedTo]++
-		}
+// decodeBallot reads a record value, which is either a bare candidate ID
+// (plurality) or a JSON array of candidate IDs in order of preference
+func decodeBallot(value []byte) ([]string, error) {
+	if !bytes.HasPrefix(value, []byte("[")) {
+		return []string{string(value)}, nil
 	}
-	response, err := json.Marshal(finalResult)
-	if err != nil {
-		fmt.Println("failed to marshal response", err)
-		return shim.Error("failed to create response")
+	var ballot []string
+	if err := json.Unmarshal(value, &ballot); err != nil {
+		return nil, err
 	}
+	if len(ballot) == 0 {
+		return nil, fmt.Errorf("empty ballot")
+	}
+	return ballot, nil
+}
 
-	return shim.Success(response)
+// txTime returns the timestamp the client put on the transaction proposal.
+// Unlike time.Now it is the same on every endorsing peer.
+func txTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get transaction timestamp: %w", err)
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
 }
 
-// query by range function
-func (t *VotingChaincode) queryByRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+// dateLayouts are the accepted input formats for election dates,
+// values without a zone are taken as UTC
+var dateLayouts = []string{time.RFC3339, time.DateTime, time.DateOnly}
+
+// parseDate reads an election date, including the "2006-01-02 15:04:05"
+// values elections were stored with before dates were kept as RFC3339
+func parseDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range dateLayouts {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date.UTC(), nil
+		}
 	}
-	startKey := args[0]
-	endKey := args[1]
-	resultsIterator, err := stub.GetStateByRange(startKey, endKey)
+	return time.Time{}, fmt.Errorf("unsupported date format: %s", value)
+}
+
+// dates are stored as RFC3339 in UTC
+func formatDate(date time.Time) string {
+	return date.UTC().Format(time.RFC3339)
+}
+
+// validateChoices prefixes the chosen candidate IDs and checks that each one
+// is chosen once and runs in the election
+func validateChoices(stub shim.ChaincodeStubInterface, electionID string, choices []string) ([]string, error) {
+	candidates, err := getElectionCandidateIDs(stub, electionID)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
-	defer resultsIterator.Close()
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
+
+	seen := make(map[string]bool)
+	normalized := make([]string, len(choices))
+	for i, CandidateID := range choices {
+		if !strings.HasPrefix(CandidateID, "candidate.") {
+			CandidateID = "candidate." + CandidateID
+		}
+		if seen[CandidateID] {
+			return nil, fmt.Errorf("candidate chosen more than once: %s", CandidateID)
+		}
+		seen[CandidateID] = true
+		if !contains(candidates, CandidateID) {
+			return nil, fmt.Errorf("candidate does not run in this election: %s", CandidateID)
+		}
+		normalized[i] = CandidateID
+	}
+	return normalized, nil
+}
+
+// getElectionCandidateIDs returns the IDs of all candidates running in the election
+func getElectionCandidateIDs(stub shim.ChaincodeStubInterface, electionID string) ([]string, error) {
+	var candidates []string
+	err := scanCompositeKeys(stub, candidateObjectType, []string{}, func(attributes []string, value []byte) error {
+		c := candidate{}
+		if err := json.Unmarshal(value, &c); err != nil {
+			return fmt.Errorf("Failed to unmarshal candidate %s", attributes[0])
 		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
+		for _, e := range c.Elections {
+			if e.ElectionID == electionID || "election."+e.ElectionID == electionID {
+				candidates = append(candidates, attributes[0])
+				break
+			}
 		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get candidates: %w", err)
+	}
+	return candidates, nil
+}
 
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
 	}
-	buffer.WriteString("]")
-	fmt.Printf("- queryByRange queryResult:\n%s\n", buffer.String())
-	return shim.Success(buffer.Bytes())
+	return false
 }
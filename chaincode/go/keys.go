@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// Everything is stored under composite keys, <objectType>~<attributes...>,
+// and listed with GetStateByPartialCompositeKey, so an ID sorting after "z"
+// can no longer fall out of a range scan. Voters, candidates and elections keep
+// their prefixed IDs ("voter.1") as the only attribute.
+const (
+	voterObjectType     = "voter"
+	candidateObjectType = "candidate"
+	electionObjectType  = "election"
+	// record~<election>~<voter> holds the ballot of a public election
+	recordObjectType = "record"
+	// ballot~<election>~<hash> holds a secret ballot, see secret.go
+	ballotObjectType    = "ballot"
+	nullifierObjectType = "nullifier"
+	// share~<election>~<trustee> and result~<election>, see encrypted.go
+	shareObjectType   = "share"
+	resultObjectType  = "result"
+	receiptObjectType = "receipt"
+	// config~<name> holds chaincode settings, see access.go
+	configObjectType = "config"
+	// voted~<election>~<voter> indexes the voters who voted, see queryVoters
+	votedObjectType = "voted"
+)
+
+// anyElection stands for the election in the voted index of voters who voted
+// in any election, election IDs all start with "election."
+const anyElection = "any"
+
+// getEntity reads the object keyed by a single ID, a voter, candidate,
+// election, result or receipt
+func getEntity(stub shim.ChaincodeStubInterface, objectType, id string) ([]byte, error) {
+	key, err := stub.CreateCompositeKey(objectType, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	return stub.GetState(key)
+}
+
+// putEntity stores an object keyed by a single ID
+func putEntity(stub shim.ChaincodeStubInterface, objectType, id string, value []byte) error {
+	key, err := stub.CreateCompositeKey(objectType, []string{id})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, value)
+}
+
+// scanCompositeKeys calls fn with the attributes and value of every key of the
+// object type starting with the given attributes
+func scanCompositeKeys(stub shim.ChaincodeStubInterface, objectType string, attributes []string, fn func(attributes []string, value []byte) error) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(objectType, attributes)
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, keyAttributes, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return err
+		}
+		if err := fn(keyAttributes, queryResponse.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyKey returns the composite key that replaces a key written before
+// composite keys were used, or false for keys that are not migrated
+func legacyKey(stub shim.ChaincodeStubInterface, key string) (string, bool, error) {
+	var objectType string
+	var attributes []string
+	switch {
+	case strings.HasPrefix(key, "voter."):
+		objectType, attributes = voterObjectType, []string{key}
+	case strings.HasPrefix(key, "candidate."):
+		objectType, attributes = candidateObjectType, []string{key}
+	case strings.HasPrefix(key, "election."):
+		objectType, attributes = electionObjectType, []string{key}
+	case strings.HasPrefix(key, "record_"):
+		// record_<election>_<voter>, voter IDs start with "voter."
+		rest := strings.TrimPrefix(key, "record_")
+		if i := strings.Index(rest, "_voter."); i >= 0 {
+			objectType, attributes = recordObjectType, []string{rest[:i], rest[i+1:]}
+		}
+	}
+	if attributes == nil {
+		return "", false, nil
+	}
+
+	compositeKey, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return "", false, err
+	}
+	return compositeKey, true, nil
+}
+
+// migrateKeys moves up to batchSize keys written before composite keys were
+// used to their composite keys, counting the ballots among them in the vote
+// counters. It returns how many keys it moved and the
+// bookmark to continue from; call it again until done is true.
+// args: batchSize, optional bookmark
+func (t *VotingChaincode) migrateKeys(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+	batchSize, err := strconv.Atoi(args[0])
+	if err != nil || batchSize < 1 || batchSize > maxMigrationBatch {
+		return shim.Error(fmt.Sprintf("Invalid batch size, expecting 1 to %d", maxMigrationBatch))
+	}
+	bookmark := ""
+	if len(args) == 2 {
+		bookmark = args[1]
+	}
+
+	// composite keys start with 0x00 and are never part of this range
+	if bookmark == "" {
+		bookmark = "\x01"
+	}
+	resultsIterator, err := stub.GetStateByRange(bookmark, string(utf8.MaxRune))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	var batch []*queryresult.KV
+	for resultsIterator.HasNext() && len(batch) < batchSize {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		batch = append(batch, queryResponse)
+		bookmark = queryResponse.Key + "\x00"
+	}
+	done := !resultsIterator.HasNext()
+
+	migrated := 0
+	for _, queryResponse := range batch {
+		key, ok, err := legacyKey(stub, queryResponse.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !ok {
+			continue
+		}
+
+		value := queryResponse.Value
+		if strings.HasPrefix(queryResponse.Key, "voter.") {
+			// voters who voted are indexed as they move
+			v := voterV2{}
+			if err := json.Unmarshal(value, &v); err != nil {
+				return shim.Error("Failed to unmarshal voter " + queryResponse.Key)
+			}
+			for _, h := range v.ElectionHistory {
+				if !h.voted() {
+					continue
+				}
+				if err := indexVote(stub, h.ElectionID, queryResponse.Key); err != nil {
+					return shim.Error(err.Error())
+				}
+			}
+		}
+		if strings.HasPrefix(queryResponse.Key, "record_") {
+			// ballots cast before votes were counted as they came in are
+			// counted as they move, the tally only reads the counters
+			_, attributes, err := stub.SplitCompositeKey(key)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if err := backfillVoteDeltas(stub, attributes[0], attributes[1], value); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+
+		if err := stub.PutState(key, value); err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := stub.DelState(queryResponse.Key); err != nil {
+			return shim.Error(err.Error())
+		}
+		migrated++
+	}
+
+	response, _ := json.Marshal(map[string]interface{}{
+		"migrated": migrated,
+		"bookmark": bookmark,
+		"done":     done,
+	})
+	return shim.Success(response)
+}
+
+// maxMigrationBatch bounds the keys one migrateKeys transaction touches
+const maxMigrationBatch = 1000
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+)
+
+// putLegacy writes keys as they were stored before composite keys were used
+func putLegacy(t *testing.T, stub *shimtest.MockStub, state map[string]string) {
+	t.Helper()
+	stub.MockTransactionStart("legacy")
+	defer stub.MockTransactionEnd("legacy")
+	for key, value := range state {
+		if err := stub.PutState(key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLegacyKey(t *testing.T) {
+	stub := shimtest.NewMockStub("voting", new(VotingChaincode))
+	for _, test := range []struct {
+		key        string
+		objectType string
+		attributes []string
+	}{
+		{"voter.1", voterObjectType, []string{"voter.1"}},
+		{"candidate.alice", candidateObjectType, []string{"candidate.alice"}},
+		{"election.tx1", electionObjectType, []string{"election.tx1"}},
+		{"record_election.tx1_voter.1", recordObjectType, []string{"election.tx1", "voter.1"}},
+		// election IDs may hold "_", voter IDs follow the last "_voter."
+		{"record_election.tx_1_voter.a_b", recordObjectType, []string{"election.tx_1", "voter.a_b"}},
+		// unknown keys are left alone
+		{"record_election.tx1_notvoter", "", nil},
+		{"roleChecks", "", nil},
+	} {
+		got, ok, err := legacyKey(stub, test.key)
+		if err != nil {
+			t.Fatalf("%s: %v", test.key, err)
+		}
+		if test.attributes == nil {
+			if ok {
+				t.Errorf("%s: expected no migration, got %q", test.key, got)
+			}
+			continue
+		}
+		want, _ := stub.CreateCompositeKey(test.objectType, test.attributes)
+		if !ok || got != want {
+			t.Errorf("%s: expected %q, got %q %v", test.key, want, got, ok)
+		}
+	}
+}
+
+func TestMigrateKeysCountsLegacyBallots(t *testing.T) {
+	stub := newStub(t)
+	putLegacy(t, stub, map[string]string{
+		"election.e":                 `{"electionID":"election.e","ballotType":"approval","maxChoices":2,"liveResults":true}`,
+		"record_election.e_voter.1":  `["alice","bob"]`,
+		"record_election.e_voter.2":  `["alice"]`,
+		"record_election.e_notvoter": "ignored",
+		"voter.1":                    `{"id":"voter.1","electionHistory":[{"electionID":"election.e","votedTo":"alice"}]}`,
+	})
+
+	// small batches, continued from the bookmarks
+	for bookmark, done := "", false; !done; {
+		args := []string{"2"}
+		if bookmark != "" {
+			args = append(args, bookmark)
+		}
+		var response struct {
+			Bookmark string `json:"bookmark"`
+			Done     bool   `json:"done"`
+		}
+		if err := json.Unmarshal([]byte(mustInvoke(t, stub, "migrateKeys", args...)), &response); err != nil {
+			t.Fatal(err)
+		}
+		bookmark, done = response.Bookmark, response.Done
+	}
+
+	for electionID, want := range map[string]map[string]int{
+		"election.e": {"alice": 2, "bob": 1},
+	} {
+		var got map[string]int
+		if err := json.Unmarshal([]byte(mustInvoke(t, stub, "getFinalResult", electionID)), &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %v, got %v", electionID, want, got)
+		}
+	}
+
+	// voters who voted are indexed as they move
+	for _, election := range []string{"election.e", anyElection} {
+		key, _ := stub.CreateCompositeKey(votedObjectType, []string{election, "voter.1"})
+		if value, _ := stub.GetState(key); value == nil {
+			t.Errorf("expected voter.1 in the voted index of %s", election)
+		}
+	}
+
+	// counted ballots are not counted again once compacted
+	mustInvoke(t, stub, "compactVoteCounts", "election.e")
+	var got map[string]int
+	if err := json.Unmarshal([]byte(mustInvoke(t, stub, "getFinalResult", "election.e")), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["alice"] != 2 || got["bob"] != 1 {
+		t.Errorf("unexpected compacted counts %v", got)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// election lifecycle states
+const (
+	statusDraft    = "draft"
+	statusOpen     = "open"
+	statusClosed   = "closed"
+	statusTallied  = "tallied"
+	statusArchived = "archived"
+)
+
+// electionTransitions maps every transition function to the state it
+// moves an election from and the state it moves it to
+var electionTransitions = map[string][2]string{
+	"openElection":    {statusDraft, statusOpen},
+	"closeElection":   {statusOpen, statusClosed},
+	"tallyElection":   {statusClosed, statusTallied},
+	"archiveElection": {statusTallied, statusArchived},
+}
+
+// elections stored before the lifecycle existed were accepting votes
+func (e election) status() string {
+	if e.Status == "" {
+		return statusOpen
+	}
+	return e.Status
+}
+
+// ended tells whether the election stopped taking votes, either closed or
+// still open past its end date
+func (e election) ended(stub shim.ChaincodeStubInterface) (bool, error) {
+	switch e.status() {
+	case statusDraft:
+		return false, nil
+	case statusOpen:
+		end, err := parseDate(e.EndDate)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse election end date: %s", e.EndDate)
+		}
+		now, err := txTime(stub)
+		if err != nil {
+			return false, err
+		}
+		return now.After(end), nil
+	}
+	return true, nil
+}
+
+// transitionElection moves an election along its lifecycle
+// args: electionID
+func (t *VotingChaincode) transitionElection(stub shim.ChaincodeStubInterface, function string, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	electionID := args[0]
+	if !strings.HasPrefix(electionID, "election.") {
+		electionID = "election." + electionID
+	}
+	transition := electionTransitions[function]
+
+	electionAsBytes, err := getEntity(stub, electionObjectType, electionID)
+	if err != nil {
+		return shim.Error("Failed to get election: " + electionID)
+	}
+	if electionAsBytes == nil {
+		return shim.Error("election not found")
+	}
+	e := election{}
+	if err := json.Unmarshal(electionAsBytes, &e); err != nil {
+		return shim.Error("Failed to unmarshal the election")
+	}
+
+	if e.status() != transition[0] {
+		return shim.Error("election is " + e.status() + ", expected " + transition[0])
+	}
+	e.Status = transition[1]
+
+	electionAsBytes, _ = json.Marshal(e)
+	if err := putEntity(stub, electionObjectType, electionID, electionAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(electionAsBytes)
+}
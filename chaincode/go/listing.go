@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// queryVoters lists voters a page at a time. Voters can be filtered by the ID
+// prefix, by an election and by whether they voted, in that election if one is
+// given or in any election otherwise. Their choices are left out unless the
+// caller may see them, see canSeeChoices.
+//
+// Voters who voted are listed from the votedObjectType index and a prefix
+// starts the listing at it, so those pages read about pageSize keys. Voters
+// who did not vote have no index and are filtered, reading at most
+// maxScannedRecords voters a page.
+// args: pageSize, bookmark, electionID, hasVoted ("true", "false" or ""), ID prefix
+func (t *VotingChaincode) queryVoters(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 5 {
+		return shim.Error("Incorrect number of arguments. Expecting at most 5")
+	}
+	args = append(args, make([]string, 5-len(args))...)
+	pageSize, bookmark, err := parsePage(args, 0)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	electionID := args[2]
+	if electionID != "" && !strings.HasPrefix(electionID, "election.") {
+		electionID = "election." + electionID
+	}
+	var hasVoted *bool
+	if args[3] != "" {
+		voted, err := strconv.ParseBool(args[3])
+		if err != nil {
+			return shim.Error("Invalid hasVoted filter: " + args[3])
+		}
+		hasVoted = &voted
+	}
+	prefix := args[4]
+	if !strings.HasPrefix(prefix, "voter.") {
+		prefix = "voter." + prefix
+	}
+
+	listed := func(id string, value []byte) pageRecord {
+		if !canSeeChoices(stub, id) {
+			v := voterV2{}
+			if err := json.Unmarshal(value, &v); err == nil {
+				redactChoices(&v)
+				value, _ = json.Marshal(v)
+			}
+		}
+		return pageRecord{Key: id, Record: value}
+	}
+
+	var page recordPage
+	// voters only show up in an election's history once they voted in it
+	if hasVoted != nil && *hasVoted || hasVoted == nil && electionID != "" {
+		indexed := electionID
+		if indexed == "" {
+			indexed = anyElection
+		}
+		page, err = scanPage(stub, votedObjectType, []string{indexed}, prefix, pageSize, bookmark, func(id string, _ []byte) (interface{}, error) {
+			value, err := getEntity(stub, voterObjectType, id)
+			if err != nil {
+				return nil, err
+			}
+			if value == nil {
+				return nil, fmt.Errorf("voter %s of the index not found", id)
+			}
+			return listed(id, value), nil
+		})
+	} else {
+		page, err = scanPage(stub, voterObjectType, []string{}, prefix, pageSize, bookmark, func(id string, value []byte) (interface{}, error) {
+			v := voterV2{}
+			if err := json.Unmarshal(value, &v); err != nil {
+				return nil, fmt.Errorf("Failed to unmarshal voter %s", id)
+			}
+			voted := false
+			for _, h := range v.ElectionHistory {
+				if (electionID == "" || h.ElectionID == electionID) && h.voted() {
+					voted = true
+					break
+				}
+			}
+			if hasVoted != nil && voted != *hasVoted {
+				return nil, nil
+			}
+			return listed(id, value), nil
+		})
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	response, _ := json.Marshal(page)
+	return shim.Success(response)
+}
+
+// indexVote adds the voter to the voters who voted in the election and in
+// any election, see queryVoters
+func indexVote(stub shim.ChaincodeStubInterface, electionID, voterID string) error {
+	for _, indexed := range []string{electionID, anyElection} {
+		key, err := stub.CreateCompositeKey(votedObjectType, []string{indexed, voterID})
+		if err != nil {
+			return err
+		}
+		if err := stub.PutState(key, []byte("1")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryCandidates lists candidates a page at a time, optionally only those
+// running in an election or whose name starts with a prefix (ignoring case)
+// args: pageSize, bookmark, electionID, name prefix
+func (t *VotingChaincode) queryCandidates(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 4 {
+		return shim.Error("Incorrect number of arguments. Expecting at most 4")
+	}
+	args = append(args, make([]string, 4-len(args))...)
+	pageSize, bookmark, err := parsePage(args, 0)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	electionID := args[2]
+	if electionID != "" && !strings.HasPrefix(electionID, "election.") {
+		electionID = "election." + electionID
+	}
+	prefix := strings.ToLower(args[3])
+
+	page, err := scanPage(stub, candidateObjectType, []string{}, "", pageSize, bookmark, func(id string, value []byte) (interface{}, error) {
+		c := candidate{}
+		if err := json.Unmarshal(value, &c); err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal candidate %s", id)
+		}
+		if !strings.HasPrefix(strings.ToLower(c.Name), prefix) {
+			return nil, nil
+		}
+		if electionID == "" {
+			return pageRecord{Key: id, Record: value}, nil
+		}
+		for _, e := range c.Elections {
+			if e.ElectionID == electionID {
+				return pageRecord{Key: id, Record: value}, nil
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	response, _ := json.Marshal(page)
+	return shim.Success(response)
+}
+
+// ballotRecord is a recorded ballot as listed by getBallotRecords. Key is the
+// voter ID of a public ballot or the hash a secret ballot is stored under.
+type ballotRecord struct {
+	Key       string          `json:"key"`
+	Ballot    []string        `json:"ballot,omitempty"`
+	Encrypted json.RawMessage `json:"encrypted,omitempty"`
+}
+
+// getBallotRecords lists the raw ballots of an election a page at a time,
+// only auditors and admins may read them, see functionRoles
+// args: electionID, pageSize, bookmark
+func (t *VotingChaincode) getBallotRecords(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting between 1 and 3")
+	}
+	pageSize, bookmark, err := parsePage(args, 1)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	electionID := args[0]
+	if !strings.HasPrefix(electionID, "election.") {
+		electionID = "election." + electionID
+	}
+	electionAsBytes, err := getEntity(stub, electionObjectType, electionID)
+	if err != nil {
+		return shim.Error("Failed to get election: " + electionID)
+	}
+	if electionAsBytes == nil {
+		return shim.Error("election not found")
+	}
+	e := election{}
+	if err := json.Unmarshal(electionAsBytes, &e); err != nil {
+		return shim.Error("Failed to unmarshal the election")
+	}
+
+	// an election stores all of its ballots either publicly or secretly
+	objectType := recordObjectType
+	if e.SecretBallot {
+		objectType = ballotObjectType
+	}
+	encrypted := e.ballotType() == ballotEncrypted || e.ballotType() == ballotHomomorphic
+
+	page, err := scanPage(stub, objectType, []string{electionID}, "", pageSize, bookmark, func(id string, value []byte) (interface{}, error) {
+		if encrypted {
+			return ballotRecord{Key: id, Encrypted: value}, nil
+		}
+		ballot, err := decodeBallot(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode ballot %s: %w", id, err)
+		}
+		return ballotRecord{Key: id, Ballot: ballot}, nil
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	response, _ := json.Marshal(page)
+	return shim.Success(response)
+}
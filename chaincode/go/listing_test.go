@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// pagingStub serves the paginated queries MockStub leaves out the way the
+// peer does, with the bookmark as the key to start at, and counts the keys
+// they read
+type pagingStub struct {
+	*shimtest.MockStub
+	read int
+}
+
+func (s *pagingStub) GetStateByPartialCompositeKeyWithPagination(objectType string, attributes []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	start, err := s.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, nil, err
+	}
+	end := start + string(utf8.MaxRune)
+	if bookmark != "" {
+		start = bookmark
+	}
+	iterator := shimtest.NewMockStateRangeQueryIterator(s.MockStub, start, end)
+	defer iterator.Close()
+	page := &kvIterator{}
+	metadata := &pb.QueryResponseMetadata{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if int32(len(page.kvs)) == pageSize {
+			metadata.Bookmark = kv.Key
+			break
+		}
+		page.kvs = append(page.kvs, kv)
+	}
+	s.read += len(page.kvs)
+	metadata.FetchedRecordsCount = int32(len(page.kvs))
+	return page, metadata, nil
+}
+
+type kvIterator struct {
+	kvs []*queryresult.KV
+}
+
+func (it *kvIterator) HasNext() bool { return len(it.kvs) > 0 }
+func (it *kvIterator) Close() error  { return nil }
+func (it *kvIterator) Next() (*queryresult.KV, error) {
+	kv := it.kvs[0]
+	it.kvs = it.kvs[1:]
+	return kv, nil
+}
+
+func TestQueryVoters(t *testing.T) {
+	stub := newStub(t)
+	admin := stub.Creator
+	electionID := mustInvoke(t, stub, "createElection", "e", "2020-01-01", "2099-01-01")
+	mustInvoke(t, stub, "createCandidate", "Alice", "alice", electionID)
+	mustInvoke(t, stub, "openElection", electionID)
+	for i := 0; i < 40; i++ {
+		mustInvoke(t, stub, "createVoter", fmt.Sprintf("%02d", i))
+	}
+	// every tenth voter votes
+	for i := 0; i < 40; i += 10 {
+		voterID := fmt.Sprintf("voter.%02d", i)
+		stub.Creator = identity(t, map[string]string{roleAttribute: roleVoter, voterIDAttribute: voterID})
+		mustInvoke(t, stub, "vote", voterID, "alice", electionID)
+	}
+	stub.Creator = admin
+
+	paging := &pagingStub{MockStub: stub}
+	list := func(args ...string) ([]string, string, int) {
+		t.Helper()
+		paging.read = 0
+		res := new(VotingChaincode).queryVoters(paging, args)
+		if res.Status != shim.OK {
+			t.Fatalf("queryVoters%v: %s", args, res.Message)
+		}
+		var page struct {
+			Records  []pageRecord `json:"records"`
+			Bookmark string       `json:"bookmark"`
+		}
+		if err := json.Unmarshal(res.Payload, &page); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, record := range page.Records {
+			ids = append(ids, record.Key)
+		}
+		return ids, page.Bookmark, paging.read
+	}
+
+	// voters who voted are read from the index, a page and the key after it
+	// at a time
+	ids, bookmark, read := list("2", "", electionID, "true")
+	if fmt.Sprint(ids) != "[voter.00 voter.10]" || bookmark == "" || read > 4 {
+		t.Errorf("unexpected first page %v %q after reading %d keys", ids, bookmark, read)
+	}
+	ids, bookmark, read = list("2", bookmark, electionID, "true")
+	if fmt.Sprint(ids) != "[voter.20 voter.30]" || read > 4 {
+		t.Errorf("unexpected second page %v %q after reading %d keys", ids, bookmark, read)
+	}
+	if ids, _, _ := list("10", "", "", "true"); len(ids) != 4 {
+		t.Errorf("expected the voters of any election, got %v", ids)
+	}
+	if ids, _, _ := list("10", "", electionID); len(ids) != 4 {
+		t.Errorf("expected the voters of the election, got %v", ids)
+	}
+
+	// a prefix starts at its first voter and ends at the last one
+	ids, bookmark, read = list("5", "", "", "", "2")
+	if fmt.Sprint(ids) != "[voter.20 voter.21 voter.22 voter.23 voter.24]" || bookmark == "" || read > 10 {
+		t.Errorf("unexpected prefix page %v %q after reading %d keys", ids, bookmark, read)
+	}
+	ids, bookmark, read = list("5", bookmark, "", "", "2")
+	if len(ids) != 5 || ids[4] != "voter.29" || bookmark != "" || read > 10 {
+		t.Errorf("unexpected last prefix page %v %q after reading %d keys", ids, bookmark, read)
+	}
+	if ids, _, _ := list("10", "", electionID, "true", "3"); fmt.Sprint(ids) != "[voter.30]" {
+		t.Errorf("expected the voter of the prefix in the index, got %v", ids)
+	}
+
+	// voters who did not vote are still filtered
+	if ids, _, _ := list("50", "", electionID, "false"); len(ids) != 36 {
+		t.Errorf("expected 36 voters who did not vote, got %d", len(ids))
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// listings are paged with the bookmarks of the paginated state queries, which
+// only run in evaluated (read-only) transactions
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// parsePage reads the optional pageSize and bookmark arguments at args[i:]
+func parsePage(args []string, i int) (int32, string, error) {
+	pageSize := defaultPageSize
+	if len(args) > i && args[i] != "" {
+		n, err := strconv.Atoi(args[i])
+		if err != nil || n < 1 || n > maxPageSize {
+			return 0, "", fmt.Errorf("Invalid page size, expecting 1 to %d", maxPageSize)
+		}
+		pageSize = n
+	}
+	bookmark := ""
+	if len(args) > i+1 {
+		bookmark = args[i+1]
+	}
+	return int32(pageSize), bookmark, nil
+}
+
+// maxScannedRecords bounds how many records one filtered page reads. A page
+// that hits it comes back short, with a bookmark to carry on from.
+const maxScannedRecords = 10 * maxPageSize
+
+// recordPage is one page of a filtered listing. Bookmark is empty on the last page.
+type recordPage struct {
+	Records  []interface{} `json:"records"`
+	Bookmark string        `json:"bookmark"`
+	Count    int           `json:"count"`
+}
+
+// pageRecord is a listed record with the ID it is stored under
+type pageRecord struct {
+	Key    string          `json:"Key"`
+	Record json.RawMessage `json:"Record"`
+}
+
+// scanPage collects up to pageSize records of the object type whose keys start
+// with the given attributes, starting at bookmark. collect turns a record,
+// passed with the last attribute of its key, into the listed value or nil to
+// leave it out. Left out records do not count towards the page, so it keeps
+// reading pages of the underlying query until the page is full.
+//
+// Only records whose last attribute starts with prefix are listed. Keys are
+// sorted, so the first page starts at the prefix and the listing ends at the
+// first key past it, rather than filtering every record.
+func scanPage(stub shim.ChaincodeStubInterface, objectType string, attributes []string, prefix string, pageSize int32, bookmark string, collect func(id string, value []byte) (interface{}, error)) (recordPage, error) {
+	page := recordPage{Records: []interface{}{}}
+	if bookmark == "" && prefix != "" {
+		// the bookmarks of range queries are the key to start at
+		start, err := stub.CreateCompositeKey(objectType, append(append([]string{}, attributes...), prefix))
+		if err != nil {
+			return page, err
+		}
+		bookmark = strings.TrimSuffix(start, "\x00")
+	}
+	scanned := 0
+	for {
+		resultsIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(objectType, attributes, pageSize, bookmark)
+		if err != nil {
+			return page, err
+		}
+
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return page, err
+			}
+			_, keyAttributes, err := stub.SplitCompositeKey(queryResponse.Key)
+			if err != nil {
+				resultsIterator.Close()
+				return page, err
+			}
+			// past the prefix, nothing further is listed
+			id := keyAttributes[len(keyAttributes)-1]
+			if !strings.HasPrefix(id, prefix) {
+				resultsIterator.Close()
+				return page, nil
+			}
+			// the page is full, continue from this record next time
+			if int32(len(page.Records)) == pageSize {
+				resultsIterator.Close()
+				page.Bookmark = queryResponse.Key
+				return page, nil
+			}
+			scanned++
+
+			record, err := collect(id, queryResponse.Value)
+			if err != nil {
+				resultsIterator.Close()
+				return page, err
+			}
+			if record != nil {
+				page.Records = append(page.Records, record)
+				page.Count++
+			}
+		}
+		resultsIterator.Close()
+
+		if metadata.FetchedRecordsCount < pageSize || metadata.Bookmark == "" {
+			return page, nil
+		}
+		bookmark = metadata.Bookmark
+		if scanned >= maxScannedRecords {
+			page.Bookmark = bookmark
+			return page, nil
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha256"
+	"math/big"
+	"strings"
+)
+
+// Clients and trustees prove what they submit with non-interactive
+// Chaum-Pedersen proofs, made non-interactive with the Fiat-Shamir heuristic.
+// A proof (e, f) that log_g1(y1) = log_g2(y2) = x is checked by recomputing the
+// commitments a = g1^f / y1^e and b = g2^f / y2^e and comparing e with the
+// hash of the statement and the commitments. Decryption shares prove they use
+// the trustee's key share, homomorphic ballots that every ciphertext encrypts
+// 0 or 1 (a disjunction of two such proofs) and that they encrypt 1 in total.
+// The hash covers a context, the election ID, so a proof does not carry over
+// to another election. The ballot package of the REST server builds them.
+
+// dleqProof proves two discrete logarithms equal, e and f are hex mod q
+type dleqProof struct {
+	E string `json:"e"`
+	F string `json:"f"`
+}
+
+// zeroOneProof proves a ciphertext encrypts 0 or 1, one Chaum-Pedersen proof
+// per plaintext of which only one is real, with e0 + e1 the challenge
+type zeroOneProof struct {
+	E0 string `json:"e0"`
+	F0 string `json:"f0"`
+	E1 string `json:"e1"`
+	F1 string `json:"f1"`
+}
+
+// challenge hashes the tag, the context and the elements into a challenge mod q
+func challenge(tag, context string, elements ...*big.Int) *big.Int {
+	parts := []string{"fabric-voting", tag, context}
+	for _, element := range elements {
+		parts = append(parts, element.Text(16))
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "|")))
+	return new(big.Int).Mod(new(big.Int).SetBytes(sum[:]), groupQ)
+}
+
+// parseExponent reads a hex encoded exponent mod q
+func parseExponent(value string) (*big.Int, bool) {
+	n, ok := new(big.Int).SetString(value, 16)
+	if !ok || n.Sign() < 0 || n.Cmp(groupQ) >= 0 {
+		return nil, false
+	}
+	return n, true
+}
+
+// commitment recomputes base^f / y^e
+func commitment(base, y, e, f *big.Int) *big.Int {
+	a := new(big.Int).Exp(base, f, groupP)
+	ye := new(big.Int).Exp(y, e, groupP)
+	return a.Mul(a, ye.ModInverse(ye, groupP)).Mod(a, groupP)
+}
+
+// verifyDLEQ checks a proof that log_g1(y1) = log_g2(y2)
+func verifyDLEQ(context string, g1, y1, g2, y2 *big.Int, proof dleqProof) bool {
+	e, ok := parseExponent(proof.E)
+	if !ok {
+		return false
+	}
+	f, ok := parseExponent(proof.F)
+	if !ok {
+		return false
+	}
+	a, b := commitment(g1, y1, e, f), commitment(g2, y2, e, f)
+	return challenge("dleq", context, g1, y1, g2, y2, a, b).Cmp(e) == 0
+}
+
+// verifyZeroOne checks a proof that (c1, c2) encrypts 0 or 1 under h
+func verifyZeroOne(context string, h, c1, c2 *big.Int, proof zeroOneProof) bool {
+	var es, commitments []*big.Int
+	for m, p := range [][2]string{{proof.E0, proof.F0}, {proof.E1, proof.F1}} {
+		e, ok := parseExponent(p[0])
+		if !ok {
+			return false
+		}
+		f, ok := parseExponent(p[1])
+		if !ok {
+			return false
+		}
+		// c2 / g^m = h^r if the ciphertext encrypts m
+		y := new(big.Int).Exp(groupG, big.NewInt(int64(m)), groupP)
+		y.Mul(c2, y.ModInverse(y, groupP)).Mod(y, groupP)
+		es = append(es, e)
+		commitments = append(commitments, commitment(groupG, c1, e, f), commitment(h, y, e, f))
+	}
+	sum := new(big.Int).Add(es[0], es[1])
+	sum.Mod(sum, groupQ)
+	return challenge("zero-one", context, append([]*big.Int{h, c1, c2}, commitments...)...).Cmp(sum) == 0
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// one counting round of an instant-runoff tally
+type runoffRound struct {
+	Round      int            `json:"round"`
+	Tally      map[string]int `json:"tally"`
+	Exhausted  int            `json:"exhausted"`
+	Eliminated []string       `json:"eliminated"`
+}
+
+type rankedResult struct {
+	ElectionID string        `json:"electionID"`
+	Winner     string        `json:"winner"`
+	Rounds     []runoffRound `json:"rounds"`
+}
+
+// vote with a ranked ballot
+// args: voterID, JSON array of candidate IDs (most preferred first), electionID
+func (t *VotingChaincode) voteRanked(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	var ranking []string
+	if err := json.Unmarshal([]byte(args[1]), &ranking); err != nil {
+		return shim.Error("Failed to unmarshal ranking")
+	}
+	if len(ranking) == 0 {
+		return shim.Error("ranking must contain at least one candidate")
+	}
+
+	ElectionID := args[2]
+	if !strings.HasPrefix(ElectionID, "election.") {
+		ElectionID = "election." + ElectionID
+	}
+
+	ranking, err := validateChoices(stub, ElectionID, ranking)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return t.castBallot(stub, args[0], ElectionID, ballotRanked, ranking)
+}
+
+// getRankedResult runs the instant-runoff tally of a ranked election and
+// returns every counting round with the candidates eliminated in it
+func (t *VotingChaincode) getRankedResult(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	electionID := args[0]
+	if !strings.HasPrefix(electionID, "election.") {
+		electionID = "election." + electionID
+	}
+
+	electionAsBytes, err := getEntity(stub, electionObjectType, electionID)
+	if err != nil {
+		return shim.Error("Failed to get election: " + electionID)
+	}
+	if electionAsBytes == nil {
+		return shim.Error("election not found")
+	}
+	e := election{}
+	if err := json.Unmarshal(electionAsBytes, &e); err != nil {
+		return shim.Error("Failed to unmarshal the election")
+	}
+	if e.ballotType() != ballotRanked {
+		return shim.Error("election is not a ranked election")
+	}
+	if err := resultsVisible(stub, e); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	candidates, err := getElectionCandidateIDs(stub, electionID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ballots, err := getBallots(stub, electionID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result := instantRunoff(candidates, ballots)
+	result.ElectionID = electionID
+
+	response, err := json.Marshal(result)
+	if err != nil {
+		fmt.Println("failed to marshal response", err)
+		return shim.Error("failed to create response")
+	}
+	return shim.Success(response)
+}
+
+// instantRunoff counts each ballot for its highest ranked continuing candidate
+// until one candidate holds a majority of the continuing ballots. The candidate
+// with the fewest votes is eliminated after every round; ties on the fewest votes
+// eliminate all tied candidates at once unless that would leave no one, in which
+// case the one sorting first by ID is dropped so the count stays deterministic.
+func instantRunoff(candidates []string, ballots [][]string) rankedResult {
+	result := rankedResult{Rounds: []runoffRound{}}
+
+	continuing := make(map[string]bool)
+	for _, c := range candidates {
+		continuing[c] = true
+	}
+
+	for round := 1; len(continuing) > 0; round++ {
+		r := runoffRound{Round: round, Tally: make(map[string]int), Eliminated: []string{}}
+		for c := range continuing {
+			r.Tally[c] = 0
+		}
+
+		active := 0
+		for _, ballot := range ballots {
+			counted := false
+			for _, c := range ballot {
+				if continuing[c] {
+					r.Tally[c]++
+					counted = true
+					break
+				}
+			}
+			if counted {
+				active++
+			} else {
+				r.Exhausted++
+			}
+		}
+
+		// nobody left to count, the election has no winner
+		if active == 0 {
+			result.Rounds = append(result.Rounds, r)
+			return result
+		}
+
+		names := make([]string, 0, len(continuing))
+		for c := range continuing {
+			names = append(names, c)
+		}
+		sort.Strings(names)
+
+		leader := names[0]
+		for _, c := range names {
+			if r.Tally[c] > r.Tally[leader] {
+				leader = c
+			}
+		}
+		if r.Tally[leader]*2 > active || len(names) == 1 {
+			result.Winner = leader
+			result.Rounds = append(result.Rounds, r)
+			return result
+		}
+
+		lowest := r.Tally[names[0]]
+		for _, c := range names {
+			if r.Tally[c] < lowest {
+				lowest = r.Tally[c]
+			}
+		}
+		for _, c := range names {
+			if r.Tally[c] == lowest {
+				r.Eliminated = append(r.Eliminated, c)
+			}
+		}
+		if len(r.Eliminated) == len(names) {
+			r.Eliminated = r.Eliminated[:1]
+		}
+		for _, c := range r.Eliminated {
+			delete(continuing, c)
+		}
+		result.Rounds = append(result.Rounds, r)
+	}
+
+	return result
+}
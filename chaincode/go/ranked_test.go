@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInstantRunoff(t *testing.T) {
+	for name, test := range map[string]struct {
+		candidates []string
+		ballots    [][]string
+		winner     string
+		// eliminated by round, the last round elects or finds no winner
+		eliminated [][]string
+		exhausted  int
+	}{
+		"majority in the first round": {
+			candidates: []string{"a", "b", "c"},
+			ballots:    [][]string{{"a"}, {"a", "b"}, {"b"}},
+			winner:     "a",
+			eliminated: [][]string{{}},
+		},
+		"votes transfer from the eliminated": {
+			candidates: []string{"a", "b", "c"},
+			ballots:    [][]string{{"a"}, {"a"}, {"b"}, {"b"}, {"c", "b"}},
+			winner:     "b",
+			eliminated: [][]string{{"c"}, {}},
+		},
+		"tied lowest are eliminated together": {
+			candidates: []string{"a", "b", "c"},
+			ballots:    [][]string{{"a"}, {"a"}, {"b", "c"}, {"c", "b"}},
+			winner:     "a",
+			eliminated: [][]string{{"b", "c"}, {}},
+			exhausted:  2,
+		},
+		"all tied drops the first by ID": {
+			candidates: []string{"a", "b"},
+			ballots:    [][]string{{"a"}, {"b"}},
+			winner:     "b",
+			eliminated: [][]string{{"a"}, {}},
+			exhausted:  1,
+		},
+		"unknown candidates exhaust the ballot": {
+			candidates: []string{"a", "b"},
+			ballots:    [][]string{{"x"}, {"x", "b"}, {"a"}},
+			winner:     "b",
+			eliminated: [][]string{{"a"}, {}},
+			exhausted:  2,
+		},
+		"no ballots": {
+			candidates: []string{"a", "b"},
+			winner:     "",
+			eliminated: [][]string{{}},
+		},
+	} {
+		result := instantRunoff(test.candidates, test.ballots)
+		var eliminated [][]string
+		for _, r := range result.Rounds {
+			eliminated = append(eliminated, r.Eliminated)
+		}
+		if result.Winner != test.winner || !reflect.DeepEqual(eliminated, test.eliminated) {
+			t.Errorf("%s: expected %q after eliminating %v, got %q after %v", name, test.winner, test.eliminated, result.Winner, eliminated)
+			continue
+		}
+		if last := result.Rounds[len(result.Rounds)-1]; last.Exhausted != test.exhausted {
+			t.Errorf("%s: expected %d exhausted ballots in the last round, got %d", name, test.exhausted, last.Exhausted)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// Every vote returns a receipt holding the transaction ID and a commitment,
+// sha256 over a nonce and the recorded ballot. The nonce is passed in the
+// transient field "nonce" so it never reaches the block; only the voter holds
+// it and with it can check that the ballot stored for their transaction is the
+// one they cast. The receipt alone tells nobody else what the ballot holds.
+//
+// The receipt is stored under receipt~<hash of the nonce> with the key of the
+// ballot sealed by the nonce, so world state maps neither a transaction nor a
+// receipt to a ballot; only the voter can find their ballot from it. Votes
+// submitted without a nonce are refused, their commitment could be matched
+// against every candidate.
+
+// receipt is what the voter keeps
+type receipt struct {
+	TxID       string `json:"txID"`
+	ElectionID string `json:"electionID"`
+	Commitment string `json:"commitment"`
+}
+
+// receiptRecord is what is stored, SealedBallotKey is the key of the ballot
+// encrypted with the nonce under the GCM nonce SealNonce
+type receiptRecord struct {
+	receipt
+	SealNonce       string `json:"sealNonce"`
+	SealedBallotKey string `json:"sealedBallotKey"`
+}
+
+// receiptVerification is the answer to verifyReceipt. Recorded tells whether
+// the ballot is still in world state, Verified whether it matches the
+// commitment, which can only be checked with the voter's nonce.
+type receiptVerification struct {
+	receipt
+	Recorded bool `json:"recorded"`
+	Verified bool `json:"verified"`
+}
+
+// ballotCommitment binds the nonce to the ballot as it is stored in world state
+func ballotCommitment(nonce, ballot []byte) string {
+	h := sha256.New()
+	h.Write([]byte("receipt|"))
+	h.Write(nonce)
+	h.Write([]byte("|"))
+	h.Write(ballot)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ballotNonce reads the voter's nonce from the transient data of the proposal
+func ballotNonce(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return nil, err
+	}
+	return transient["nonce"], nil
+}
+
+// receiptID is the ID the receipt of a nonce is stored under
+func receiptID(nonce []byte) string {
+	sum := sha256.Sum256(append([]byte("receipt-id|"), nonce...))
+	return hex.EncodeToString(sum[:])
+}
+
+// ballotSeal returns the cipher sealing the ballot key of a receipt
+func ballotSeal(nonce []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(append([]byte("seal|"), nonce...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealNonce returns the GCM nonce of the current transaction. Every endorsing
+// peer must write the same receipt, so it is not read from crypto/rand but
+// hashed from the transaction ID, itself a hash over random bytes of the client.
+func sealNonce(stub shim.ChaincodeStubInterface, size int) []byte {
+	sum := sha256.Sum256([]byte("seal-nonce|" + stub.GetTxID()))
+	return sum[:size]
+}
+
+// putReceipt records the receipt of the ballot written by the current
+// transaction and returns it as JSON
+func putReceipt(stub shim.ChaincodeStubInterface, electionID, ballotKey string, ballot []byte) ([]byte, error) {
+	nonce, err := ballotNonce(stub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transient data: %w", err)
+	}
+	if len(nonce) == 0 {
+		return nil, fmt.Errorf("the nonce of the receipt is required in the transient field \"nonce\"")
+	}
+
+	r := receiptRecord{
+		receipt: receipt{
+			TxID:       stub.GetTxID(),
+			ElectionID: electionID,
+			Commitment: ballotCommitment(nonce, ballot),
+		},
+	}
+	existing, err := getEntity(stub, receiptObjectType, receiptID(nonce))
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("receipt nonce was already used")
+	}
+	aead, err := ballotSeal(nonce)
+	if err != nil {
+		return nil, err
+	}
+	iv := sealNonce(stub, aead.NonceSize())
+	r.SealNonce = hex.EncodeToString(iv)
+	r.SealedBallotKey = hex.EncodeToString(aead.Seal(nil, iv, []byte(ballotKey), nil))
+	recordAsBytes, _ := json.Marshal(r)
+	if err := putEntity(stub, receiptObjectType, receiptID(nonce), recordAsBytes); err != nil {
+		return nil, err
+	}
+	return json.Marshal(r.receipt)
+}
+
+// verifyReceipt checks a receipt against committed state, the receipt is
+// found by the voter's nonce
+// args: txID, with the voter's nonce in the transient field "nonce"
+func (t *VotingChaincode) verifyReceipt(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	nonce, err := ballotNonce(stub)
+	if err != nil {
+		return shim.Error("Failed to get transient data")
+	}
+	if len(nonce) == 0 {
+		return shim.Error("the nonce of the receipt is required")
+	}
+	recordAsBytes, err := getEntity(stub, receiptObjectType, receiptID(nonce))
+	if err != nil {
+		return shim.Error("Failed to get receipt")
+	}
+	r := receiptRecord{}
+	if recordAsBytes != nil {
+		if err := json.Unmarshal(recordAsBytes, &r); err != nil {
+			return shim.Error("Failed to unmarshal receipt")
+		}
+	}
+	if recordAsBytes == nil || r.TxID != args[0] {
+		return shim.Error("receipt not found")
+	}
+
+	aead, err := ballotSeal(nonce)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	iv, err := hex.DecodeString(r.SealNonce)
+	if err != nil || len(iv) != aead.NonceSize() {
+		return shim.Error("Invalid receipt")
+	}
+	sealed, err := hex.DecodeString(r.SealedBallotKey)
+	if err != nil {
+		return shim.Error("Invalid receipt")
+	}
+	ballotKey, err := aead.Open(nil, iv, sealed, nil)
+	if err != nil {
+		return shim.Error("Invalid receipt")
+	}
+	ballotAsBytes, err := stub.GetState(string(ballotKey))
+	if err != nil {
+		return shim.Error("Failed to get ballot")
+	}
+
+	verification := receiptVerification{
+		receipt:  r.receipt,
+		Recorded: ballotAsBytes != nil,
+		Verified: ballotAsBytes != nil && ballotCommitment(nonce, ballotAsBytes) == r.Commitment,
+	}
+	response, _ := json.Marshal(verification)
+	return shim.Success(response)
+}
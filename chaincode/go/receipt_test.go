@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+func TestReceipts(t *testing.T) {
+	stub := newStub(t)
+	admin := stub.Creator
+	public := mustInvoke(t, stub, "createElection", "public", "2020-01-01", "2099-01-01")
+	secret := mustInvoke(t, stub, "createElection", "secret", "2020-01-01", "2099-01-01", "plurality", "1", "1", "true")
+	for _, electionID := range []string{public, secret} {
+		mustInvoke(t, stub, "createCandidate", "Alice "+electionID, "alice", electionID)
+		mustInvoke(t, stub, "openElection", electionID)
+	}
+	mustInvoke(t, stub, "createVoter", "1")
+	stub.Creator = identity(t, map[string]string{roleAttribute: roleVoter, voterIDAttribute: "voter.1"})
+
+	for _, electionID := range []string{public, secret} {
+		nonce := []byte("nonce of " + electionID)
+		stub.TransientMap = map[string][]byte{"nonce": nonce, ballotKeyField: []byte("ballot key of " + electionID)}
+		var r receipt
+		if err := json.Unmarshal([]byte(mustInvoke(t, stub, "vote", "voter.1", "alice", electionID)), &r); err != nil {
+			t.Fatal(err)
+		}
+
+		// the stored receipt leads from the transaction to no ballot
+		for key, value := range stub.State {
+			if !strings.HasPrefix(key, "\x00"+receiptObjectType) {
+				continue
+			}
+			// composite keys are JSON encoded with their null bytes escaped
+			if strings.Contains(key, r.TxID) || strings.Contains(string(value), `\u0000`) {
+				t.Errorf("%s: expected the receipt not to name the ballot key, got %q %s", electionID, key, value)
+			}
+		}
+
+		var verification receiptVerification
+		if err := json.Unmarshal([]byte(mustInvoke(t, stub, "verifyReceipt", r.TxID)), &verification); err != nil {
+			t.Fatal(err)
+		}
+		if !verification.Recorded || !verification.Verified || verification.Commitment != r.Commitment {
+			t.Errorf("%s: expected the receipt to verify, got %+v", electionID, verification)
+		}
+		if res := invoke(stub, "verifyReceipt", "tx0"); res.Status == shim.OK {
+			t.Errorf("%s: expected the receipt of another transaction not to be found", electionID)
+		}
+		stub.TransientMap = map[string][]byte{"nonce": []byte("guessed")}
+		if res := invoke(stub, "verifyReceipt", r.TxID); res.Status == shim.OK {
+			t.Errorf("%s: expected another nonce not to find the receipt", electionID)
+		}
+		stub.TransientMap = nil
+		if res := invoke(stub, "verifyReceipt", r.TxID); res.Status == shim.OK {
+			t.Errorf("%s: expected the nonce to be required", electionID)
+		}
+	}
+
+	// a nonce seals one ballot key only
+	stub.Creator = admin
+	mustInvoke(t, stub, "createVoter", "2")
+	stub.Creator = identity(t, map[string]string{roleAttribute: roleVoter, voterIDAttribute: "voter.2"})
+	stub.TransientMap = map[string][]byte{"nonce": []byte("nonce of " + public)}
+	if res := invoke(stub, "vote", "voter.2", "alice", public); res.Status == shim.OK {
+		t.Error("expected a used nonce to be refused")
+	}
+
+	// a vote without nonce would get a receipt nobody can keep secret, the
+	// mock stub keeps the writes of refused votes so another voter casts it
+	stub.Creator = admin
+	mustInvoke(t, stub, "createVoter", "3")
+	stub.Creator = identity(t, map[string]string{roleAttribute: roleVoter, voterIDAttribute: "voter.3"})
+	stub.TransientMap = map[string][]byte{}
+	if res := invoke(stub, "vote", "voter.3", "alice", public); !strings.HasPrefix(res.Message, "the nonce of the receipt is required") {
+		t.Errorf("expected a vote without nonce to be refused, got %q", res.Message)
+	}
+	stub.TransientMap = nil
+
+	// every receipt is sealed under a GCM nonce of its own
+	sealNonces := make(map[string]bool)
+	for key, value := range stub.State {
+		if !strings.HasPrefix(key, "\x00"+receiptObjectType) {
+			continue
+		}
+		var record receiptRecord
+		if err := json.Unmarshal(value, &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.SealNonce == "" || sealNonces[record.SealNonce] {
+			t.Errorf("expected a GCM nonce of its own, got %q", record.SealNonce)
+		}
+		sealNonces[record.SealNonce] = true
+	}
+	if len(sealNonces) != 2 {
+		t.Errorf("expected two stored receipts, got %d", len(sealNonces))
+	}
+}
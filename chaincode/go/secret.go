@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// Secret ballot elections keep ballot keys that nothing on the ledger ties to
+// the voter. The voter record only keeps a nullifier, a hash of the election
+// and voter IDs that proves participation and blocks a second vote, while the
+// ballot is stored under ballot~<election>~<hash of a random key>. The key is
+// picked by the client for every ballot and passed in the transient field
+// "ballotKey", so it never reaches the block and cannot be derived from the
+// voter, the nullifier or the transaction ID. getVoter, the voter listings and
+// range queries over ballots reveal who voted but not for whom.
+
+// ballotKeyField is the transient field holding the random key of a secret ballot
+const ballotKeyField = "ballotKey"
+
+// minBallotKeyLength is the least number of random bytes a ballot key has,
+// enough that it cannot be guessed
+const minBallotKeyLength = 16
+
+// ballotNullifier is the participation proof of a voter in an election
+func ballotNullifier(electionID, voterID string) string {
+	sum := sha256.Sum256([]byte("nullifier|" + electionID + "|" + voterID))
+	return hex.EncodeToString(sum[:])
+}
+
+// secretBallotKey returns the key the ballot of the current transaction is
+// stored under, derived from the random key in the transient data
+func secretBallotKey(stub shim.ChaincodeStubInterface, electionID string) (string, error) {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return "", fmt.Errorf("failed to get transient data: %w", err)
+	}
+	random := transient[ballotKeyField]
+	if len(random) < minBallotKeyLength {
+		return "", fmt.Errorf("secret ballots need a random key of at least %d bytes in the transient field %q", minBallotKeyLength, ballotKeyField)
+	}
+	sum := sha256.Sum256(append([]byte("ballot|"), random...))
+	key, err := stub.CreateCompositeKey(ballotObjectType, []string{electionID, hex.EncodeToString(sum[:])})
+	if err != nil {
+		return "", err
+	}
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		return "", fmt.Errorf("ballot key was already used")
+	}
+	return key, nil
+}
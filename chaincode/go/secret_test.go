@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSecretBallotKey(t *testing.T) {
+	stub := newStub(t)
+	admin := stub.Creator
+	electionID := mustInvoke(t, stub, "createElection", "secret", "2020-01-01", "2099-01-01", "plurality", "1", "1", "true")
+	mustInvoke(t, stub, "createCandidate", "Alice", "alice", electionID)
+	mustInvoke(t, stub, "openElection", electionID)
+	vote := func(voterID string, transient map[string][]byte) string {
+		stub.Creator = admin
+		mustInvoke(t, stub, "createVoter", strings.TrimPrefix(voterID, "voter."))
+		stub.Creator = identity(t, map[string]string{roleAttribute: roleVoter, voterIDAttribute: voterID})
+		defer func() { stub.Creator, stub.TransientMap = admin, nil }()
+		stub.TransientMap = transient
+		return invoke(stub, "vote", voterID, "alice", electionID).Message
+	}
+
+	for i, transient := range []map[string][]byte{{}, {ballotKeyField: []byte("short")}} {
+		if message := vote("voter.refused"+strconv.Itoa(i), transient); !strings.HasPrefix(message, "secret ballots need a random key") {
+			t.Errorf("expected a ballot without a random key to be refused, got %q", message)
+		}
+	}
+
+	random := []byte("0123456789abcdef")
+	if message := vote("voter.1", map[string][]byte{"nonce": []byte("nonce 1"), ballotKeyField: random}); message != "" {
+		t.Fatalf("expected the vote to be cast, got %q", message)
+	}
+	// the ballot is found by the random key only
+	sum := sha256.Sum256(append([]byte("ballot|"), random...))
+	key, _ := stub.CreateCompositeKey(ballotObjectType, []string{electionID, hex.EncodeToString(sum[:])})
+	if value, _ := stub.GetState(key); string(value) != "candidate.alice" {
+		t.Errorf("expected the ballot under the random key, got %q", value)
+	}
+	txSum := sha256.Sum256([]byte("ballot|" + fmt.Sprintf("tx%d", txCount)))
+	if strings.Contains(key, hex.EncodeToString(txSum[:])) {
+		t.Error("expected the ballot key not to follow from the transaction")
+	}
+
+	if message := vote("voter.2", map[string][]byte{"nonce": []byte("nonce 2"), ballotKeyField: random}); message != "ballot key was already used" {
+		t.Errorf("expected a used ballot key to be refused, got %q", message)
+	}
+}